@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// A post or chat message carries at most this many files
+	maxAttachments = 10
+	// Room for the multipart boundaries and part headers around the file
+	multipartOverhead = 64 << 10
+	// Uploads decoded at the same time; a 4096x4096 image is 64MB as RGBA
+	maxConcurrentDecodes = 4
+	maxFilenameRunes     = 255
+	// How often uploads nobody claimed are looked for
+	unclaimedSweepInterval = time.Hour
+)
+
+// Uploads are sniffed, never trusted by extension or declared type. Images
+// are the only types shown inline; everything else is served as a download.
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+var ErrAttachmentNotFound = errors.New("attachment not found")
+
+// Attachment is an uploaded file. It belongs to nobody until a post or
+// message claims it; until then only the uploader can download it, and it
+// is deleted if nothing claims it within uploads.unclaimed_ttl.
+type Attachment struct {
+	UUID         string    `json:"uuid"`
+	UploaderUUID string    `json:"uploader_uuid"`
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	Width        int       `json:"width,omitempty"` // images only
+	Height       int       `json:"height,omitempty"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+	HasThumbnail bool      `json:"-"`
+	OwnerType    string    `json:"-"` // "", post or message
+	OwnerUUID    string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (a *Attachment) setURLs() {
+	a.URL = "/attachments/" + a.UUID
+	a.ThumbnailURL = ""
+	if a.HasThumbnail {
+		a.ThumbnailURL = a.URL + "/thumbnail"
+	}
+}
+
+func (a *Attachment) isImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+// thumbnailType is the format thumbnails of a are encoded in
+func (a *Attachment) thumbnailType() string {
+	if a.ContentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+func thumbnailKey(attachmentUUID string) string {
+	return attachmentUUID + "-thumb"
+}
+
+// sanitizeFilename keeps the base name of what the client sent, without
+// control characters, so it is safe to echo in Content-Disposition
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if runes := []rune(name); len(runes) > maxFilenameRunes {
+		name = string(runes[:maxFilenameRunes])
+	}
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+// UploadAttachmentHandler stores the "file" part of a multipart form and
+// returns the new attachment, ready to be referenced by a post or message
+func (s *Server) UploadAttachmentHandler() http.HandlerFunc {
+	maxBytes := s.cfg.Uploads.MaxBytes
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		file, ok := readUpload(w, r, maxBytes)
+		if !ok {
+			return
+		}
+		data := file.data
+
+		contentType := http.DetectContentType(data)
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if !allowedAttachmentTypes[mediaType] {
+			writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedType, "Files of type "+mediaType+" are not accepted")
+			return
+		}
+
+		a := Attachment{
+			UUID:         uuid.New().String(),
+			UploaderUUID: userUUID,
+			Filename:     file.filename,
+			ContentType:  contentType,
+			Size:         int64(len(data)),
+			CreatedAt:    time.Now(),
+		}
+
+		var thumbnail []byte
+		if a.isImage() {
+			var errs ValidationErrors
+			thumbnail, errs = s.processImage(&a, data)
+			if len(errs) > 0 {
+				writeValidationErrors(w, errs)
+				return
+			}
+		}
+
+		if err := s.blobs.Put(a.UUID, data); err != nil {
+			writeServerError(w, "Failed to store upload", err)
+			return
+		}
+		if thumbnail != nil {
+			if err := s.blobs.Put(thumbnailKey(a.UUID), thumbnail); err != nil {
+				s.blobs.Delete(a.UUID)
+				writeServerError(w, "Failed to store thumbnail", err)
+				return
+			}
+			a.HasThumbnail = true
+		}
+		if err := s.attachments.CreateAttachment(a); err != nil {
+			s.blobs.Delete(a.UUID)
+			s.blobs.Delete(thumbnailKey(a.UUID))
+			writeServerError(w, "Failed to save attachment", err)
+			return
+		}
+
+		a.setURLs()
+		writeData(w, http.StatusCreated, a)
+	}
+}
+
+// SweepUnclaimedAttachments deletes uploads that no post or message claimed
+// within the configured time, now and then hourly until ctx is done
+func (s *Server) SweepUnclaimedAttachments(ctx context.Context) {
+	ticker := time.NewTicker(unclaimedSweepInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := s.deleteUnclaimedAttachments(time.Now()); err != nil {
+			log.Printf("Error deleting unclaimed attachments: %v", err)
+		} else if n > 0 {
+			log.Printf("Deleted %d unclaimed attachments", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deleteUnclaimedAttachments removes the expired unclaimed uploads and then
+// their blobs. A blob that fails to delete is only logged; its row is gone,
+// so nothing can reference it any more.
+func (s *Server) deleteUnclaimedAttachments(now time.Time) (int, error) {
+	deleted, err := s.attachments.DeleteUnclaimedAttachments(now.Add(-s.cfg.Uploads.UnclaimedTTL.Duration()))
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range deleted {
+		keys := []string{a.UUID}
+		if a.HasThumbnail {
+			keys = append(keys, thumbnailKey(a.UUID))
+		}
+		for _, key := range keys {
+			if err := s.blobs.Delete(key); err != nil {
+				log.Printf("Error deleting blob %s: %v", key, err)
+			}
+		}
+	}
+	return len(deleted), nil
+}
+
+// uploadedFile is the "file" part of a multipart form together with the small
+// text fields sent before it
+type uploadedFile struct {
+	filename string
+	data     []byte
+	fields   map[string]string
+}
+
+// Text fields next to an upload are short options such as crop offsets
+const maxUploadFieldBytes = 1024
+
+// readUpload reads a multipart body holding a non-empty "file" of at most
+// maxBytes, writing the error response when there is none
+func readUpload(w http.ResponseWriter, r *http.Request, maxBytes int64) (*uploadedFile, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+multipartOverhead)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Expected a multipart/form-data body")
+		return nil, false
+	}
+
+	u := &uploadedFile{fields: map[string]string{}}
+	for u.data == nil {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeUploadReadError(w, err, maxBytes)
+			return nil, false
+		}
+
+		name := part.FormName()
+		switch {
+		case name == "file":
+			u.filename = sanitizeFilename(part.FileName())
+			u.data, err = io.ReadAll(io.LimitReader(part, maxBytes+1))
+		case part.FileName() == "":
+			var value []byte
+			value, err = io.ReadAll(io.LimitReader(part, maxUploadFieldBytes))
+			u.fields[name] = string(value)
+		}
+		part.Close()
+		if err != nil {
+			writeUploadReadError(w, err, maxBytes)
+			return nil, false
+		}
+	}
+
+	switch {
+	case u.data == nil:
+		writeValidationErrors(w, ValidationErrors{"file": "file is required"})
+		return nil, false
+	case int64(len(u.data)) > maxBytes:
+		writeTooLarge(w, maxBytes)
+		return nil, false
+	case len(u.data) == 0:
+		writeValidationErrors(w, ValidationErrors{"file": "file is empty"})
+		return nil, false
+	}
+	return u, true
+}
+
+func writeTooLarge(w http.ResponseWriter, maxBytes int64) {
+	writeError(w, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("Files may be at most %d bytes", maxBytes))
+}
+
+// writeUploadReadError tells an oversized body apart from a malformed one
+func writeUploadReadError(w http.ResponseWriter, err error, maxBytes int64) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeTooLarge(w, maxBytes)
+		return
+	}
+	writeError(w, http.StatusBadRequest, codeInvalidRequest, "Malformed multipart body")
+}
+
+// acquireDecodeSlot blocks until an image may be decoded; call the returned
+// func once the decoded image is no longer needed
+func (s *Server) acquireDecodeSlot() func() {
+	s.decodeSlots <- struct{}{}
+	return func() { <-s.decodeSlots }
+}
+
+// decodeImage checks an uploaded image's dimensions before decoding it, so
+// a small file cannot claim a huge canvas. Hold a decode slot while using
+// the result.
+func (s *Server) decodeImage(data []byte) (image.Image, ValidationErrors) {
+	limit := s.cfg.Uploads.MaxImageDimension
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, ValidationErrors{"file": "file is not a valid image"}
+	}
+	if cfg.Width > limit || cfg.Height > limit {
+		return nil, ValidationErrors{"file": fmt.Sprintf("images may be at most %dx%d pixels", limit, limit)}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ValidationErrors{"file": "file is not a valid image"}
+	}
+	return img, nil
+}
+
+// processImage records an uploaded image's dimensions and returns its thumbnail
+func (s *Server) processImage(a *Attachment, data []byte) ([]byte, ValidationErrors) {
+	release := s.acquireDecodeSlot()
+	defer release()
+
+	img, errs := s.decodeImage(data)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	a.Width, a.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+	thumbnail, err := encodeThumbnail(img, s.cfg.Uploads.ThumbnailSize, a.thumbnailType())
+	if err != nil {
+		// The upload itself is fine; clients fall back to the full image
+		log.Printf("Error creating thumbnail: %v", err)
+		return nil, nil
+	}
+	return thumbnail, nil
+}
+
+// encodeThumbnail scales img to fit in a size×size box, never enlarging it
+func encodeThumbnail(img image.Image, size int, contentType string) ([]byte, error) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	tw, th := w, h
+	if w > size || h > size {
+		if w >= h {
+			tw, th = size, max(1, h*size/w)
+		} else {
+			tw, th = max(1, w*size/h), size
+		}
+	}
+
+	thumb := resize(img, bounds, tw, th)
+
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	return buf.Bytes(), err
+}
+
+// resize scales the r part of src to tw×th, averaging the source pixels
+// covered by each target pixel and repeating pixels when enlarging. Source
+// rows are converted to RGBA one at a time, so the source is never copied
+// whole. RGBA is premultiplied, so transparent edges do not darken.
+func resize(src image.Image, r image.Rectangle, tw, th int) *image.RGBA {
+	w, h := r.Dx(), r.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	row := image.NewRGBA(image.Rect(0, 0, w, 1))
+	sums := make([]int, tw*4)
+
+	for y := 0; y < th; y++ {
+		y0, y1 := y*h/th, max((y+1)*h/th, y*h/th+1)
+		clear(sums)
+		for sy := y0; sy < y1; sy++ {
+			draw.Draw(row, row.Bounds(), src, image.Pt(r.Min.X, r.Min.Y+sy), draw.Src)
+			for x := 0; x < tw; x++ {
+				x0, x1 := x*w/tw, max((x+1)*w/tw, x*w/tw+1)
+				for i := x0 * 4; i < x1*4; i += 4 {
+					sums[x*4] += int(row.Pix[i])
+					sums[x*4+1] += int(row.Pix[i+1])
+					sums[x*4+2] += int(row.Pix[i+2])
+					sums[x*4+3] += int(row.Pix[i+3])
+				}
+			}
+		}
+		for x := 0; x < tw; x++ {
+			x0, x1 := x*w/tw, max((x+1)*w/tw, x*w/tw+1)
+			n := (y1 - y0) * (x1 - x0)
+			o := y*dst.Stride + x*4
+			for c := 0; c < 4; c++ {
+				dst.Pix[o+c] = uint8(sums[x*4+c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// ServeAttachmentHandler streams an attachment, or its thumbnail, to
+// whoever may see what it is attached to: anyone for live posts, only the
+// two participants for chat messages, only the uploader while unattached.
+// Attachments the viewer may not see are reported as missing.
+func (s *Server) ServeAttachmentHandler(thumbnail bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a, err := s.attachments.GetAttachment(mux.Vars(r)["uuid"])
+		if errors.Is(err, ErrAttachmentNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Attachment not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to fetch attachment", err)
+			return
+		}
+
+		public, allowed, err := s.attachmentAccess(r, a)
+		if err != nil {
+			writeServerError(w, "Failed to check attachment access", err)
+			return
+		}
+		if !allowed {
+			if _, signedIn := UserUUIDFromContext(r.Context()); !signedIn {
+				writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+				return
+			}
+			writeError(w, http.StatusNotFound, codeNotFound, "Attachment not found")
+			return
+		}
+
+		key, contentType := a.UUID, a.ContentType
+		if thumbnail {
+			if !a.HasThumbnail {
+				writeError(w, http.StatusNotFound, codeNotFound, "Attachment has no thumbnail")
+				return
+			}
+			key, contentType = thumbnailKey(a.UUID), a.thumbnailType()
+		}
+
+		blob, err := s.blobs.Open(key)
+		if errors.Is(err, ErrBlobNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Attachment not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to open attachment", err)
+			return
+		}
+		defer blob.Close()
+
+		disposition := "attachment"
+		if a.isImage() {
+			disposition = "inline"
+		}
+		if v := mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}); v != "" {
+			disposition = v
+		}
+
+		cacheControl := "private, max-age=3600"
+		if public {
+			cacheControl = "public, max-age=3600"
+		}
+
+		h := w.Header()
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Disposition", disposition)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		h.Set("Cache-Control", cacheControl)
+		// Stored files never change, so the blob key is a strong validator
+		h.Set("ETag", `"`+key+`"`)
+		http.ServeContent(w, r, "", a.CreatedAt, blob)
+	}
+}
+
+// attachmentAccess reports whether the current viewer may download a, and
+// whether anyone at all may
+func (s *Server) attachmentAccess(r *http.Request, a *Attachment) (public, allowed bool, err error) {
+	userUUID, _ := UserUUIDFromContext(r.Context())
+
+	switch a.OwnerType {
+	case "post":
+		post, err := s.posts.GetPost(a.OwnerUUID)
+		if errors.Is(err, ErrPostNotFound) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		if !post.Deleted {
+			return true, true, nil
+		}
+		// Files of deleted posts stay available to their author and to staff
+		return false, userUUID != "" && (userUUID == post.AuthorUUID || isModerator(r)), nil
+	case "message":
+		msg, err := s.messages.GetMessage(a.OwnerUUID)
+		if errors.Is(err, ErrMessageNotFound) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		return false, !msg.Deleted && userUUID != "" && (userUUID == msg.From || userUUID == msg.To), nil
+	default:
+		return false, userUUID != "" && userUUID == a.UploaderUUID, nil
+	}
+}
+
+// checkAttachmentUUIDs trims and de-duplicates the attachments referenced
+// by a new post or message
+func checkAttachmentUUIDs(uuids []string) ([]string, string) {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, id := range uuids {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		out = append(out, id)
+	}
+	if len(out) > maxAttachments {
+		return nil, fmt.Sprintf("at most %d attachments are allowed", maxAttachments)
+	}
+	return out, ""
+}
+
+// loadPostAttachments fills Attachments for each post; deleted posts show none
+func (s *Server) loadPostAttachments(posts []Post) error {
+	uuids := make([]string, 0, len(posts))
+	for _, p := range posts {
+		uuids = append(uuids, p.UUID)
+	}
+	byPost, err := s.attachments.ListAttachments("post", uuids)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].Attachments = []Attachment{}
+		if !posts[i].Deleted {
+			posts[i].Attachments = append(posts[i].Attachments, byPost[posts[i].UUID]...)
+		}
+	}
+	return nil
+}
+
+// loadMessageAttachments fills Attachments for each message; deleted
+// messages show none
+func (s *Server) loadMessageAttachments(messages []Message) error {
+	uuids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		uuids = append(uuids, m.UUID)
+	}
+	byMessage, err := s.attachments.ListAttachments("message", uuids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Attachments = []Attachment{}
+		if !messages[i].Deleted {
+			messages[i].Attachments = append(messages[i].Attachments, byMessage[messages[i].UUID]...)
+		}
+	}
+	return nil
+}
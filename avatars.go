@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Avatars are square PNGs stored in each of these sizes, in pixels
+var avatarSizes = []int{64, 128, 256}
+
+const defaultAvatarSize = 128
+
+// Avatars accept the image types attachments show inline
+var avatarTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true}
+
+// avatarVersion names the avatar a user currently has
+func avatarVersion(avatarUUID string) string {
+	if avatarUUID == "" {
+		return "default"
+	}
+	return avatarUUID
+}
+
+// avatarURL is versioned so a new upload is never hidden by a cached copy
+func avatarURL(userUUID, avatarUUID string) string {
+	return "/users/" + userUUID + "/avatar?v=" + avatarVersion(avatarUUID)
+}
+
+func (u *User) setAvatarURL() {
+	u.AvatarURL = avatarURL(u.UUID, u.AvatarUUID)
+}
+
+func avatarKey(avatarUUID string, size int) string {
+	return avatarUUID + "-" + strconv.Itoa(size)
+}
+
+// Profile is what anyone may see about a user
+type Profile struct {
+	UUID      string    `json:"uuid"`
+	Nickname  string    `json:"nickname"`
+	Role      Role      `json:"role"`
+	AvatarURL string    `json:"avatar_url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func profileOf(u *User) Profile {
+	return Profile{UUID: u.UUID, Nickname: u.Nickname, Role: u.Role, AvatarURL: u.AvatarURL, CreatedAt: u.CreatedAt}
+}
+
+func (s *Server) GetProfileHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.users.GetUser(mux.Vars(r)["uuid"])
+		if errors.Is(err, ErrUserNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to fetch user", err)
+			return
+		}
+
+		writeData(w, http.StatusOK, profileOf(user))
+	}
+}
+
+// lookupAuthor is the Author shown on content userUUID has just written
+func (s *Server) lookupAuthor(userUUID string) Author {
+	user, err := s.users.GetUser(userUUID)
+	if err != nil {
+		log.Printf("Error loading author: %v", err)
+		return Author{Role: RoleUser, AvatarURL: avatarURL(userUUID, "")}
+	}
+	return Author{Nickname: user.Nickname, Role: user.Role, AvatarURL: user.AvatarURL}
+}
+
+// UploadAvatarHandler replaces the current user's avatar with the "file"
+// part of a multipart form. The optional crop_x, crop_y and crop_size
+// fields pick a square in image pixels; without them the largest centred
+// square is used.
+func (s *Server) UploadAvatarHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		file, ok := readUpload(w, r, s.cfg.Uploads.MaxBytes)
+		if !ok {
+			return
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(file.data))
+		if !avatarTypes[mediaType] {
+			writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedType, "Avatars must be PNG, JPEG or GIF images")
+			return
+		}
+		release := s.acquireDecodeSlot()
+		defer release()
+
+		img, errs := s.decodeImage(file.data)
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		crop, errs := avatarCrop(img.Bounds(), file.fields)
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		avatarUUID := uuid.New().String()
+		for _, size := range avatarSizes {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, resize(img, crop, size, size)); err != nil {
+				s.deleteAvatar(avatarUUID)
+				writeServerError(w, "Failed to encode avatar", err)
+				return
+			}
+			if err := s.blobs.Put(avatarKey(avatarUUID, size), buf.Bytes()); err != nil {
+				s.deleteAvatar(avatarUUID)
+				writeServerError(w, "Failed to store avatar", err)
+				return
+			}
+		}
+
+		s.replaceAvatar(w, userUUID, avatarUUID)
+	}
+}
+
+// DeleteAvatarHandler goes back to the generated default avatar
+func (s *Server) DeleteAvatarHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		s.replaceAvatar(w, userUUID, "")
+	}
+}
+
+// replaceAvatar records the user's new avatar, drops the old files and tells
+// connected clients, then responds with the updated profile
+func (s *Server) replaceAvatar(w http.ResponseWriter, userUUID, avatarUUID string) {
+	previous, err := s.users.SetAvatar(userUUID, avatarUUID)
+	if err != nil {
+		if avatarUUID != "" {
+			s.deleteAvatar(avatarUUID)
+		}
+		writeServerError(w, "Failed to save avatar", err)
+		return
+	}
+	if previous != "" && previous != avatarUUID {
+		s.deleteAvatar(previous)
+	}
+
+	user, err := s.users.GetUser(userUUID)
+	if err != nil {
+		writeServerError(w, "Failed to fetch user", err)
+		return
+	}
+	s.hub.SetAvatarURL(userUUID, user.AvatarURL)
+
+	writeData(w, http.StatusOK, profileOf(user))
+}
+
+func (s *Server) deleteAvatar(avatarUUID string) {
+	for _, size := range avatarSizes {
+		if err := s.blobs.Delete(avatarKey(avatarUUID, size)); err != nil {
+			log.Printf("Error deleting avatar: %v", err)
+		}
+	}
+}
+
+// avatarCrop returns the square of bounds an avatar is cut from
+func avatarCrop(bounds image.Rectangle, fields map[string]string) (image.Rectangle, ValidationErrors) {
+	_, hasX := fields["crop_x"]
+	_, hasY := fields["crop_y"]
+	_, hasSize := fields["crop_size"]
+	if !hasX && !hasY && !hasSize {
+		side := min(bounds.Dx(), bounds.Dy())
+		x := bounds.Min.X + (bounds.Dx()-side)/2
+		y := bounds.Min.Y + (bounds.Dy()-side)/2
+		return image.Rect(x, y, x+side, y+side), nil
+	}
+
+	errs := ValidationErrors{}
+	values := map[string]int{}
+	for _, name := range []string{"crop_x", "crop_y", "crop_size"} {
+		v, err := strconv.Atoi(fields[name])
+		if err != nil || v < 0 {
+			errs.add(name, name+" must be a non-negative integer")
+		}
+		values[name] = v
+	}
+	if len(errs) > 0 {
+		return image.Rectangle{}, errs
+	}
+
+	x, y, side := values["crop_x"], values["crop_y"], values["crop_size"]
+	crop := image.Rect(x, y, x+side, y+side).Add(bounds.Min)
+	if side == 0 || !crop.In(bounds) {
+		return image.Rectangle{}, ValidationErrors{"crop_size": fmt.Sprintf("crop must be a non-empty square inside the %dx%d image", bounds.Dx(), bounds.Dy())}
+	}
+	return crop, nil
+}
+
+// ServeAvatarHandler serves a user's avatar at ?size= (one of avatarSizes),
+// falling back to an identicon generated from their UUID. ETags let
+// clients revalidate; URLs carrying the current ?v= may be cached for a day.
+func (s *Server) ServeAvatarHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		size := defaultAvatarSize
+		if v := r.URL.Query().Get("size"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || !slices.Contains(avatarSizes, n) {
+				writeValidationErrors(w, ValidationErrors{"size": fmt.Sprintf("size must be one of %v", avatarSizes)})
+				return
+			}
+			size = n
+		}
+
+		user, err := s.users.GetUser(mux.Vars(r)["uuid"])
+		if errors.Is(err, ErrUserNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to fetch user", err)
+			return
+		}
+
+		version := avatarVersion(user.AvatarUUID)
+		var content io.ReadSeeker
+		etag := `"` + user.UUID + "-identicon-" + strconv.Itoa(size) + `"`
+		if user.AvatarUUID != "" {
+			key := avatarKey(user.AvatarUUID, size)
+			blob, err := s.blobs.Open(key)
+			switch {
+			case errors.Is(err, ErrBlobNotFound) || errors.Is(err, os.ErrNotExist):
+				// A lost file is not worth a broken image; the identicon
+				// stands in, and is not cached under the upload's version
+				log.Printf("Avatar %s is missing, serving the identicon", key)
+				version = avatarVersion("")
+			case err != nil:
+				writeServerError(w, "Failed to open avatar", err)
+				return
+			default:
+				defer blob.Close()
+				content, etag = blob, `"`+key+`"`
+			}
+		}
+		if content == nil {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, identicon(user.UUID, size)); err != nil {
+				writeServerError(w, "Failed to draw avatar", err)
+				return
+			}
+			content = bytes.NewReader(buf.Bytes())
+		}
+
+		h := w.Header()
+		h.Set("Content-Type", "image/png")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("ETag", etag)
+		if r.URL.Query().Get("v") == version {
+			h.Set("Cache-Control", "public, max-age=86400")
+		} else {
+			h.Set("Cache-Control", "public, no-cache")
+		}
+		http.ServeContent(w, r, "", time.Time{}, content)
+	}
+}
+
+// identicon draws a 5×5 horizontally symmetric pattern in a colour derived
+// from id, the same for the same id every time
+func identicon(id string, size int) *image.RGBA {
+	sum := sha256.Sum256([]byte(id))
+	fg := color.RGBA{60 + sum[29]%140, 60 + sum[30]%140, 60 + sum[31]%140, 255}
+	bg := color.RGBA{240, 240, 240, 255}
+
+	// Cells of the left three columns come from the hash, mirrored right
+	var cells [5][5]bool
+	for i := 0; i < 15; i++ {
+		row, col := i/3, i%3
+		on := sum[i]&1 == 1
+		cells[row][col], cells[row][4-col] = on, on
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	// The grid is inset by half a cell on every side: 6 cells across
+	for y := 0; y < size; y++ {
+		gy := y*12/size - 1
+		for x := 0; x < size; x++ {
+			gx := x*12/size - 1
+			c := bg
+			if gx >= 0 && gx < 10 && gy >= 0 && gy < 10 && cells[gy/2][gx/2] {
+				c = fg
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
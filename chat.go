@@ -1,70 +1,129 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
-var (
-	clients     = make(map[string]*Client)       // key = user UUID
-	broadcast   = make(chan Message)             // channel for incoming messages
-	onlineUsers = make(map[string]*UserPresence) // key = userUUID
-)
+// Time allowed to write a frame before the connection is considered dead
+const writeWait = 10 * time.Second
 
 type Client struct {
-	Conn     *websocket.Conn
-	UserUUID string
-	Send     chan []byte
+	Conn      *websocket.Conn
+	UserUUID  string
+	AvatarURL string
+	Send      chan []byte
+
+	// Set by the hub before Send is closed; sent to the peer in the close frame
+	closeCode   int
+	closeReason string
+	sendClosed  bool
+
+	// Scopes of live events the client follows; guarded by the hub's mutex
+	subscriptions map[Subscription]bool
 }
 
 type Message struct {
+	UUID    string `json:"uuid"`
 	From    string `json:"from"`
 	To      string `json:"to"`
 	Content string `json:"content"`
 	SentAt  string `json:"sent_at"`
+	Deleted bool   `json:"deleted,omitempty"`
+
+	Mentions    []Mention    `json:"mentions"`
+	Attachments []Attachment `json:"attachments"`
+	// Sent by clients to attach files they uploaded; never echoed back
+	AttachmentUUIDs []string `json:"attachment_uuids,omitempty"`
 }
 
 type UserPresence struct {
 	UserUUID    string
 	LastMessage string // preview or timestamp
 	IsOnline    bool
+	AvatarURL   string
 }
 
-func handleMessages() {
-	for {
-		msg := <-broadcast
+// Hub tracks connected clients and routes chat messages between them.
+// A user may hold several connections at once (one per open tab).
+type Hub struct {
+	mu          sync.Mutex
+	clients     map[string]map[*Client]bool // key = user UUID
+	onlineUsers map[string]*UserPresence    // key = user UUID
+	closing     bool
 
-		// Save/update last message in memory
-		if u, ok := onlineUsers[msg.To]; ok {
-			u.LastMessage = msg.Content
-		}
+	broadcast chan Message  // channel for incoming messages
+	quit      chan struct{} // closed when shutdown begins
+	done      chan struct{} // closed when Run has drained broadcast
+	pumps     sync.WaitGroup
+}
 
-		// If receiver is online, send the message directly
-		if client, ok := clients[msg.To]; ok {
-			data, _ := json.Marshal(msg)
-			client.Send <- data
-		}
+func NewHub() *Hub {
+	return &Hub{
+		clients:     make(map[string]map[*Client]bool),
+		onlineUsers: make(map[string]*UserPresence),
+		broadcast:   make(chan Message),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
 
-		// Optionally send back to sender as confirmation
-		if sender, ok := clients[msg.From]; ok {
-			data, _ := json.Marshal(msg)
-			sender.Send <- data
+// Run delivers broadcast messages until Shutdown is called
+func (h *Hub) Run() {
+	defer close(h.done)
+
+	for {
+		select {
+		case msg := <-h.broadcast:
+			h.deliver(msg)
+		case <-h.quit:
+			// Deliver whatever readers already handed over before stopping
+			for {
+				select {
+				case msg := <-h.broadcast:
+					h.deliver(msg)
+				default:
+					return
+				}
+			}
 		}
+	}
+}
+
+func (h *Hub) deliver(msg Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Save/update last message in memory
+	if u, ok := h.onlineUsers[msg.To]; ok {
+		u.LastMessage = msg.Content
+	}
+
+	data, _ := json.Marshal(msg)
 
-		// Broadcast updated online user list to all clients
-		sendOnlineUsersToAll()
+	// If receiver is online, send the message directly
+	h.sendToUserLocked(msg.To, data)
 
+	// Send back to sender as confirmation
+	if msg.From != msg.To {
+		h.sendToUserLocked(msg.From, data)
 	}
+
+	// Broadcast updated online user list to all clients
+	h.sendOnlineUsersLocked()
 }
 
-func sendOnlineUsersToAll() {
+func (h *Hub) sendOnlineUsersLocked() {
 	users := []UserPresence{}
-	for _, u := range onlineUsers {
+	for _, u := range h.onlineUsers {
 		users = append(users, *u)
 	}
 
@@ -75,43 +134,280 @@ func sendOnlineUsersToAll() {
 
 	encoded, _ := json.Marshal(data)
 
-	for _, client := range clients {
-		client.Send <- encoded
+	for _, conns := range h.clients {
+		for client := range conns {
+			h.sendLocked(client, encoded)
+		}
 	}
 }
 
-func readPump(db *sql.DB, client *Client) {
-	defer func() {
+// SendToUser pushes v as a JSON frame to every connection the user holds
+func (h *Hub) SendToUser(userUUID string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding frame: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sendToUserLocked(userUUID, data)
+}
+
+// SetAvatarURL updates the avatar shown in presence lists after a user
+// changes it
+func (h *Hub) SetAvatarURL(userUUID, avatarURL string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	u, ok := h.onlineUsers[userUUID]
+	if !ok {
+		return
+	}
+	u.AvatarURL = avatarURL
+	h.sendOnlineUsersLocked()
+}
+
+func (h *Hub) sendToUserLocked(userUUID string, data []byte) {
+	for client := range h.clients[userUUID] {
+		h.sendLocked(client, data)
+	}
+}
+
+// sendLocked queues data without blocking the hub; a client whose buffer is
+// full is too slow to keep up and gets disconnected
+func (h *Hub) sendLocked(client *Client, data []byte) {
+	if client.sendClosed {
+		return
+	}
+	select {
+	case client.Send <- data:
+	default:
+		h.closeClientLocked(client, websocket.CloseTryAgainLater, "too slow")
+	}
+}
+
+// closeClientLocked stops the client's write pump, which flushes queued
+// frames and then sends a close frame with the given code and reason
+func (h *Hub) closeClientLocked(client *Client, code int, reason string) {
+	if client.sendClosed {
+		return
+	}
+	client.closeCode = code
+	client.closeReason = reason
+	client.sendClosed = true
+	close(client.Send)
+}
+
+// FrameError rejects a chat message; the sender gets it back as an error
+// frame and the message is not delivered
+type FrameError struct {
+	Code    string
+	Message string
+}
+
+func (e *FrameError) Error() string {
+	return e.Message
+}
+
+// Serve registers the client and pumps its connection until it closes.
+// save stores each chat message the client sends and may fill in derived
+// fields before it is delivered. Messages it fails to save are not
+// delivered; a *FrameError tells the sender why.
+func (h *Hub) Serve(client *Client, maxMessageBytes int64, save func(msg *Message, sentAt time.Time) error) {
+	h.mu.Lock()
+	if h.closing {
+		h.mu.Unlock()
+		deadline := time.Now().Add(writeWait)
+		client.Conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting"), deadline)
 		client.Conn.Close()
-		delete(clients, client.UserUUID)
-		if u, ok := onlineUsers[client.UserUUID]; ok {
+		return
+	}
+
+	if h.clients[client.UserUUID] == nil {
+		h.clients[client.UserUUID] = make(map[*Client]bool)
+	}
+	h.clients[client.UserUUID][client] = true
+	h.onlineUsers[client.UserUUID] = &UserPresence{
+		UserUUID:    client.UserUUID,
+		IsOnline:    true,
+		LastMessage: "",
+		AvatarURL:   client.AvatarURL,
+	}
+	h.pumps.Add(2)
+	h.mu.Unlock()
+
+	go h.writePump(client)
+	h.readPump(client, maxMessageBytes, save)
+}
+
+func (h *Hub) unregister(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	conns := h.clients[client.UserUUID]
+	delete(conns, client)
+	if len(conns) == 0 {
+		delete(h.clients, client.UserUUID)
+		if u, ok := h.onlineUsers[client.UserUUID]; ok {
 			u.IsOnline = false
 		}
+	}
+	h.closeClientLocked(client, websocket.CloseNormalClosure, "")
+}
+
+// DisconnectUser closes every connection the user holds with a policy
+// violation frame carrying reason
+func (h *Hub) DisconnectUser(userUUID, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.clients[userUUID] {
+		h.closeClientLocked(client, websocket.ClosePolicyViolation, truncateCloseReason(reason))
+	}
+}
+
+// Close frames carry at most 123 bytes of reason text
+const maxCloseReasonBytes = 123
+
+func truncateCloseReason(reason string) string {
+	if len(reason) <= maxCloseReasonBytes {
+		return reason
+	}
+	cut := maxCloseReasonBytes
+	for cut > 0 && !utf8.RuneStart(reason[cut]) {
+		cut--
+	}
+	return reason[:cut]
+}
+
+// Shutdown stops accepting clients, delivers messages already read, sends
+// every client a "server restarting" close frame after its queued frames and
+// waits for all pumps to finish. Connections still open when ctx expires are
+// closed forcibly.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	if h.closing {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closing = true
+	h.mu.Unlock()
+
+	close(h.quit)
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+	}
+
+	h.mu.Lock()
+	for _, conns := range h.clients {
+		for client := range conns {
+			h.closeClientLocked(client, websocket.CloseServiceRestart, "server restarting")
+		}
+	}
+	h.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		close(finished)
 	}()
 
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		h.mu.Lock()
+		for _, conns := range h.clients {
+			for client := range conns {
+				client.Conn.Close()
+			}
+		}
+		h.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (h *Hub) readPump(client *Client, maxMessageBytes int64, save func(msg *Message, sentAt time.Time) error) {
+	defer func() {
+		h.unregister(client)
+		client.Conn.Close()
+		h.pumps.Done()
+	}()
+
+	client.Conn.SetReadLimit(maxMessageBytes)
+
 	for {
-		var msg Message
-		err := client.Conn.ReadJSON(&msg)
+		_, data, err := client.Conn.ReadMessage()
 		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("read error:", err)
+			}
+			break
+		}
+
+		var frame inboundFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			log.Println("read error:", err)
+			break
+		}
+		if frame.Type != "" {
+			h.handleFrame(client, frame)
+			continue
+		}
+
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
 			log.Println("read error:", err)
 			break
 		}
 
+		now := time.Now()
+		msg.UUID = uuid.New().String()
 		msg.From = client.UserUUID
-		msg.SentAt = time.Now().Format(time.RFC3339)
+		msg.SentAt = now.Format(time.RFC3339)
+		msg.Deleted = false
+		msg.Mentions = nil
+		msg.Attachments = nil
 
-		SaveMessage(db, uuid.New().String(), msg.From, msg.To, msg.Content, time.Now())
+		if err := save(&msg, now); err != nil {
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) {
+				log.Printf("Error saving message: %v", err)
+				frameErr = &FrameError{Code: codeInternal, Message: "Message could not be sent"}
+			}
+			h.sendError(client, frameErr.Code, frameErr.Message)
+			continue
+		}
+		msg.AttachmentUUIDs = nil
 
-		broadcast <- msg
+		select {
+		case h.broadcast <- msg:
+		case <-h.quit:
+			return
+		}
 	}
 }
 
-func writePump(client *Client) {
-	for {
-		msg, ok := <-client.Send
-		if !ok {
+func (h *Hub) writePump(client *Client) {
+	defer func() {
+		client.Conn.Close()
+		h.pumps.Done()
+	}()
+
+	for msg := range client.Send {
+		client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := client.Conn.WriteMessage(websocket.TextMessage, msg); err != nil {
 			return
 		}
-		client.Conn.WriteMessage(websocket.TextMessage, msg)
 	}
+
+	// Send was closed by the hub: every queued frame is flushed, say goodbye
+	h.mu.Lock()
+	code, reason := client.closeCode, client.closeReason
+	h.mu.Unlock()
+	client.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
 }
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every setting the server needs. Values are resolved in
+// increasing priority: defaults, the JSON config file, FORUM_* environment
+// variables, then command-line flags.
+type Config struct {
+	Addr           string        `json:"addr"`
+	DBPath         string        `json:"db_path"`
+	SessionTTL     Duration      `json:"session_ttl"`
+	AllowedOrigins []string      `json:"allowed_origins"`
+	CookieSecure   bool          `json:"cookie_secure"`
+	CookieSameSite string        `json:"cookie_same_site"`
+	Dev            bool          `json:"dev"`
+	Chat           ChatConfig    `json:"chat"`
+	Uploads        UploadsConfig `json:"uploads"`
+
+	// How long shutdown may take to drain requests and WebSocket clients
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// TLS is enabled when both files are set. RedirectAddr optionally runs a
+	// plain HTTP listener that redirects everything to HTTPS.
+	TLSCertFile  string   `json:"tls_cert_file"`
+	TLSKeyFile   string   `json:"tls_key_file"`
+	RedirectAddr string   `json:"redirect_addr"`
+	HSTSMaxAge   Duration `json:"hsts_max_age"`
+
+	// How long after posting an author may still edit a comment
+	CommentEditWindow Duration `json:"comment_edit_window"`
+}
+
+// ChatConfig limits what a single WebSocket client can send and buffer
+type ChatConfig struct {
+	MaxMessageBytes int64 `json:"max_message_bytes"`
+	HistoryPageSize int   `json:"history_page_size"`
+	SendBuffer      int   `json:"send_buffer"`
+}
+
+// UploadsConfig controls where attachments are kept and what is accepted
+type UploadsConfig struct {
+	Dir               string `json:"dir"`
+	MaxBytes          int64  `json:"max_bytes"`
+	MaxImageDimension int    `json:"max_image_dimension"`
+	ThumbnailSize     int    `json:"thumbnail_size"`
+	// Uploads no post or message claims within this long are deleted
+	UnclaimedTTL Duration `json:"unclaimed_ttl"`
+}
+
+// Duration is a time.Duration that reads "24h"-style strings from JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"24h\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Duration returns d as a time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultConfig matches the behaviour of the server before it was configurable
+func DefaultConfig() *Config {
+	return &Config{
+		Addr:            ":8080",
+		DBPath:          "forum.db",
+		SessionTTL:      Duration(24 * time.Hour),
+		CookieSameSite:  "lax",
+		ShutdownTimeout: Duration(10 * time.Second),
+		HSTSMaxAge:      Duration(180 * 24 * time.Hour),
+
+		CommentEditWindow: Duration(15 * time.Minute),
+		Chat: ChatConfig{
+			MaxMessageBytes: 4096,
+			HistoryPageSize: 10,
+			SendBuffer:      16,
+		},
+		Uploads: UploadsConfig{
+			Dir:               "uploads",
+			MaxBytes:          5 << 20,
+			MaxImageDimension: 4096,
+			ThumbnailSize:     256,
+			UnclaimedTTL:      Duration(24 * time.Hour),
+		},
+	}
+}
+
+// LoadConfig resolves the configuration from a config file, the environment
+// and args (usually os.Args[1:]) and validates the result
+func LoadConfig(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("forum", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("FORUM_CONFIG"), "path to a JSON config file")
+	addr := fs.String("addr", "", "listen address")
+	dbPath := fs.String("db", "", "SQLite database path")
+	sessionTTL := fs.Duration("session-ttl", 0, "session lifetime")
+	origins := fs.String("allowed-origins", "", "comma-separated origins allowed to open WebSockets")
+	cookieSecure := fs.Bool("cookie-secure", false, "mark cookies Secure")
+	cookieSameSite := fs.String("cookie-samesite", "", "cookie SameSite mode: lax, strict or none")
+	dev := fs.Bool("dev", false, "serve the web client from disk instead of the embedded copy")
+	maxMessage := fs.Int64("chat-max-message-bytes", 0, "largest WebSocket frame accepted from a client")
+	historyPage := fs.Int("chat-history-page-size", 0, "messages returned per /messages page")
+	sendBuffer := fs.Int("chat-send-buffer", 0, "outgoing frames buffered per client")
+	uploadsDir := fs.String("uploads-dir", "", "directory attachments are stored in")
+	uploadsMaxBytes := fs.Int64("uploads-max-bytes", 0, "largest attachment accepted")
+	uploadsMaxDimension := fs.Int("uploads-max-image-dimension", 0, "largest width or height of an uploaded image")
+	uploadsThumbnail := fs.Int("uploads-thumbnail-size", 0, "bounding box of generated thumbnails")
+	uploadsUnclaimedTTL := fs.Duration("uploads-unclaimed-ttl", 0, "how long an upload may stay unused before it is deleted")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 0, "time allowed for a graceful shutdown")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file; enables HTTPS together with -tls-key")
+	tlsKey := fs.String("tls-key", "", "TLS private key file")
+	redirectAddr := fs.String("redirect-addr", "", "plain HTTP address that redirects to HTTPS")
+	hstsMaxAge := fs.Duration("hsts-max-age", 0, "Strict-Transport-Security max-age when TLS is on")
+	commentEditWindow := fs.Duration("comment-edit-window", 0, "how long authors may edit a comment after posting")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	// Only flags given on the command line override earlier sources
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = *addr
+		case "db":
+			cfg.DBPath = *dbPath
+		case "session-ttl":
+			cfg.SessionTTL = Duration(*sessionTTL)
+		case "allowed-origins":
+			cfg.AllowedOrigins = splitList(*origins)
+		case "cookie-secure":
+			cfg.CookieSecure = *cookieSecure
+		case "cookie-samesite":
+			cfg.CookieSameSite = *cookieSameSite
+		case "dev":
+			cfg.Dev = *dev
+		case "chat-max-message-bytes":
+			cfg.Chat.MaxMessageBytes = *maxMessage
+		case "chat-history-page-size":
+			cfg.Chat.HistoryPageSize = *historyPage
+		case "chat-send-buffer":
+			cfg.Chat.SendBuffer = *sendBuffer
+		case "uploads-dir":
+			cfg.Uploads.Dir = *uploadsDir
+		case "uploads-max-bytes":
+			cfg.Uploads.MaxBytes = *uploadsMaxBytes
+		case "uploads-max-image-dimension":
+			cfg.Uploads.MaxImageDimension = *uploadsMaxDimension
+		case "uploads-thumbnail-size":
+			cfg.Uploads.ThumbnailSize = *uploadsThumbnail
+		case "uploads-unclaimed-ttl":
+			cfg.Uploads.UnclaimedTTL = Duration(*uploadsUnclaimedTTL)
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = Duration(*shutdownTimeout)
+		case "tls-cert":
+			cfg.TLSCertFile = *tlsCert
+		case "tls-key":
+			cfg.TLSKeyFile = *tlsKey
+		case "redirect-addr":
+			cfg.RedirectAddr = *redirectAddr
+		case "hsts-max-age":
+			cfg.HSTSMaxAge = Duration(*hstsMaxAge)
+		case "comment-edit-window":
+			cfg.CommentEditWindow = Duration(*commentEditWindow)
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv applies FORUM_* variables. FORUM_ENV=production switches the
+// cookie defaults to Secure and SameSite=Strict before the specific
+// variables are read.
+func (c *Config) loadEnv() error {
+	if strings.EqualFold(os.Getenv("FORUM_ENV"), "production") {
+		c.CookieSecure = true
+		c.CookieSameSite = "strict"
+	}
+
+	vars := []struct {
+		name  string
+		parse func(string) error
+	}{
+		{"FORUM_ADDR", stringVar(&c.Addr)},
+		{"FORUM_DB_PATH", stringVar(&c.DBPath)},
+		{"FORUM_SESSION_TTL", durationVar(&c.SessionTTL)},
+		{"FORUM_ALLOWED_ORIGINS", func(v string) error { c.AllowedOrigins = splitList(v); return nil }},
+		{"FORUM_COOKIE_SECURE", boolVar(&c.CookieSecure)},
+		{"FORUM_COOKIE_SAMESITE", stringVar(&c.CookieSameSite)},
+		{"FORUM_DEV", boolVar(&c.Dev)},
+		{"FORUM_CHAT_MAX_MESSAGE_BYTES", func(v string) (err error) { c.Chat.MaxMessageBytes, err = strconv.ParseInt(v, 10, 64); return err }},
+		{"FORUM_CHAT_HISTORY_PAGE_SIZE", intVar(&c.Chat.HistoryPageSize)},
+		{"FORUM_CHAT_SEND_BUFFER", intVar(&c.Chat.SendBuffer)},
+		{"FORUM_UPLOADS_DIR", stringVar(&c.Uploads.Dir)},
+		{"FORUM_UPLOADS_MAX_BYTES", func(v string) (err error) { c.Uploads.MaxBytes, err = strconv.ParseInt(v, 10, 64); return err }},
+		{"FORUM_UPLOADS_MAX_IMAGE_DIMENSION", intVar(&c.Uploads.MaxImageDimension)},
+		{"FORUM_UPLOADS_THUMBNAIL_SIZE", intVar(&c.Uploads.ThumbnailSize)},
+		{"FORUM_UPLOADS_UNCLAIMED_TTL", durationVar(&c.Uploads.UnclaimedTTL)},
+		{"FORUM_SHUTDOWN_TIMEOUT", durationVar(&c.ShutdownTimeout)},
+		{"FORUM_TLS_CERT", stringVar(&c.TLSCertFile)},
+		{"FORUM_TLS_KEY", stringVar(&c.TLSKeyFile)},
+		{"FORUM_REDIRECT_ADDR", stringVar(&c.RedirectAddr)},
+		{"FORUM_HSTS_MAX_AGE", durationVar(&c.HSTSMaxAge)},
+		{"FORUM_COMMENT_EDIT_WINDOW", durationVar(&c.CommentEditWindow)},
+	}
+	for _, v := range vars {
+		value, ok := os.LookupEnv(v.name)
+		if !ok {
+			continue
+		}
+		if err := v.parse(value); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+func stringVar(dst *string) func(string) error {
+	return func(v string) error { *dst = v; return nil }
+}
+
+func boolVar(dst *bool) func(string) error {
+	return func(v string) (err error) { *dst, err = strconv.ParseBool(v); return err }
+}
+
+func intVar(dst *int) func(string) error {
+	return func(v string) (err error) { *dst, err = strconv.Atoi(v); return err }
+}
+
+func durationVar(dst *Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		*dst = Duration(d)
+		return err
+	}
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("addr must not be empty"))
+	}
+	if c.DBPath == "" {
+		errs = append(errs, errors.New("db_path must not be empty"))
+	}
+	if time.Duration(c.SessionTTL) < time.Minute {
+		errs = append(errs, errors.New("session_ttl must be at least 1m"))
+	}
+	for _, origin := range c.AllowedOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			errs = append(errs, fmt.Errorf("allowed origin %q must look like https://host[:port]", origin))
+		}
+	}
+	sameSite, ok := parseSameSite(c.CookieSameSite)
+	if !ok {
+		errs = append(errs, fmt.Errorf("cookie_same_site %q must be lax, strict or none", c.CookieSameSite))
+	}
+	if ok && sameSite == http.SameSiteNoneMode && !c.CookieOptions().Secure {
+		errs = append(errs, errors.New("cookie_same_site none requires cookie_secure"))
+	}
+	if c.Chat.MaxMessageBytes <= 0 {
+		errs = append(errs, errors.New("chat.max_message_bytes must be positive"))
+	}
+	if c.Chat.HistoryPageSize <= 0 || c.Chat.HistoryPageSize > 100 {
+		errs = append(errs, errors.New("chat.history_page_size must be between 1 and 100"))
+	}
+	if c.Chat.SendBuffer <= 0 {
+		errs = append(errs, errors.New("chat.send_buffer must be positive"))
+	}
+	if c.Uploads.Dir == "" {
+		errs = append(errs, errors.New("uploads.dir must not be empty"))
+	}
+	if c.Uploads.MaxBytes <= 0 {
+		errs = append(errs, errors.New("uploads.max_bytes must be positive"))
+	}
+	if c.Uploads.MaxImageDimension <= 0 {
+		errs = append(errs, errors.New("uploads.max_image_dimension must be positive"))
+	}
+	if c.Uploads.ThumbnailSize <= 0 {
+		errs = append(errs, errors.New("uploads.thumbnail_size must be positive"))
+	}
+	if c.Uploads.UnclaimedTTL <= 0 {
+		errs = append(errs, errors.New("uploads.unclaimed_ttl must be positive"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("tls_cert_file and tls_key_file must be set together"))
+	}
+	for _, file := range []string{c.TLSCertFile, c.TLSKeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("tls: %w", err))
+		}
+	}
+	if c.RedirectAddr != "" && !c.TLSEnabled() {
+		errs = append(errs, errors.New("redirect_addr requires TLS"))
+	}
+	if c.HSTSMaxAge < 0 {
+		errs = append(errs, errors.New("hsts_max_age must not be negative"))
+	}
+	if c.CommentEditWindow <= 0 {
+		errs = append(errs, errors.New("comment_edit_window must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// TLSEnabled reports whether the server terminates HTTPS itself
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// CookieOptions returns the cookie attributes selected by the config.
+// Cookies are always Secure when the server speaks TLS.
+func (c *Config) CookieOptions() CookieOptions {
+	sameSite, _ := parseSameSite(c.CookieSameSite)
+	return CookieOptions{Secure: c.CookieSecure || c.TLSEnabled(), SameSite: sameSite}
+}
+
+// OriginAllowed reports whether a WebSocket handshake from origin may proceed.
+// With no allowed origins configured only same-origin pages are accepted.
+func (c *Config) OriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	for _, allowed := range c.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return sameOrigin(r)
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "session_token"
+	csrfCookieName    = "csrf_token"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// CookieOptions holds the security attributes applied to every cookie we set
+type CookieOptions struct {
+	Secure   bool
+	SameSite http.SameSite
+}
+
+func parseSameSite(v string) (http.SameSite, bool) {
+	switch strings.ToLower(v) {
+	case "lax":
+		return http.SameSiteLaxMode, true
+	case "strict":
+		return http.SameSiteStrictMode, true
+	case "none":
+		return http.SameSiteNoneMode, true
+	}
+	return 0, false
+}
+
+// SetSessionCookies writes the HttpOnly session cookie and the script-readable
+// CSRF cookie the client echoes back in the X-CSRF-Token header
+func (o CookieOptions) SetSessionCookies(w http.ResponseWriter, sessionUUID, csrfToken string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionUUID,
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   o.Secure,
+		SameSite: o.SameSite,
+		Path:     "/",
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Expires:  expiresAt,
+		Secure:   o.Secure,
+		SameSite: o.SameSite,
+		Path:     "/",
+	})
+}
+
+// ClearSessionCookies expires both session cookies
+func (o CookieOptions) ClearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookieName, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: name == sessionCookieName,
+			Secure:   o.Secure,
+			SameSite: o.SameSite,
+		})
+	}
+}
@@ -2,33 +2,58 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 var ErrUserExists = errors.New("user already exists")
 
+// Connection settings applied to every pooled connection. WAL lets the feed
+// read while chat writes; immediate transactions take the write lock up
+// front so two writers wait on busy_timeout instead of failing with
+// "database is locked" when upgrading from a read lock.
+const (
+	sqliteBusyTimeoutMs = 5000
+	sqliteMaxOpenConns  = 8
+	sqliteConnMaxIdle   = 5 * time.Minute
+)
+
 func InitDB(dbFile string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbFile)
+	db, err := sql.Open("sqlite3", sqliteDSN(dbFile))
 	if err != nil {
 		return nil, err
 	}
 
+	db.SetMaxOpenConns(sqliteMaxOpenConns)
+	db.SetMaxIdleConns(sqliteMaxOpenConns)
+	db.SetConnMaxIdleTime(sqliteConnMaxIdle)
+
 	// Ping to check connection
 	if err := db.Ping(); err != nil {
 		return nil, err
 	}
 
+	// Bring databases created by older schemas up to date before the
+	// schema's indexes are created on top of them
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+
 	// Read schema.sql
 	schema, err := os.ReadFile("schema.sql")
 	if err != nil {
 		return nil, err
 	}
 
-	// Execute schema to create table if not exist
+	// Execute schema to create tables and indexes if not exist
 	_, err = db.Exec(string(schema))
 	if err != nil {
 		return nil, err
@@ -36,11 +61,390 @@ func InitDB(dbFile string) (*sql.DB, error) {
 	return db, nil
 }
 
-// Check if email or nickname already exists
+// sqliteDSN appends the pragmas every connection needs to the database path
+func sqliteDSN(dbFile string) string {
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_synchronous", "NORMAL")
+	params.Set("_foreign_keys", "on")
+	params.Set("_busy_timeout", strconv.Itoa(sqliteBusyTimeoutMs))
+	params.Set("_txlock", "immediate")
+
+	sep := "?"
+	if strings.Contains(dbFile, "?") {
+		sep = "&"
+	}
+	return "file:" + dbFile + sep + params.Encode()
+}
+
+// migrate adds columns introduced after a database was first created.
+// CREATE TABLE IF NOT EXISTS leaves existing tables untouched, so every
+// column added to schema.sql also needs an entry here. It runs before
+// schema.sql, so a brand new database has nothing to migrate.
+func migrate(db *sql.DB) error {
+	if exists, err := tableExists(db, "users"); err != nil || !exists {
+		return err
+	}
+
+	if err := ensureColumn(db, "sessions", "csrf_token", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "nickname_normalized", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := normalizeUserIdentities(db); err != nil {
+		return err
+	}
+	if err := rebuildPostCategories(db); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "posts", "edited_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "posts", "deleted_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "comments", "edited_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "comments", "deleted_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addCommentCounts(db); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "role", "TEXT NOT NULL DEFAULT 'user'"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "suspended_until", "DATETIME"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "suspension_reason", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "banned_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "users", "avatar_uuid", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	for target, table := range reactionTables {
+		if err := addReactionCounts(db, table, target); err != nil {
+			return err
+		}
+	}
+	if err := addHotScores(db); err != nil {
+		return err
+	}
+	// messages only exists from the version that started persisting chat
+	if exists, err := tableExists(db, "messages"); err != nil || !exists {
+		return err
+	}
+	return ensureColumn(db, "messages", "deleted_at", "DATETIME")
+}
+
+// addCommentCounts adds posts.comment_count and fills it from existing comments
+func addCommentCounts(db *sql.DB) error {
+	columns, err := tableColumns(db, "posts")
+	if err != nil {
+		return err
+	}
+	if _, ok := columns["comment_count"]; ok {
+		return nil
+	}
+
+	if err := ensureColumn(db, "posts", "comment_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+        UPDATE posts SET comment_count = (
+            SELECT COUNT(*) FROM comments
+            WHERE comments.post_uuid = posts.uuid AND comments.deleted_at IS NULL
+        )`)
+	return err
+}
+
+// addReactionCounts adds the likes and dislikes counters to table and fills
+// them from existing likes_dislikes rows
+func addReactionCounts(db *sql.DB, table string, target ReactionTarget) error {
+	columns, err := tableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	if _, ok := columns["likes"]; ok {
+		return nil
+	}
+
+	for _, column := range []string{"likes", "dislikes"} {
+		if err := ensureColumn(db, table, column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	// likes_dislikes only exists once schema.sql has run on this database
+	if exists, err := tableExists(db, "likes_dislikes"); err != nil || !exists {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`
+        UPDATE %[1]s SET
+            likes = (SELECT COUNT(*) FROM likes_dislikes l WHERE l.target_type = ? AND l.target_id = %[1]s.id AND l.is_like),
+            dislikes = (SELECT COUNT(*) FROM likes_dislikes l WHERE l.target_type = ? AND l.target_id = %[1]s.id AND NOT l.is_like)`,
+		table), target, target)
+	return err
+}
+
+// addHotScores adds posts.hot_score and computes it for existing posts,
+// which needs the reaction counters to be in place already
+func addHotScores(db *sql.DB) error {
+	columns, err := tableColumns(db, "posts")
+	if err != nil {
+		return err
+	}
+	if _, ok := columns["hot_score"]; ok {
+		return nil
+	}
+
+	if err := ensureColumn(db, "posts", "hot_score", "REAL NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	return WithTx(db, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT id FROM posts`)
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := updateHotScore(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// normalizeUserIdentities lower-cases stored emails and fills
+// nickname_normalized for users created before it existed; schema.sql then
+// enforces case-insensitive uniqueness with a unique index. Accounts that
+// only differ by case would break that index, so they are reported before
+// any row is rewritten and an operator decides which account to keep.
+func normalizeUserIdentities(db *sql.DB) error {
+	return WithTx(db, func(tx *sql.Tx) error {
+		var pending bool
+		err := tx.QueryRow(`
+            SELECT EXISTS(SELECT 1 FROM users WHERE email <> lower(trim(email)) OR nickname_normalized = '')`).Scan(&pending)
+		if err != nil || !pending {
+			return err
+		}
+
+		users, err := identityRows(tx)
+		if err != nil {
+			return err
+		}
+		if err := identityCollisions(users); err != nil {
+			return err
+		}
+
+		for _, u := range users {
+			_, err := tx.Exec(`UPDATE users SET email = ?, nickname_normalized = ? WHERE id = ?`, u.email, u.nickname, u.id)
+			if err != nil {
+				return fmt.Errorf("normalizing user identities: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// identityRow is a user's email and nickname in normalized form
+type identityRow struct {
+	id              int64
+	uuid            string
+	email, nickname string
+}
+
+// identityRows returns every user, oldest first, with the identities the
+// validation layer would give them
+func identityRows(tx *sql.Tx) ([]identityRow, error) {
+	rows, err := tx.Query(`SELECT id, uuid, email, nickname, nickname_normalized FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []identityRow
+	for rows.Next() {
+		var u identityRow
+		var nickname, normalized string
+		if err := rows.Scan(&u.id, &u.uuid, &u.email, &nickname, &normalized); err != nil {
+			return nil, err
+		}
+		u.email = NormalizeEmail(u.email)
+		u.nickname = normalized
+		if u.nickname == "" {
+			u.nickname = NormalizeNickname(nickname)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// identityCollisions lists every email and nickname held by more than one
+// of users, each with the clashing account UUIDs oldest first
+func identityCollisions(users []identityRow) error {
+	var clashes []string
+	for _, field := range []struct {
+		name  string
+		value func(identityRow) string
+	}{
+		{"email", func(u identityRow) string { return u.email }},
+		{"nickname", func(u identityRow) string { return u.nickname }},
+	} {
+		holders := map[string][]string{}
+		var order []string
+		for _, u := range users {
+			v := field.value(u)
+			if len(holders[v]) == 0 {
+				order = append(order, v)
+			}
+			holders[v] = append(holders[v], u.uuid)
+		}
+		for _, v := range order {
+			if len(holders[v]) > 1 {
+				clashes = append(clashes, fmt.Sprintf("%s %q: %s", field.name, v, strings.Join(holders[v], ", ")))
+			}
+		}
+	}
+	if len(clashes) == 0 {
+		return nil
+	}
+	return fmt.Errorf("normalizing user identities: accounts differ only by case or spacing; "+
+		"rename or remove all but one account in each group, then restart:\n  %s", strings.Join(clashes, "\n  "))
+}
+
+// ensureColumn adds column to table unless it already exists
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	columns, err := tableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	if _, ok := columns[column]; ok {
+		return nil
+	}
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)`, table).Scan(&exists)
+	return exists, err
+}
+
+// tableColumns maps each column of table to whether it is part of the primary key
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = pk > 0
+	}
+	return columns, rows.Err()
+}
+
+// rebuildPostCategories recreates post_categories with its primary key and
+// cascading delete, dropping duplicate rows. SQLite cannot add either to an
+// existing table in place.
+func rebuildPostCategories(db *sql.DB) error {
+	columns, err := tableColumns(db, "post_categories")
+	if err != nil {
+		return err
+	}
+	if isPK, ok := columns["post_uuid"]; !ok || isPK {
+		return nil
+	}
+
+	return WithTx(db, func(tx *sql.Tx) error {
+		stmts := []string{
+			`CREATE TABLE post_categories_new (
+                post_uuid TEXT NOT NULL,
+                category TEXT NOT NULL,
+                PRIMARY KEY (post_uuid, category),
+                FOREIGN KEY(post_uuid) REFERENCES posts(uuid) ON DELETE CASCADE
+            )`,
+			`INSERT OR IGNORE INTO post_categories_new (post_uuid, category)
+             SELECT post_uuid, category FROM post_categories`,
+			`DROP TABLE post_categories`,
+			`ALTER TABLE post_categories_new RENAME TO post_categories`,
+		}
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("rebuilding post_categories: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx so writes can join a transaction
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// WithTx runs fn in a transaction, committing if it returns nil and rolling
+// back if it returns an error or panics
+func WithTx(db *sql.DB, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Check if email or nickname already exists, ignoring case
 func UserExists(db *sql.DB, email, nickname string) (bool, error) {
 	var exists bool
-	query := `SELECT EXISTS(SELECT 1 FROM users WHERE email = ? OR nickname = ?)`
-	err := db.QueryRow(query, email, nickname).Scan(&exists)
+	query := `SELECT EXISTS(SELECT 1 FROM users WHERE email = ? OR nickname_normalized = ?)`
+	err := db.QueryRow(query, NormalizeEmail(email), NormalizeNickname(nickname)).Scan(&exists)
 	return exists, err
 }
 
@@ -58,30 +462,230 @@ func UserExists(db *sql.DB, email, nickname string) (bool, error) {
 	}
 */
 
-// Insert user with all fields
+// Insert user with all fields. Returns ErrUserExists when the email or
+// nickname collides with an existing account.
 func InsertUserFull(db *sql.DB, uuid, nickname, email, passwordHash string, age int, gender, firstName, lastName string) error {
-	stmt := `INSERT INTO users (uuid, nickname, email, password_hash, age, gender, first_name, last_name) 
-             VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-	_, err := db.Exec(stmt, uuid, nickname, email, passwordHash, age, gender, firstName, lastName)
+	stmt := `INSERT INTO users (uuid, nickname, nickname_normalized, email, password_hash, age, gender, first_name, last_name)
+             VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(stmt, uuid, nickname, NormalizeNickname(nickname), NormalizeEmail(email), passwordHash, age, gender, firstName, lastName)
+	if isUniqueViolation(err) {
+		return ErrUserExists
+	}
 	return err
 }
 
-// GetUserByEmailOrNickname fetches user with matching email OR nickname
+// SetUserRole changes a user's role, returning ErrUserNotFound for unknown UUIDs
+func SetUserRole(db *sql.DB, userUUID string, role Role) error {
+	res, err := db.Exec(`UPDATE users SET role = ? WHERE uuid = ?`, role, userUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// SuspendUser blocks a user until the given time, returning ErrUserNotFound
+// for unknown UUIDs
+func SuspendUser(db *sql.DB, userUUID string, until time.Time, reason string) error {
+	res, err := db.Exec(`UPDATE users SET suspended_until = ?, suspension_reason = ? WHERE uuid = ?`, until, reason, userUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// BanUser blocks a user permanently, returning ErrUserNotFound for unknown UUIDs
+func BanUser(db *sql.DB, userUUID string, bannedAt time.Time, reason string) error {
+	res, err := db.Exec(`UPDATE users SET banned_at = ?, suspension_reason = ? WHERE uuid = ?`, bannedAt, reason, userUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// LiftSuspension clears both timed suspensions and bans
+func LiftSuspension(db *sql.DB, userUUID string) error {
+	res, err := db.Exec(`UPDATE users SET suspended_until = NULL, banned_at = NULL, suspension_reason = '' WHERE uuid = ?`, userUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// GetUserSuspension returns the user's active suspension or ban, or nil
+func GetUserSuspension(db *sql.DB, userUUID string) (*Suspension, error) {
+	var bannedAt, suspendedUntil sql.NullTime
+	var reason string
+	err := db.QueryRow(`SELECT banned_at, suspended_until, suspension_reason FROM users WHERE uuid = ?`, userUUID).
+		Scan(&bannedAt, &suspendedUntil, &reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return activeSuspension(bannedAt.Time, suspendedUntil.Time, reason, time.Now()), nil
+}
+
+const userColumns = `uuid, nickname, email, age, gender, first_name, last_name, role, created_at, avatar_uuid`
+
+// scanUser reads userColumns
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var u User
+	var gender, firstName, lastName sql.NullString
+	var createdAt sql.NullTime
+	err := row.Scan(&u.UUID, &u.Nickname, &u.Email, &u.Age, &gender, &firstName, &lastName, &u.Role, &createdAt, &u.AvatarUUID)
+	u.Gender, u.FirstName, u.LastName = gender.String, firstName.String, lastName.String
+	u.CreatedAt = createdAt.Time
+	u.setAvatarURL()
+	return u, err
+}
+
+// GetUser returns a user's public account details, or ErrUserNotFound
+func GetUser(db *sql.DB, userUUID string) (*User, error) {
+	u, err := scanUser(db.QueryRow(`SELECT `+userColumns+` FROM users WHERE uuid = ?`, userUUID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetUsers returns the users found among userUUIDs, keyed by UUID
+func GetUsers(db *sql.DB, userUUIDs []string) (map[string]User, error) {
+	users := map[string]User{}
+	if len(userUUIDs) == 0 {
+		return users, nil
+	}
+
+	args := make([]any, len(userUUIDs))
+	for i, id := range userUUIDs {
+		args[i] = id
+	}
+	rows, err := db.Query(`SELECT `+userColumns+` FROM users WHERE uuid IN (?`+strings.Repeat(", ?", len(userUUIDs)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users[u.UUID] = u
+	}
+	return users, rows.Err()
+}
+
+func GetUsersByNickname(db *sql.DB, nicknames []string) (map[string]User, error) {
+	users := map[string]User{}
+	if len(nicknames) == 0 {
+		return users, nil
+	}
+
+	args := make([]any, len(nicknames))
+	for i, n := range nicknames {
+		args[i] = n
+	}
+	rows, err := db.Query(`
+        SELECT `+userColumns+`
+        FROM users WHERE nickname_normalized IN (?`+strings.Repeat(", ?", len(nicknames)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users[NormalizeNickname(u.Nickname)] = u
+	}
+	return users, rows.Err()
+}
+
+// SetUserAvatar replaces the user's avatar and returns the one it replaced;
+// an empty avatarUUID goes back to the generated default
+func SetUserAvatar(db *sql.DB, userUUID, avatarUUID string) (previous string, err error) {
+	err = WithTx(db, func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT avatar_uuid FROM users WHERE uuid = ?`, userUUID).Scan(&previous)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE users SET avatar_uuid = ? WHERE uuid = ?`, avatarUUID, userUUID)
+		return err
+	})
+	return previous, err
+}
+
+var ErrAdminExists = errors.New("an admin already exists")
+
+// PromoteFirstAdmin makes the user with the given email or nickname an
+// admin, provided nobody holds the role yet
+func PromoteFirstAdmin(db *sql.DB, identifier string) (userUUID string, err error) {
+	err = WithTx(db, func(tx *sql.Tx) error {
+		var admins int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ?`, RoleAdmin).Scan(&admins); err != nil {
+			return err
+		}
+		if admins > 0 {
+			return ErrAdminExists
+		}
+
+		err := tx.QueryRow(`SELECT uuid FROM users WHERE email = ? OR nickname_normalized = ?`,
+			NormalizeEmail(identifier), NormalizeNickname(identifier)).Scan(&userUUID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE users SET role = ? WHERE uuid = ?`, RoleAdmin, userUUID)
+		return err
+	})
+	return userUUID, err
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// GetUserByEmailOrNickname fetches user with matching email OR nickname, ignoring case
 func GetUserByEmailOrNickname(db *sql.DB, identifier string) (uuid, hashedPassword string, err error) {
-	query := `SELECT uuid, password_hash FROM users WHERE email = ? OR nickname = ?`
-	return getUserAuth(db, query, identifier)
+	query := `SELECT uuid, password_hash FROM users WHERE email = ? OR nickname_normalized = ?`
+	return getUserAuth(db, query, NormalizeEmail(identifier), NormalizeNickname(identifier))
 }
 
-func getUserAuth(db *sql.DB, query, id string) (string, string, error) {
+func getUserAuth(db *sql.DB, query, email, nickname string) (string, string, error) {
 	var uuid, hash string
-	err := db.QueryRow(query, id, id).Scan(&uuid, &hash)
+	err := db.QueryRow(query, email, nickname).Scan(&uuid, &hash)
 	return uuid, hash, err
 }
 
-// CreateSession inserts a session for a user
-func CreateSession(db *sql.DB, sessionUUID, userUUID string, expiresAt time.Time) error {
-	stmt := `INSERT INTO sessions (session_uuid, user_uuid, expires_at) VALUES (?, ?, ?)`
-	_, err := db.Exec(stmt, sessionUUID, userUUID, expiresAt)
+// CreateSession inserts a session for a user along with its CSRF token
+func CreateSession(db *sql.DB, sessionUUID, userUUID, csrfToken string, expiresAt time.Time) error {
+	stmt := `INSERT INTO sessions (session_uuid, user_uuid, csrf_token, expires_at) VALUES (?, ?, ?, ?)`
+	_, err := db.Exec(stmt, sessionUUID, userUUID, csrfToken, expiresAt)
 	return err
 }
 
@@ -90,21 +694,35 @@ var ErrSessionNotFound = errors.New("session not found or expired")
 type Session struct {
 	SessionUUID string
 	UserUUID    string
+	CSRFToken   string
 	ExpiresAt   time.Time
+	Role        Role // the user's current role, read with the session
+	// The user's active suspension or ban, nil when they may use the site
+	Suspension *Suspension
 }
 
 // GetSession returns session info if session exists and valid
 func GetSession(db *sql.DB, sessionUUID string) (*Session, error) {
 	var s Session
-	query := "SELECT session_uuid, user_uuid, expires_at FROM sessions WHERE session_uuid = ?"
-	err := db.QueryRow(query, sessionUUID).Scan(&s.SessionUUID, &s.UserUUID, &s.ExpiresAt)
+	query := `
+        SELECT s.session_uuid, s.user_uuid, s.csrf_token, s.expires_at, u.role,
+               u.banned_at, u.suspended_until, u.suspension_reason
+        FROM sessions s
+        JOIN users u ON u.uuid = s.user_uuid
+        WHERE s.session_uuid = ?`
+	var bannedAt, suspendedUntil sql.NullTime
+	var reason string
+	err := db.QueryRow(query, sessionUUID).Scan(&s.SessionUUID, &s.UserUUID, &s.CSRFToken, &s.ExpiresAt, &s.Role,
+		&bannedAt, &suspendedUntil, &reason)
 	if err != nil {
 		return nil, ErrSessionNotFound
 	}
 
-	if time.Now().After(s.ExpiresAt) {
+	now := time.Now()
+	if now.After(s.ExpiresAt) {
 		return nil, ErrSessionNotFound
 	}
+	s.Suspension = activeSuspension(bannedAt.Time, suspendedUntil.Time, reason, now)
 
 	return &s, nil
 }
@@ -114,123 +732,389 @@ func DeleteSession(db *sql.DB, sessionUUID string) error {
 	_, err := db.Exec(stmt, sessionUUID)
 	return err
 }
+
+var ErrPostNotFound = errors.New("post not found")
+
+// Placeholder shown instead of the title and content of a deleted post or comment
+const deletedPlaceholder = "[deleted]"
+
 type Post struct {
-    UUID       string    `json:"uuid"`
-    Title      string    `json:"title"`
-    Content    string    `json:"content"`
-    AuthorUUID string    `json:"author_uuid"`
-    CreatedAt  time.Time `json:"created_at"`
-    Categories []string  `json:"categories"`
-}
-
-// Fetch posts optionally filtered by category
-func GetPosts(db *sql.DB, categoryFilter string) ([]Post, error) {
-    var rows *sql.Rows
-    var err error
-
-    if categoryFilter != "" {
-        query := `
-            SELECT DISTINCT p.uuid, p.title, p.content, p.user_uuid, p.created_at
-            FROM posts p
-            JOIN post_categories pc ON p.uuid = pc.post_uuid
-            WHERE pc.category = ?
-            ORDER BY p.created_at DESC`
-        rows, err = db.Query(query, categoryFilter)
-    } else {
-        query := `
-            SELECT uuid, title, content, user_uuid, created_at
-            FROM posts
-            ORDER BY created_at DESC`
-        rows, err = db.Query(query)
-    }
-
-    if err != nil {
-        return nil, err
-    }
-    defer rows.Close()
-
-    var posts []Post
-    for rows.Next() {
-        var p Post
-        if err := rows.Scan(&p.UUID, &p.Title, &p.Content, &p.AuthorUUID, &p.CreatedAt); err != nil {
-            return nil, err
-        }
-
-        cats, err := GetPostCategories(db, p.UUID)
-        if err != nil {
-            return nil, err
-        }
-        p.Categories = cats
-        posts = append(posts, p)
-    }
-
-    return posts, nil
+	UUID         string       `json:"uuid"`
+	Title        string       `json:"title"`
+	Content      string       `json:"content"`
+	ContentHTML  string       `json:"content_html"` // rendered from Content, never stored
+	AuthorUUID   string       `json:"author_uuid"`
+	Author       Author       `json:"author"`
+	CreatedAt    time.Time    `json:"created_at"`
+	EditedAt     *time.Time   `json:"edited_at,omitempty"`
+	Deleted      bool         `json:"deleted"`
+	Categories   []string     `json:"categories"`
+	CommentCount int          `json:"comment_count"`
+	Likes        int          `json:"likes"`
+	Dislikes     int          `json:"dislikes"`
+	Mentions     []Mention    `json:"mentions"`
+	Attachments  []Attachment `json:"attachments"`
+	HotScore     float64      `json:"-"` // maintained for the hot sort
 }
 
-// GetPostCategories returns all categories for a post
-func GetPostCategories(db *sql.DB, postUUID string) ([]string, error) {
-    rows, err := db.Query(`SELECT category FROM post_categories WHERE post_uuid = ?`, postUUID)
-    if err != nil {
-        return nil, err
-    }
-    defer rows.Close()
+// Author is what posts and comments show about who wrote them
+type Author struct {
+	Nickname  string `json:"nickname"`
+	AvatarURL string `json:"avatar_url"`
+	Role      Role   `json:"role"` // shown as a badge for staff
+}
 
-    var categories []string
-    for rows.Next() {
-        var cat string
-        rows.Scan(&cat)
-        categories = append(categories, cat)
-    }
+// authorColumns reads the author from users joined as u. The join is a
+// LEFT JOIN so content whose author row is missing still shows up.
+const authorColumns = `COALESCE(u.nickname, ''), COALESCE(u.role, 'user'), COALESCE(u.avatar_uuid, '')`
 
-    return categories, nil
+// PostRevision is the state of a post before one of its edits
+type PostRevision struct {
+	PostUUID   string    `json:"post_uuid"`
+	EditorUUID string    `json:"editor_uuid"`
+	Title      string    `json:"title"`
+	Content    string    `json:"content"`
+	Categories []string  `json:"categories"`
+	ReplacedAt time.Time `json:"replaced_at"`
 }
 
-func InsertPost(db *sql.DB, postUUID, userUUID, title, content string, createdAt time.Time) error {
-	stmt := "INSERT INTO posts (uuid, user_uuid, title, content, created_at) VALUES (?, ?, ?, ?, ?)"
-	_, err := db.Exec(stmt, postUUID, userUUID, title, content, createdAt)
-	return err
-}
+const postColumns = `p.uuid, p.title, p.content, p.user_uuid, p.created_at, p.edited_at, p.deleted_at,
+    p.comment_count, p.likes, p.dislikes, p.hot_score, ` + authorColumns
 
-func InsertPostCategories(db *sql.DB, postUUID string, categories []string) error {
-	stmt := "INSERT INTO post_categories (post_uuid, category) VALUES (?, ?)"
-	for _, cat := range categories {
-		_, err := db.Exec(stmt, postUUID, cat)
-		if err != nil {
-			return err
-		}
+// scanPost reads postColumns. A deleted post keeps its author and
+// timestamps but its title and content are withheld.
+func scanPost(row interface{ Scan(...any) error }) (Post, error) {
+	var p Post
+	var editedAt, deletedAt sql.NullTime
+	var avatarUUID string
+	err := row.Scan(&p.UUID, &p.Title, &p.Content, &p.AuthorUUID, &p.CreatedAt, &editedAt, &deletedAt,
+		&p.CommentCount, &p.Likes, &p.Dislikes, &p.HotScore, &p.Author.Nickname, &p.Author.Role, &avatarUUID)
+	p.Author.AvatarURL = avatarURL(p.AuthorUUID, avatarUUID)
+	p.EditedAt = nullTimePtr(editedAt)
+	if deletedAt.Valid {
+		p.Deleted = true
+		p.Title = deletedPlaceholder
+		p.Content = deletedPlaceholder
 	}
-	return nil
+	return p, err
 }
 
-func SaveMessage(db *sql.DB, uuid, sender, receiver, content string, createdAt time.Time) error {
-	stmt := `
-        INSERT INTO messages (uuid, sender_uuid, receiver_uuid, content, created_at)
-        VALUES (?, ?, ?, ?, ?)`
-	_, err := db.Exec(stmt, uuid, sender, receiver, content, createdAt)
-	return err
+// FeedFilter narrows and orders the feed; empty fields match every post
+type FeedFilter struct {
+	Category string
+	// Author is a normalized nickname
+	Author string
+	// AuthorUUID, LikedBy and FollowedBy are user UUIDs, keeping posts that
+	// user wrote, liked, or filed under a category they follow
+	AuthorUUID string
+	LikedBy    string
+	FollowedBy string
+	Sort       FeedSort
+	// Since drops posts created before it
+	Since time.Time
+	// After resumes the feed below a previous page's last post
+	After *FeedCursor
+	Limit int
 }
 
-func LoadMessages(db *sql.DB, userA, userB string, limit, offset int) ([]Message, error) {
-	stmt := `
-        SELECT sender_uuid, receiver_uuid, content, created_at
-        FROM messages
-        WHERE (sender_uuid = ? AND receiver_uuid = ?)
-           OR (sender_uuid = ? AND receiver_uuid = ?)
-        ORDER BY created_at DESC
-        LIMIT ? OFFSET ?`
+// feedOrderKeys are the maintained columns each sort ranks by ahead of
+// created_at and uuid. Each has an index in schema.sql.
+var feedOrderKeys = map[FeedSort]string{
+	SortTop:       "(p.likes - p.dislikes)",
+	SortHot:       "p.hot_score",
+	SortCommented: "p.comment_count",
+}
 
-	rows, err := db.Query(stmt, userA, userB, userB, userA, limit, offset)
-	if err != nil {
+// GetPosts returns a page of live posts matching the filter in its sort order
+func GetPosts(db *sql.DB, f FeedFilter) ([]Post, error) {
+	// Deleted posts stay reachable by UUID but drop out of the feed
+	query := `
+        SELECT ` + postColumns + `
+        FROM posts p
+        LEFT JOIN users u ON u.uuid = p.user_uuid
+        WHERE p.deleted_at IS NULL`
+	var args []any
+	if f.Category != "" {
+		query += ` AND p.uuid IN (SELECT post_uuid FROM post_categories WHERE category = ?)`
+		args = append(args, f.Category)
+	}
+	if f.Author != "" {
+		query += ` AND u.nickname_normalized = ?`
+		args = append(args, f.Author)
+	}
+	if f.AuthorUUID != "" {
+		query += ` AND p.user_uuid = ?`
+		args = append(args, f.AuthorUUID)
+	}
+	if f.LikedBy != "" {
+		query += ` AND p.id IN (SELECT target_id FROM likes_dislikes WHERE user_uuid = ? AND target_type = ? AND is_like)`
+		args = append(args, f.LikedBy, ReactionOnPost)
+	}
+	if f.FollowedBy != "" {
+		query += ` AND p.uuid IN (
+            SELECT pc.post_uuid FROM post_categories pc
+            JOIN category_follows f ON f.category = pc.category
+            WHERE f.user_uuid = ?)`
+		args = append(args, f.FollowedBy)
+	}
+	if !f.Since.IsZero() {
+		query += ` AND p.created_at >= ?`
+		args = append(args, f.Since)
+	}
+	order := `p.created_at DESC, p.uuid DESC`
+	if key, ok := feedOrderKeys[f.Sort]; ok {
+		order = key + ` DESC, ` + order
+		if f.After != nil {
+			query += ` AND (` + key + `, p.created_at, p.uuid) < (?, ?, ?)`
+			args = append(args, f.After.Key, f.After.CreatedAt, f.After.UUID)
+		}
+	} else if f.After != nil {
+		query += ` AND (p.created_at, p.uuid) < (?, ?)`
+		args = append(args, f.After.CreatedAt, f.After.UUID)
+	}
+	query += ` ORDER BY ` + order + ` LIMIT ?`
+	args = append(args, f.Limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	posts := []Post{}
+	for rows.Next() {
+		p, err := scanPost(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Categories are loaded only after the posts cursor is closed so a
+	// request never holds two pooled connections at once
+	if err := attachCategories(db, posts); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// attachCategories fills Categories for every post, querying in batches to
+// stay under SQLite's bound parameter limit
+func attachCategories(db dbtx, posts []Post) error {
+	const batchSize = 500
+
+	byUUID := make(map[string]*Post, len(posts))
+	for i := range posts {
+		posts[i].Categories = []string{}
+		byUUID[posts[i].UUID] = &posts[i]
+	}
+
+	for start := 0; start < len(posts); start += batchSize {
+		end := min(start+batchSize, len(posts))
+		args := make([]any, 0, end-start)
+		for _, p := range posts[start:end] {
+			args = append(args, p.UUID)
+		}
+
+		query := `SELECT post_uuid, category FROM post_categories WHERE post_uuid IN (?` +
+			strings.Repeat(", ?", len(args)-1) + `) ORDER BY category`
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var postUUID, category string
+			if err := rows.Scan(&postUUID, &category); err != nil {
+				rows.Close()
+				return err
+			}
+			if p, ok := byUUID[postUUID]; ok {
+				p.Categories = append(p.Categories, category)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPost returns one post, deleted or not. A deleted post keeps its author
+// and timestamps but its title, content and categories are withheld.
+func GetPost(db dbtx, postUUID string) (*Post, error) {
+	p, err := scanPost(db.QueryRow(`
+        SELECT `+postColumns+`
+        FROM posts p
+        LEFT JOIN users u ON u.uuid = p.user_uuid
+        WHERE p.uuid = ?`, postUUID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPostNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Deleted {
+		p.Categories = []string{}
+		return &p, nil
+	}
+	p.Categories, err = GetPostCategories(db, p.UUID)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// UpdatePost saves the current version of a live post as a revision, then
+// replaces its title, content and categories
+func UpdatePost(db *sql.DB, post Post, editorUUID string, editedAt time.Time) error {
+	return WithTx(db, func(tx *sql.Tx) error {
+		current, err := GetPost(tx, post.UUID)
+		if err != nil {
+			return err
+		}
+		if current.Deleted {
+			return ErrPostNotFound
+		}
+
+		categories, err := json.Marshal(current.Categories)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+            INSERT INTO post_revisions (post_uuid, editor_uuid, title, content, categories, replaced_at)
+            VALUES (?, ?, ?, ?, ?, ?)`,
+			current.UUID, editorUUID, current.Title, current.Content, string(categories), editedAt)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE posts SET title = ?, content = ?, edited_at = ? WHERE uuid = ?`,
+			post.Title, post.Content, editedAt, post.UUID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM post_categories WHERE post_uuid = ?`, post.UUID); err != nil {
+			return err
+		}
+		return InsertPostCategories(tx, post.UUID, post.Categories)
+	})
+}
+
+// SoftDeletePost marks a post deleted; its row, revisions and comments are kept
+func SoftDeletePost(db *sql.DB, postUUID string, deletedAt time.Time) error {
+	res, err := db.Exec(`UPDATE posts SET deleted_at = ? WHERE uuid = ? AND deleted_at IS NULL`, deletedAt, postUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPostNotFound
+	}
+	return nil
+}
+
+// GetPostRevisions returns a post's edit history, oldest first
+func GetPostRevisions(db *sql.DB, postUUID string) ([]PostRevision, error) {
+	rows, err := db.Query(`
+        SELECT post_uuid, editor_uuid, title, content, categories, replaced_at
+        FROM post_revisions WHERE post_uuid = ? ORDER BY id`, postUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []PostRevision{}
+	for rows.Next() {
+		var r PostRevision
+		var categories string
+		if err := rows.Scan(&r.PostUUID, &r.EditorUUID, &r.Title, &r.Content, &categories, &r.ReplacedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(categories), &r.Categories); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// GetPostCategories returns all categories for a post
+func GetPostCategories(db dbtx, postUUID string) ([]string, error) {
+	rows, err := db.Query(`SELECT category FROM post_categories WHERE post_uuid = ?`, postUUID)
+	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var messages []Message
+	categories := []string{}
 	for rows.Next() {
-		var m Message
-		var createdAt time.Time
-		rows.Scan(&m.From, &m.To, &m.Content, &createdAt)
-		m.SentAt = createdAt.Format(time.RFC3339)
+		var cat string
+		rows.Scan(&cat)
+		categories = append(categories, cat)
+	}
+
+	return categories, nil
+}
+
+func InsertPost(db dbtx, postUUID, userUUID, title, content string, createdAt time.Time) error {
+	stmt := "INSERT INTO posts (uuid, user_uuid, title, content, created_at, hot_score) VALUES (?, ?, ?, ?, ?, ?)"
+	_, err := db.Exec(stmt, postUUID, userUUID, title, content, createdAt, hotScore(0, 0, createdAt))
+	return err
+}
+
+func InsertPostCategories(db dbtx, postUUID string, categories []string) error {
+	stmt := "INSERT INTO post_categories (post_uuid, category) VALUES (?, ?)"
+	for _, cat := range categories {
+		_, err := db.Exec(stmt, postUUID, cat)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func SaveMessage(db dbtx, uuid, sender, receiver, content string, createdAt time.Time) error {
+	stmt := `
+        INSERT INTO messages (uuid, sender_uuid, receiver_uuid, content, created_at)
+        VALUES (?, ?, ?, ?, ?)`
+	_, err := db.Exec(stmt, uuid, sender, receiver, content, createdAt)
+	return err
+}
+
+func LoadMessages(db *sql.DB, userA, userB string, limit, offset int) ([]Message, error) {
+	stmt := `
+        SELECT ` + messageColumns + `
+        FROM messages
+        WHERE (sender_uuid = ? AND receiver_uuid = ?)
+           OR (sender_uuid = ? AND receiver_uuid = ?)
+        ORDER BY created_at DESC
+        LIMIT ? OFFSET ?`
+
+	rows, err := db.Query(stmt, userA, userB, userB, userA, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
 		messages = append(messages, m)
 	}
 
@@ -239,12 +1123,752 @@ func LoadMessages(db *sql.DB, userA, userB string, limit, offset int) ([]Message
 		messages[i], messages[j] = messages[j], messages[i]
 	}
 
-	return messages, nil
+	return messages, rows.Err()
+}
+
+var ErrMessageNotFound = errors.New("message not found")
+
+const messageColumns = `uuid, sender_uuid, receiver_uuid, content, created_at, deleted_at`
+
+// scanMessage reads messageColumns, hiding the content of deleted messages
+func scanMessage(row interface{ Scan(...any) error }) (Message, error) {
+	var m Message
+	var createdAt time.Time
+	var deletedAt sql.NullTime
+	err := row.Scan(&m.UUID, &m.From, &m.To, &m.Content, &createdAt, &deletedAt)
+	m.SentAt = createdAt.Format(time.RFC3339)
+	if deletedAt.Valid {
+		m.Deleted = true
+		m.Content = deletedPlaceholder
+	}
+	return m, err
+}
+
+func GetMessage(db *sql.DB, messageUUID string) (*Message, error) {
+	m, err := scanMessage(db.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE uuid = ?`, messageUUID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func SoftDeleteMessage(db *sql.DB, messageUUID string, deletedAt time.Time) error {
+	res, err := db.Exec(`UPDATE messages SET deleted_at = ? WHERE uuid = ? AND deleted_at IS NULL`, deletedAt, messageUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
 }
 
-func InsertComment(db *sql.DB, commentUUID, postUUID, userUUID, content string, createdAt time.Time) error {
-    stmt := `INSERT INTO comments (uuid, post_uuid, user_uuid, content, created_at)
+var ErrCommentNotFound = errors.New("comment not found")
+
+type Comment struct {
+	UUID        string     `json:"uuid"`
+	PostUUID    string     `json:"post_uuid"`
+	AuthorUUID  string     `json:"author_uuid"`
+	Author      Author     `json:"author"`
+	Content     string     `json:"content"`
+	ContentHTML string     `json:"content_html"` // rendered from Content, never stored
+	CreatedAt   time.Time  `json:"created_at"`
+	EditedAt    *time.Time `json:"edited_at,omitempty"`
+	Deleted     bool       `json:"deleted"`
+	Likes       int        `json:"likes"`
+	Dislikes    int        `json:"dislikes"`
+	Mentions    []Mention  `json:"mentions"`
+}
+
+// commentColumns are read from comments c joined with their author as u
+const commentColumns = `c.uuid, c.post_uuid, c.user_uuid, c.content, c.created_at, c.edited_at, c.deleted_at,
+    c.likes, c.dislikes, ` + authorColumns
+
+const commentTables = `comments c LEFT JOIN users u ON u.uuid = c.user_uuid`
+
+// scanComment reads commentColumns, hiding the content of deleted comments
+func scanComment(row interface{ Scan(...any) error }) (Comment, error) {
+	var c Comment
+	var editedAt, deletedAt sql.NullTime
+	var avatarUUID string
+	err := row.Scan(&c.UUID, &c.PostUUID, &c.AuthorUUID, &c.Content, &c.CreatedAt, &editedAt, &deletedAt,
+		&c.Likes, &c.Dislikes, &c.Author.Nickname, &c.Author.Role, &avatarUUID)
+	c.Author.AvatarURL = avatarURL(c.AuthorUUID, avatarUUID)
+	c.EditedAt = nullTimePtr(editedAt)
+	if deletedAt.Valid {
+		c.Deleted = true
+		c.Content = deletedPlaceholder
+	}
+	return c, err
+}
+
+// GetComments returns the comments on a post, oldest first. Deleted comments
+// keep their place in the list with placeholder content.
+func GetComments(db *sql.DB, postUUID string) ([]Comment, error) {
+	rows, err := db.Query(`SELECT `+commentColumns+` FROM `+commentTables+` WHERE c.post_uuid = ? ORDER BY c.created_at`, postUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []Comment{}
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+func GetComment(db *sql.DB, commentUUID string) (*Comment, error) {
+	c, err := scanComment(db.QueryRow(`SELECT `+commentColumns+` FROM `+commentTables+` WHERE c.uuid = ?`, commentUUID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCommentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// InsertComment adds a comment to a live post and bumps its comment count;
+// run it in a transaction so the two stay in step. Returns ErrPostNotFound
+// if the post is missing or deleted.
+func InsertComment(tx *sql.Tx, commentUUID, postUUID, userUUID, content string, createdAt time.Time) error {
+	res, err := tx.Exec(`UPDATE posts SET comment_count = comment_count + 1 WHERE uuid = ? AND deleted_at IS NULL`, postUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPostNotFound
+	}
+
+	stmt := `INSERT INTO comments (uuid, post_uuid, user_uuid, content, created_at)
              VALUES (?, ?, ?, ?, ?)`
-    _, err := db.Exec(stmt, commentUUID, postUUID, userUUID, content, createdAt)
-    return err
+	_, err = tx.Exec(stmt, commentUUID, postUUID, userUUID, content, createdAt)
+	return err
+}
+
+// UpdateComment replaces the content of a live comment
+func UpdateComment(db *sql.DB, commentUUID, content string, editedAt time.Time) error {
+	res, err := db.Exec(`UPDATE comments SET content = ?, edited_at = ? WHERE uuid = ? AND deleted_at IS NULL`,
+		content, editedAt, commentUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCommentNotFound
+	}
+	return nil
+}
+
+// SoftDeleteComment marks a comment deleted and removes it from its post's count
+func SoftDeleteComment(db *sql.DB, commentUUID string, deletedAt time.Time) error {
+	return WithTx(db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE comments SET deleted_at = ? WHERE uuid = ? AND deleted_at IS NULL`, deletedAt, commentUUID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrCommentNotFound
+		}
+
+		_, err = tx.Exec(`
+            UPDATE posts SET comment_count = comment_count - 1
+            WHERE uuid = (SELECT post_uuid FROM comments WHERE uuid = ?) AND comment_count > 0`, commentUUID)
+		return err
+	})
+}
+
+var (
+	ErrReportNotFound = errors.New("report not found")
+	ErrReportExists   = errors.New("report already open")
+)
+
+// InsertReport files a report, returning ErrReportExists if the reporter
+// already has an open report on the same target
+func InsertReport(db *sql.DB, r Report) error {
+	stmt := `
+        INSERT INTO reports (uuid, reporter_uuid, target_type, target_uuid, target_author_uuid, reason, status, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(stmt, r.UUID, r.ReporterUUID, r.TargetType, r.TargetUUID, r.TargetAuthorUUID, r.Reason, r.Status, r.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrReportExists
+	}
+	return err
+}
+
+const reportColumns = `uuid, reporter_uuid, target_type, target_uuid, target_author_uuid, reason, status, created_at, resolved_at, resolved_by`
+
+func scanReport(row interface{ Scan(...any) error }) (Report, error) {
+	var r Report
+	var resolvedAt sql.NullTime
+	var resolvedBy sql.NullString
+	err := row.Scan(&r.UUID, &r.ReporterUUID, &r.TargetType, &r.TargetUUID, &r.TargetAuthorUUID,
+		&r.Reason, &r.Status, &r.CreatedAt, &resolvedAt, &resolvedBy)
+	r.ResolvedAt = nullTimePtr(resolvedAt)
+	r.ResolvedBy = resolvedBy.String
+	return r, err
+}
+
+// GetReport returns a report together with the actions taken on it
+func GetReport(db *sql.DB, reportUUID string) (*Report, error) {
+	r, err := scanReport(db.QueryRow(`SELECT `+reportColumns+` FROM reports WHERE uuid = ?`, reportUUID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrReportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+        SELECT report_uuid, moderator_uuid, action, note, created_at
+        FROM report_actions
+        WHERE report_uuid = ?
+        ORDER BY created_at, id`, reportUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	r.Actions = []ReportAction{}
+	for rows.Next() {
+		var a ReportAction
+		if err := rows.Scan(&a.ReportUUID, &a.ModeratorUUID, &a.Action, &a.Note, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		r.Actions = append(r.Actions, a)
+	}
+	return &r, rows.Err()
+}
+
+// ListReports returns reports matching the filter, oldest first so the
+// queue is worked in the order reports arrived
+func ListReports(db *sql.DB, f ReportFilter) ([]Report, error) {
+	query := `SELECT ` + reportColumns + ` FROM reports WHERE 1 = 1`
+	var args []any
+	if f.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, f.Status)
+	}
+	if f.TargetType != "" {
+		query += ` AND target_type = ?`
+		args = append(args, f.TargetType)
+	}
+	query += ` ORDER BY created_at, id LIMIT ? OFFSET ?`
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+// ResolveReport closes an open report with the given status and records the
+// action taken. Reports that are unknown or already closed return
+// ErrReportNotFound.
+func ResolveReport(db *sql.DB, status ReportStatus, action ReportAction) error {
+	return WithTx(db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`
+            UPDATE reports SET status = ?, resolved_at = ?, resolved_by = ?
+            WHERE uuid = ? AND status = ?`,
+			status, action.CreatedAt, action.ModeratorUUID, action.ReportUUID, ReportOpen)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrReportNotFound
+		}
+
+		_, err = tx.Exec(`
+            INSERT INTO report_actions (report_uuid, moderator_uuid, action, note, created_at)
+            VALUES (?, ?, ?, ?, ?)`,
+			action.ReportUUID, action.ModeratorUUID, action.Action, action.Note, action.CreatedAt)
+		return err
+	})
+}
+
+// InsertAuditEvent appends to the audit log; triggers in schema.sql reject
+// updates and deletes
+func InsertAuditEvent(db *sql.DB, e AuditEvent) error {
+	stmt := `
+        INSERT INTO audit_events (actor_uuid, action, target_type, target_uuid, detail, ip, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)`
+	// Stored in UTC so the time range filters compare like with like
+	_, err := db.Exec(stmt, nullString(e.ActorUUID), e.Action, e.TargetType, e.TargetUUID, e.Detail, e.IP, e.CreatedAt.UTC())
+	return err
+}
+
+// ListAuditEvents returns events matching the filter in the order they were written
+func ListAuditEvents(db *sql.DB, f AuditFilter) ([]AuditEvent, error) {
+	query := `
+        SELECT id, actor_uuid, action, target_type, target_uuid, detail, ip, created_at
+        FROM audit_events
+        WHERE id > ?`
+	args := []any{f.AfterID}
+	if f.ActorUUID != "" {
+		query += ` AND actor_uuid = ?`
+		args = append(args, f.ActorUUID)
+	}
+	if f.Action != "" {
+		query += ` AND action = ?`
+		args = append(args, f.Action)
+	}
+	if !f.Since.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, f.Until.UTC())
+	}
+	query += ` ORDER BY id LIMIT ?`
+	args = append(args, f.Limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var actor sql.NullString
+		if err := rows.Scan(&e.ID, &actor, &e.Action, &e.TargetType, &e.TargetUUID, &e.Detail, &e.IP, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.ActorUUID = actor.String
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// nullString stores empty strings as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// reactionTables maps reaction target types to the table holding the target
+var reactionTables = map[ReactionTarget]string{
+	ReactionOnPost:    "posts",
+	ReactionOnComment: "comments",
+}
+
+// SetReaction records a user's like or dislike, replacing any earlier
+// reaction, and keeps the target's counters in step. Targets that are
+// missing or deleted return ErrPostNotFound or ErrCommentNotFound.
+func SetReaction(db *sql.DB, userUUID string, targetType ReactionTarget, targetUUID string, like bool) (ReactionCounts, error) {
+	var counts ReactionCounts
+	err := WithTx(db, func(tx *sql.Tx) error {
+		table := reactionTables[targetType]
+		targetID, err := reactionTargetID(tx, targetType, targetUUID)
+		if err != nil {
+			return err
+		}
+
+		var previous sql.NullBool
+		err = tx.QueryRow(`SELECT is_like FROM likes_dislikes WHERE user_uuid = ? AND target_type = ? AND target_id = ?`,
+			userUUID, targetType, targetID).Scan(&previous)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		if !previous.Valid || previous.Bool != like {
+			_, err = tx.Exec(`
+                INSERT INTO likes_dislikes (user_uuid, target_type, target_id, is_like) VALUES (?, ?, ?, ?)
+                ON CONFLICT(user_uuid, target_type, target_id) DO UPDATE SET is_like = excluded.is_like, created_at = CURRENT_TIMESTAMP`,
+				userUUID, targetType, targetID, like)
+			if err != nil {
+				return err
+			}
+			if err := adjustReactionCount(tx, table, targetID, like, 1); err != nil {
+				return err
+			}
+			if previous.Valid {
+				if err := adjustReactionCount(tx, table, targetID, previous.Bool, -1); err != nil {
+					return err
+				}
+			}
+			if targetType == ReactionOnPost {
+				if err := updateHotScore(tx, targetID); err != nil {
+					return err
+				}
+			}
+		}
+
+		counts, err = reactionCounts(tx, table, targetID)
+		counts.Reaction = reactionName(like)
+		return err
+	})
+	return counts, err
+}
+
+// RemoveReaction withdraws a user's reaction, if any
+func RemoveReaction(db *sql.DB, userUUID string, targetType ReactionTarget, targetUUID string) (ReactionCounts, error) {
+	var counts ReactionCounts
+	err := WithTx(db, func(tx *sql.Tx) error {
+		table := reactionTables[targetType]
+		targetID, err := reactionTargetID(tx, targetType, targetUUID)
+		if err != nil {
+			return err
+		}
+
+		var previous bool
+		err = tx.QueryRow(`
+            DELETE FROM likes_dislikes WHERE user_uuid = ? AND target_type = ? AND target_id = ?
+            RETURNING is_like`, userUUID, targetType, targetID).Scan(&previous)
+		if err == nil {
+			err = adjustReactionCount(tx, table, targetID, previous, -1)
+		}
+		if err == nil && targetType == ReactionOnPost {
+			err = updateHotScore(tx, targetID)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		counts, err = reactionCounts(tx, table, targetID)
+		return err
+	})
+	return counts, err
+}
+
+func reactionTargetID(tx *sql.Tx, targetType ReactionTarget, targetUUID string) (int64, error) {
+	var id int64
+	err := tx.QueryRow(`SELECT id FROM `+reactionTables[targetType]+` WHERE uuid = ? AND deleted_at IS NULL`, targetUUID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		if targetType == ReactionOnComment {
+			return 0, ErrCommentNotFound
+		}
+		return 0, ErrPostNotFound
+	}
+	return id, err
+}
+
+func adjustReactionCount(tx *sql.Tx, table string, targetID int64, like bool, delta int) error {
+	column := "dislikes"
+	if like {
+		column = "likes"
+	}
+	_, err := tx.Exec(`UPDATE `+table+` SET `+column+` = MAX(`+column+` + ?, 0) WHERE id = ?`, delta, targetID)
+	return err
+}
+
+// updateHotScore recomputes a post's hot_score from its reaction counters
+func updateHotScore(tx *sql.Tx, postID int64) error {
+	var likes, dislikes int
+	var createdAt time.Time
+	err := tx.QueryRow(`SELECT likes, dislikes, created_at FROM posts WHERE id = ?`, postID).Scan(&likes, &dislikes, &createdAt)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE posts SET hot_score = ? WHERE id = ?`, hotScore(likes, dislikes, createdAt), postID)
+	return err
+}
+
+func reactionCounts(tx *sql.Tx, table string, targetID int64) (ReactionCounts, error) {
+	var c ReactionCounts
+	err := tx.QueryRow(`SELECT likes, dislikes FROM `+table+` WHERE id = ?`, targetID).Scan(&c.Likes, &c.Dislikes)
+	return c, err
+}
+
+func InsertNotification(db dbtx, n Notification) error {
+	stmt := `
+        INSERT INTO notifications (uuid, user_uuid, type, actor_uuid, target_type, target_uuid, post_uuid, preview, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(stmt, n.UUID, n.UserUUID, n.Type, n.ActorUUID, n.TargetType, n.TargetUUID, n.PostUUID, n.Preview, n.CreatedAt)
+	return err
+}
+
+// InsertNotificationOnce inserts n unless an equivalent notification exists;
+// the check and the insert are one statement, so two requests cannot both pass
+func InsertNotificationOnce(db *sql.DB, n Notification) (bool, error) {
+	res, err := db.Exec(`
+        INSERT INTO notifications (uuid, user_uuid, type, actor_uuid, target_type, target_uuid, post_uuid, preview, created_at)
+        SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?
+        WHERE NOT EXISTS (
+            SELECT 1 FROM notifications
+            WHERE target_uuid = ? AND target_type = ? AND actor_uuid = ? AND user_uuid = ? AND type = ?)`,
+		n.UUID, n.UserUUID, n.Type, n.ActorUUID, n.TargetType, n.TargetUUID, n.PostUUID, n.Preview, n.CreatedAt,
+		n.TargetUUID, n.TargetType, n.ActorUUID, n.UserUUID, n.Type)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	return inserted > 0, err
+}
+
+// ListNotifications returns one page of a user's notifications, newest first
+func ListNotifications(db *sql.DB, userUUID string, unreadOnly bool, limit, offset int) ([]Notification, error) {
+	query := `
+        SELECT uuid, user_uuid, type, actor_uuid, target_type, target_uuid, post_uuid, preview, created_at, read_at
+        FROM notifications
+        WHERE user_uuid = ?`
+	if unreadOnly {
+		query += ` AND read_at IS NULL`
+	}
+	query += ` ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?`
+
+	rows, err := db.Query(query, userUUID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var readAt sql.NullTime
+		if err := rows.Scan(&n.UUID, &n.UserUUID, &n.Type, &n.ActorUUID, &n.TargetType, &n.TargetUUID,
+			&n.PostUUID, &n.Preview, &n.CreatedAt, &readAt); err != nil {
+			return nil, err
+		}
+		n.ReadAt = nullTimePtr(readAt)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func CountUnreadNotifications(db *sql.DB, userUUID string) (int, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_uuid = ? AND read_at IS NULL`, userUUID).Scan(&n)
+	return n, err
+}
+
+// MarkNotificationRead returns ErrNotificationNotFound unless the
+// notification belongs to the user. Marking twice is not an error.
+func MarkNotificationRead(db *sql.DB, userUUID, notificationUUID string, readAt time.Time) error {
+	res, err := db.Exec(`UPDATE notifications SET read_at = COALESCE(read_at, ?) WHERE uuid = ? AND user_uuid = ?`,
+		readAt, notificationUUID, userUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotificationNotFound
+	}
+	return nil
+}
+
+func MarkAllNotificationsRead(db *sql.DB, userUUID string, readAt time.Time) error {
+	_, err := db.Exec(`UPDATE notifications SET read_at = ? WHERE user_uuid = ? AND read_at IS NULL`, readAt, userUUID)
+	return err
+}
+
+// GetNotificationPreferences returns every notification type, enabled
+// unless the user switched it off
+func GetNotificationPreferences(db *sql.DB, userUUID string) (NotificationPreferences, error) {
+	rows, err := db.Query(`SELECT type, enabled FROM notification_preferences WHERE user_uuid = ?`, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefs := defaultNotificationPreferences()
+	for rows.Next() {
+		var t NotificationType
+		var enabled bool
+		if err := rows.Scan(&t, &enabled); err != nil {
+			return nil, err
+		}
+		if _, known := prefs[t]; known {
+			prefs[t] = enabled
+		}
+	}
+	return prefs, rows.Err()
+}
+
+func SetNotificationPreferences(db *sql.DB, userUUID string, changes NotificationPreferences) error {
+	return WithTx(db, func(tx *sql.Tx) error {
+		for t, enabled := range changes {
+			_, err := tx.Exec(`
+                INSERT INTO notification_preferences (user_uuid, type, enabled) VALUES (?, ?, ?)
+                ON CONFLICT(user_uuid, type) DO UPDATE SET enabled = excluded.enabled`, userUUID, t, enabled)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func FollowCategory(db *sql.DB, userUUID, category string, at time.Time) error {
+	_, err := db.Exec(`
+        INSERT INTO category_follows (user_uuid, category, created_at) VALUES (?, ?, ?)
+        ON CONFLICT(user_uuid, category) DO NOTHING`, userUUID, category, at)
+	return err
+}
+
+func UnfollowCategory(db *sql.DB, userUUID, category string) error {
+	_, err := db.Exec(`DELETE FROM category_follows WHERE user_uuid = ? AND category = ?`, userUUID, category)
+	return err
+}
+
+func GetFollowedCategories(db *sql.DB, userUUID string) ([]string, error) {
+	rows, err := db.Query(`SELECT category FROM category_follows WHERE user_uuid = ? ORDER BY category`, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []string{}
+	for rows.Next() {
+		var category string
+		if err := rows.Scan(&category); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+// AddMentions inserts the mention rows that do not exist yet and returns the
+// users they name
+func AddMentions(db *sql.DB, targetType, targetUUID string, userUUIDs []string, at time.Time) ([]string, error) {
+	added := []string{}
+	err := WithTx(db, func(tx *sql.Tx) error {
+		for _, userUUID := range userUUIDs {
+			res, err := tx.Exec(`
+                INSERT INTO mentions (user_uuid, target_type, target_uuid, created_at) VALUES (?, ?, ?, ?)
+                ON CONFLICT(target_type, target_uuid, user_uuid) DO NOTHING`, userUUID, targetType, targetUUID, at)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				added = append(added, userUUID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+const attachmentColumns = `uuid, uploader_uuid, filename, content_type, size, width, height, has_thumbnail, owner_type, owner_uuid, created_at`
+
+func scanAttachment(row interface{ Scan(...any) error }) (Attachment, error) {
+	var a Attachment
+	err := row.Scan(&a.UUID, &a.UploaderUUID, &a.Filename, &a.ContentType, &a.Size, &a.Width, &a.Height,
+		&a.HasThumbnail, &a.OwnerType, &a.OwnerUUID, &a.CreatedAt)
+	a.setURLs()
+	return a, err
+}
+
+func InsertAttachment(db *sql.DB, a Attachment) error {
+	stmt := `
+        INSERT INTO attachments (uuid, uploader_uuid, filename, content_type, size, width, height, has_thumbnail, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(stmt, a.UUID, a.UploaderUUID, a.Filename, a.ContentType, a.Size, a.Width, a.Height, a.HasThumbnail, a.CreatedAt)
+	return err
+}
+
+func GetAttachment(db *sql.DB, attachmentUUID string) (*Attachment, error) {
+	a, err := scanAttachment(db.QueryRow(`SELECT `+attachmentColumns+` FROM attachments WHERE uuid = ?`, attachmentUUID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// LinkAttachments gives every listed attachment its owner. Each must have
+// been uploaded by uploaderUUID and not be linked yet; run it in the
+// transaction that writes the owner so a failure links nothing.
+func LinkAttachments(tx *sql.Tx, uploaderUUID, ownerType, ownerUUID string, attachmentUUIDs []string) error {
+	for _, attachmentUUID := range attachmentUUIDs {
+		res, err := tx.Exec(`
+            UPDATE attachments SET owner_type = ?, owner_uuid = ?
+            WHERE uuid = ? AND uploader_uuid = ? AND owner_type = ''`,
+			ownerType, ownerUUID, attachmentUUID, uploaderUUID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrAttachmentNotFound
+		}
+	}
+	return nil
+}
+
+// DeleteUnclaimedAttachments removes attachments uploaded before cutoff that
+// nothing has claimed and returns them, so their blobs can be removed too
+func DeleteUnclaimedAttachments(db *sql.DB, cutoff time.Time) ([]Attachment, error) {
+	var deleted []Attachment
+	err := WithTx(db, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT `+attachmentColumns+` FROM attachments WHERE owner_type = '' AND created_at < ?`, cutoff)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			a, err := scanAttachment(rows)
+			if err != nil {
+				return err
+			}
+			deleted = append(deleted, a)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM attachments WHERE owner_type = '' AND created_at < ?`, cutoff)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// ListAttachments returns the attachments of each owner in upload order
+func ListAttachments(db *sql.DB, ownerType string, ownerUUIDs []string) (map[string][]Attachment, error) {
+	byOwner := map[string][]Attachment{}
+	if len(ownerUUIDs) == 0 {
+		return byOwner, nil
+	}
+
+	args := []any{ownerType}
+	for _, ownerUUID := range ownerUUIDs {
+		args = append(args, ownerUUID)
+	}
+	query := `
+        SELECT ` + attachmentColumns + `
+        FROM attachments
+        WHERE owner_type = ? AND owner_uuid IN (?` + strings.Repeat(", ?", len(ownerUUIDs)-1) + `)
+        ORDER BY created_at, id`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		byOwner[a.OwnerUUID] = append(byOwner[a.OwnerUUID], a)
+	}
+	return byOwner, rows.Err()
 }
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentWritesAndReads hammers one database file with chat writes,
+// read-then-write transactions and feed reads from more goroutines than the
+// pool has connections. None may fail with "database is locked".
+func TestConcurrentWritesAndReads(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	db, err := InitDB(filepath.Join(t.TempDir(), "forum.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	defer db.Close()
+
+	// Every pooled connection got the DSN pragmas
+	ctx := context.Background()
+	conns := make([]*sql.Conn, sqliteMaxOpenConns)
+	for i := range conns {
+		if conns[i], err = db.Conn(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, conn := range conns {
+		var journal string
+		var foreignKeys, busyTimeout int
+		conn.QueryRowContext(ctx, `PRAGMA journal_mode`).Scan(&journal)
+		conn.QueryRowContext(ctx, `PRAGMA foreign_keys`).Scan(&foreignKeys)
+		conn.QueryRowContext(ctx, `PRAGMA busy_timeout`).Scan(&busyTimeout)
+		if journal != "wal" || foreignKeys != 1 || busyTimeout != sqliteBusyTimeoutMs {
+			t.Errorf("connection pragmas: journal_mode=%s foreign_keys=%d busy_timeout=%d", journal, foreignKeys, busyTimeout)
+		}
+		conn.Close()
+	}
+
+	const users = 20
+	for i := 0; i < users; i++ {
+		id := fmt.Sprint(i)
+		if err := InsertUserFull(db, "u"+id, "user"+id, "user"+id+"@x.com", "x", 20, "", "", ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := InsertPost(db, "p"+id, "u"+id, "title", "content", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const (
+		writers    = 16
+		counters   = 8
+		readers    = 16
+		iterations = 50
+	)
+	errs := make(chan error, (writers+counters+readers)*iterations)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				from, to := fmt.Sprint("u", (w+i)%users), fmt.Sprint("u", (w+i+1)%users)
+				errs <- SaveMessage(db, fmt.Sprintf("m-%d-%d", w, i), from, to, "hello", time.Now())
+			}
+		}()
+	}
+	// Transactions that read before they write deadlock under deferred
+	// locking instead of waiting on busy_timeout
+	for w := 0; w < counters; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				errs <- WithTx(db, func(tx *sql.Tx) error {
+					var n int
+					if err := tx.QueryRow(`SELECT COUNT(*) FROM post_categories WHERE post_uuid = ?`, fmt.Sprint("p", i%users)).Scan(&n); err != nil {
+						return err
+					}
+					return InsertPostCategories(tx, fmt.Sprint("p", i%users), []string{fmt.Sprintf("c-%d-%d", w, n)})
+				})
+			}
+		}()
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				_, err := GetPosts(db, FeedFilter{Sort: SortHot, Limit: feedPageSize})
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	failures := 0
+	for err := range errs {
+		if err != nil {
+			if failures++; failures <= 5 {
+				t.Error(err)
+			}
+		}
+	}
+	if failures > 0 {
+		t.Fatalf("%d of %d operations failed", failures, (writers+counters+readers)*iterations)
+	}
+
+	var saved int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved != writers*iterations {
+		t.Errorf("saved %d messages; want %d", saved, writers*iterations)
+	}
+}
+
+func TestPromoteFirstAdmin(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "forum.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	defer db.Close()
+	for _, nick := range []string{"Alice", "bob"} {
+		if err := InsertUserFull(db, "u-"+nick, nick, nick+"@x.com", "x", 20, "", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := PromoteFirstAdmin(db, "nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user: %v; want ErrUserNotFound", err)
+	}
+	userUUID, err := PromoteFirstAdmin(db, "alice")
+	if err != nil || userUUID != "u-Alice" {
+		t.Fatalf("first promotion: %q %v", userUUID, err)
+	}
+	if _, err := PromoteFirstAdmin(db, "bob@x.com"); !errors.Is(err, ErrAdminExists) {
+		t.Errorf("second promotion: %v; want ErrAdminExists", err)
+	}
+
+	session := Session{SessionUUID: "s", UserUUID: "u-Alice", CSRFToken: "t", ExpiresAt: time.Now().Add(time.Hour)}
+	store := NewSQLiteStores(db).Sessions
+	if err := store.CreateSession(session); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetSession("s")
+	if err != nil || got.Role != RoleAdmin {
+		t.Errorf("session role = %v, %v; want admin", got, err)
+	}
+}
+
+func TestAuditEventsAppendOnly(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "forum.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	defer db.Close()
+	if err := InsertAuditEvent(db, AuditEvent{Action: AuditLoginFailed, Detail: "alice", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`UPDATE audit_events SET detail = 'bob'`); err == nil {
+		t.Error("UPDATE on audit_events succeeded")
+	}
+	if _, err := db.Exec(`DELETE FROM audit_events`); err == nil {
+		t.Error("DELETE on audit_events succeeded")
+	}
+
+	events, err := ListAuditEvents(db, AuditFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Detail != "alice" || events[0].ActorUUID != "" {
+		t.Errorf("events after tampering = %+v", events)
+	}
+}
+
+// oldDatabase creates a database with the first released schema holding
+// users, given as uuid, nickname and email triples, and returns its path
+func oldDatabase(t *testing.T, users [][3]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "forum.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	schema, err := os.ReadFile("testdata/schema_v1.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range users {
+		_, err := db.Exec(`INSERT INTO users (uuid, nickname, email, age, password_hash) VALUES (?, ?, ?, 20, 'x')`, u[0], u[1], u[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestMigrateNormalizesIdentities(t *testing.T) {
+	path := oldDatabase(t, [][3]string{
+		{"u-bob", "Bob", " Bob@X.com "},
+		{"u-alice", "alice", "alice@x.com"},
+	})
+
+	db, err := InitDB(path)
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	defer db.Close()
+
+	var email, normalized string
+	if err := db.QueryRow(`SELECT email, nickname_normalized FROM users WHERE uuid = 'u-bob'`).Scan(&email, &normalized); err != nil {
+		t.Fatal(err)
+	}
+	if email != "bob@x.com" || normalized != "bob" {
+		t.Errorf("got email %q, nickname_normalized %q; want bob@x.com, bob", email, normalized)
+	}
+	for _, identifier := range []string{"BOB", "bob@x.com"} {
+		if userUUID, _, err := GetUserByEmailOrNickname(db, identifier); err != nil || userUUID != "u-bob" {
+			t.Errorf("lookup %q = %q, %v; want u-bob", identifier, userUUID, err)
+		}
+	}
+}
+
+func TestMigrateRejectsIdentityCollisions(t *testing.T) {
+	tests := []struct {
+		name  string
+		users [][3]string
+		want  []string
+	}{
+		{
+			name:  "email and nickname",
+			users: [][3]string{{"u-old", "Bob", "Bob@x.com"}, {"u-new", "bob", "bob@x.com"}},
+			want:  []string{`email "bob@x.com": u-old, u-new`, `nickname "bob": u-old, u-new`},
+		},
+		{
+			name:  "email only",
+			users: [][3]string{{"u-old", "Bob", "Bob@x.com"}, {"u-new", "robert", "bob@x.com"}},
+			want:  []string{`email "bob@x.com": u-old, u-new`},
+		},
+		{
+			name:  "nickname only",
+			users: [][3]string{{"u-old", "Bob", "one@x.com"}, {"u-new", " bob", "two@x.com"}},
+			want:  []string{`nickname "bob": u-old, u-new`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := oldDatabase(t, tt.users)
+
+			db, err := InitDB(path)
+			if err == nil {
+				db.Close()
+				t.Fatal("InitDB succeeded; want a collision error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+
+			// Nothing was rewritten, so the operator can fix the rows and retry
+			raw, err := sql.Open("sqlite3", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raw.Close()
+			var email string
+			if err := raw.QueryRow(`SELECT email FROM users WHERE uuid = 'u-old'`).Scan(&email); err != nil {
+				t.Fatal(err)
+			}
+			if email != tt.users[0][2] {
+				t.Errorf("email rewritten to %q", email)
+			}
+		})
+	}
+}
+
+func TestCreateCommentRollsBackWithNotification(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "forum.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	defer db.Close()
+	stores := NewSQLiteStores(db)
+
+	for _, id := range []string{"u1", "u2"} {
+		if err := InsertUserFull(db, id, "user"+id, id+"@x.com", "x", 20, "", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := InsertPost(db, "p1", "u1", "title", "content", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	taken := Notification{UUID: "n1", UserUUID: "u1", Type: NotifyComment, ActorUUID: "u2", TargetType: "post", TargetUUID: "p1", PostUUID: "p1", CreatedAt: time.Now()}
+	if err := stores.Notifications.CreateNotification(taken); err != nil {
+		t.Fatal(err)
+	}
+
+	// The notification reuses a taken UUID, so its insert fails after the comment's
+	comment := Comment{UUID: "c1", PostUUID: "p1", AuthorUUID: "u2", Content: "hi", CreatedAt: time.Now()}
+	if err := stores.Comments.CreateComment(comment, &taken); err == nil {
+		t.Fatal("CreateComment succeeded; want the notification insert to fail")
+	}
+
+	var comments, count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM comments`).Scan(&comments); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT comment_count FROM posts WHERE uuid = 'p1'`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if comments != 0 || count != 0 {
+		t.Errorf("after rollback: %d comments, comment_count %d; want 0, 0", comments, count)
+	}
+}
+
+func TestFailedInsertLeavesAttachmentsUnclaimed(t *testing.T) {
+	db, err := InitDB(filepath.Join(t.TempDir(), "forum.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	defer db.Close()
+	stores := NewSQLiteStores(db)
+
+	for _, id := range []string{"u1", "u2"} {
+		if err := InsertUserFull(db, id, "user"+id, id+"@x.com", "x", 20, "", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	post := Post{UUID: "p1", AuthorUUID: "u1", Title: "t", Content: "c", CreatedAt: time.Now()}
+	if err := stores.Posts.CreatePost(post, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Messages.SaveMessage("m1", Message{From: "u1", To: "u2", Content: "hi"}, time.Now(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Attachments.CreateAttachment(Attachment{UUID: "a1", UploaderUUID: "u1", Filename: "f", ContentType: "text/plain", Size: 1, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both reuse a taken UUID, so the insert fails whatever the claim does
+	if err := stores.Posts.CreatePost(post, []string{"a1"}); err == nil {
+		t.Error("CreatePost with a duplicate UUID succeeded")
+	}
+	if err := stores.Messages.SaveMessage("m1", Message{From: "u1", To: "u2", Content: "hi"}, time.Now(), []string{"a1"}); err == nil {
+		t.Error("SaveMessage with a duplicate UUID succeeded")
+	}
+
+	a, err := stores.Attachments.GetAttachment("a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.OwnerType != "" {
+		t.Errorf("attachment claimed by %s %s after the insert failed", a.OwnerType, a.OwnerUUID)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+// A client may follow at most this many scopes at once
+const maxSubscriptions = 50
+
+// Subscription scopes live events to one category or one post. With both
+// fields empty it follows new posts across the whole feed, like /feed
+// without ?category=.
+type Subscription struct {
+	Category string `json:"category,omitempty"`
+	PostUUID string `json:"post_uuid,omitempty"`
+}
+
+// inboundFrame is what clients send over /ws. Frames without a type are
+// chat messages; "subscribe" and "unsubscribe" carry a Subscription.
+type inboundFrame struct {
+	Type string `json:"type"`
+	Subscription
+}
+
+type errorFrame struct {
+	Type  string   `json:"type"`
+	Error APIError `json:"error"`
+}
+
+type postCreatedFrame struct {
+	Type string `json:"type"`
+	Post Post   `json:"post"`
+}
+
+type commentCreatedFrame struct {
+	Type    string  `json:"type"`
+	Comment Comment `json:"comment"`
+}
+
+// reactionFrame carries a target's new totals; unlike the REST response it
+// says nothing about the viewer's own reaction
+type reactionFrame struct {
+	Type       string         `json:"type"`
+	TargetType ReactionTarget `json:"target_type"`
+	TargetUUID string         `json:"target_uuid"`
+	PostUUID   string         `json:"post_uuid"`
+	Likes      int            `json:"likes"`
+	Dislikes   int            `json:"dislikes"`
+}
+
+// handleFrame applies a typed frame from client, answering bad ones with an
+// error frame
+func (h *Hub) handleFrame(client *Client, frame inboundFrame) {
+	sub := Subscription{
+		Category: strings.TrimSpace(frame.Category),
+		PostUUID: strings.TrimSpace(frame.PostUUID),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch {
+	case frame.Type != "subscribe" && frame.Type != "unsubscribe":
+		h.sendErrorLocked(client, codeInvalidRequest, "Unknown frame type "+frame.Type)
+	case sub.Category != "" && sub.PostUUID != "":
+		h.sendErrorLocked(client, codeInvalidRequest, "Subscribe to a category or a post, not both")
+	case frame.Type == "unsubscribe":
+		delete(client.subscriptions, sub)
+	case len(client.subscriptions) >= maxSubscriptions && !client.subscriptions[sub]:
+		h.sendErrorLocked(client, codeInvalidRequest, "Too many subscriptions")
+	default:
+		if client.subscriptions == nil {
+			client.subscriptions = make(map[Subscription]bool)
+		}
+		client.subscriptions[sub] = true
+	}
+}
+
+func (h *Hub) sendError(client *Client, code, message string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sendErrorLocked(client, code, message)
+}
+
+func (h *Hub) sendErrorLocked(client *Client, code, message string) {
+	data, _ := json.Marshal(errorFrame{Type: "error", Error: APIError{Code: code, Message: message}})
+	h.sendLocked(client, data)
+}
+
+// publish sends v once to every client following any of scopes
+func (h *Hub) publish(v any, scopes ...Subscription) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding event: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, conns := range h.clients {
+		for client := range conns {
+			for _, scope := range scopes {
+				if client.subscriptions[scope] {
+					h.sendLocked(client, data)
+					break
+				}
+			}
+		}
+	}
+}
+
+// feedScopes are the subscriptions that see a post in their feed
+func feedScopes(post *Post) []Subscription {
+	scopes := []Subscription{{}}
+	for _, cat := range post.Categories {
+		scopes = append(scopes, Subscription{Category: cat})
+	}
+	return scopes
+}
+
+func (s *Server) publishPostCreated(post Post) {
+	s.hub.publish(postCreatedFrame{Type: "post_created", Post: post}, feedScopes(&post)...)
+}
+
+func (s *Server) publishCommentCreated(comment Comment) {
+	s.hub.publish(commentCreatedFrame{Type: "comment_created", Comment: comment},
+		Subscription{PostUUID: comment.PostUUID})
+}
+
+// publishReaction sends new totals to the post's followers and, for post
+// reactions, to feeds showing the post
+func (s *Server) publishReaction(targetType ReactionTarget, targetUUID string, counts ReactionCounts) {
+	frame := reactionFrame{
+		Type:       "reaction_updated",
+		TargetType: targetType,
+		TargetUUID: targetUUID,
+		Likes:      counts.Likes,
+		Dislikes:   counts.Dislikes,
+	}
+
+	var scopes []Subscription
+	switch targetType {
+	case ReactionOnPost:
+		post, err := s.posts.GetPost(targetUUID)
+		if err != nil {
+			log.Printf("Error loading reacted post: %v", err)
+			return
+		}
+		frame.PostUUID = post.UUID
+		scopes = append(feedScopes(post), Subscription{PostUUID: post.UUID})
+	case ReactionOnComment:
+		comment, err := s.comments.GetComment(targetUUID)
+		if err != nil {
+			log.Printf("Error loading reacted comment: %v", err)
+			return
+		}
+		frame.PostUUID = comment.PostUUID
+		scopes = []Subscription{{PostUUID: comment.PostUUID}}
+	}
+	s.hub.publish(frame, scopes...)
+}
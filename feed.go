@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type FeedSort string
+
+const (
+	SortNewest    FeedSort = "newest"
+	SortTop       FeedSort = "top"
+	SortHot       FeedSort = "hot"
+	SortCommented FeedSort = "commented"
+)
+
+var feedSorts = map[FeedSort]bool{SortNewest: true, SortTop: true, SortHot: true, SortCommented: true}
+
+// Windows ?window= accepts for the top sort; zero means all time
+var topWindows = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"year":  365 * 24 * time.Hour,
+	"all":   0,
+}
+
+const (
+	defaultTopWindow = "week"
+	feedPageSize     = 20
+	maxFeedPageSize  = 100
+)
+
+// hotScore ranks a post for the hot sort. Every tenfold increase in net
+// likes is worth as much as being 12.5 hours newer, so the score only
+// changes when the post is reacted to and can be stored and indexed.
+func hotScore(likes, dislikes int, createdAt time.Time) float64 {
+	net := float64(likes - dislikes)
+	order := math.Log10(math.Max(math.Abs(net), 1))
+	if net < 0 {
+		order = -order
+	}
+	return order + float64(createdAt.Unix())/45000
+}
+
+// feedKey is the value p is ranked by under sort, before the created_at and
+// uuid tie-breakers; the newest sort has none
+func feedKey(sort FeedSort, p Post) float64 {
+	switch sort {
+	case SortTop:
+		return float64(p.Likes - p.Dislikes)
+	case SortHot:
+		return p.HotScore
+	case SortCommented:
+		return float64(p.CommentCount)
+	}
+	return 0
+}
+
+// FeedCursor marks the last post of a page. Every sort orders by its key,
+// then created_at and uuid, all descending, so the next page is the posts
+// ranked strictly below the cursor.
+type FeedCursor struct {
+	Sort      FeedSort  `json:"s"`
+	Key       float64   `json:"k"`
+	CreatedAt time.Time `json:"t"`
+	UUID      string    `json:"u"`
+	// Since carries the top window's start so later pages don't shift
+	Since time.Time `json:"w"`
+}
+
+func feedCursorAt(f FeedFilter, p Post) FeedCursor {
+	return FeedCursor{Sort: f.Sort, Key: feedKey(f.Sort, p), CreatedAt: p.CreatedAt, UUID: p.UUID, Since: f.Since}
+}
+
+// precedes reports whether p is ranked after the cursor
+func (c FeedCursor) precedes(p Post) bool {
+	if key := feedKey(c.Sort, p); key != c.Key {
+		return key < c.Key
+	}
+	if !p.CreatedAt.Equal(c.CreatedAt) {
+		return p.CreatedAt.Before(c.CreatedAt)
+	}
+	return p.UUID < c.UUID
+}
+
+func (c FeedCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeFeedCursor(s string) (FeedCursor, bool) {
+	var c FeedCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &c) != nil || !feedSorts[c.Sort] || c.UUID == "" {
+		return FeedCursor{}, false
+	}
+	return c, true
+}
+
+// parseFeedFilter reads ?category=, ?author=, ?sort=, ?window= (top only),
+// ?limit= and ?cursor= from the query string, along with ?mine=, ?liked=
+// and ?followed=, which narrow the feed to the viewer's own activity.
+// personal reports whether any of those three was switched on.
+func parseFeedFilter(r *http.Request, viewerUUID string, now time.Time) (filter FeedFilter, personal bool, errs ValidationErrors) {
+	query := r.URL.Query()
+	filter = FeedFilter{
+		Category: query.Get("category"),
+		Author:   NormalizeNickname(query.Get("author")),
+		Sort:     SortNewest,
+		Limit:    feedPageSize,
+	}
+
+	errs = ValidationErrors{}
+	for _, param := range []struct {
+		name string
+		dst  *string
+	}{{"mine", &filter.AuthorUUID}, {"liked", &filter.LikedBy}, {"followed", &filter.FollowedBy}} {
+		v := query.Get(param.name)
+		if v == "" {
+			continue
+		}
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			errs.add(param.name, param.name+" must be true or false")
+			continue
+		}
+		if on {
+			*param.dst = viewerUUID
+			personal = true
+		}
+	}
+	if v := query.Get("sort"); v != "" {
+		filter.Sort = FeedSort(v)
+		if !feedSorts[filter.Sort] {
+			errs.add("sort", "sort must be one of newest, top, hot or commented")
+		}
+	}
+	if v := query.Get("window"); v != "" || filter.Sort == SortTop {
+		if v == "" {
+			v = defaultTopWindow
+		}
+		window, ok := topWindows[v]
+		switch {
+		case !ok:
+			errs.add("window", "window must be one of day, week, month, year or all")
+		case filter.Sort != SortTop:
+			errs.add("window", "window only applies to the top sort")
+		case window > 0:
+			filter.Since = now.Add(-window)
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxFeedPageSize {
+			errs.add("limit", "limit must be between 1 and "+strconv.Itoa(maxFeedPageSize))
+		}
+		filter.Limit = n
+	}
+	if v := query.Get("cursor"); v != "" {
+		cursor, ok := decodeFeedCursor(v)
+		switch {
+		case !ok:
+			errs.add("cursor", "cursor is not valid")
+		case cursor.Sort != filter.Sort:
+			errs.add("cursor", "cursor belongs to the "+string(cursor.Sort)+" sort")
+		default:
+			filter.After = &cursor
+			filter.Since = cursor.Since
+		}
+	}
+	return filter, personal, errs
+}
+
+type FeedPage struct {
+	Posts []Post `json:"posts"`
+	// Pass as ?cursor= with the same sort for the next page; empty at the end
+	NextCursor string `json:"next_cursor,omitempty"`
+}
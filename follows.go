@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// FollowedCategoriesHandler lists the categories the current user follows
+func (s *Server) FollowedCategoriesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		categories, err := s.follows.FollowedCategories(userUUID)
+		if err != nil {
+			writeServerError(w, "Failed to fetch followed categories", err)
+			return
+		}
+		writeData(w, http.StatusOK, categories)
+	}
+}
+
+// FollowCategoryHandler follows or unfollows the category in the path and
+// responds with every category the user now follows. Both are idempotent,
+// and any name may be followed before a post uses it.
+func (s *Server) FollowCategoryHandler(follow bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		// Trimmed the same way as the categories posts are filed under
+		category := strings.TrimSpace(mux.Vars(r)["name"])
+		if category == "" {
+			writeValidationErrors(w, ValidationErrors{"name": "category is required"})
+			return
+		}
+
+		var err error
+		if follow {
+			err = s.follows.FollowCategory(userUUID, category, time.Now())
+		} else {
+			err = s.follows.UnfollowCategory(userUUID, category)
+		}
+		if err != nil {
+			writeServerError(w, "Failed to update followed categories", err)
+			return
+		}
+
+		categories, err := s.follows.FollowedCategories(userUUID)
+		if err != nil {
+			writeServerError(w, "Failed to fetch followed categories", err)
+			return
+		}
+		writeData(w, http.StatusOK, categories)
+	}
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
@@ -23,53 +26,64 @@ type RegisterRequest struct {
 	Password  string `json:"password"`
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		origin := r.Header.Get("Origin")
-		return origin == "http://localhost:8080"
-	},
+// RegisterResponse describes the account that was just created
+type RegisterResponse struct {
+	UUID     string `json:"uuid"`
+	Nickname string `json:"nickname"`
+	Email    string `json:"email"`
 }
 
-func RegisterHandler(db *sql.DB) http.HandlerFunc {
+// newUpgrader builds the WebSocket upgrader for the configured origins
+func newUpgrader(cfg *Config) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     cfg.OriginAllowed,
+	}
+}
+
+// sameOrigin accepts WebSocket handshakes from pages served by this host
+func sameOrigin(r *http.Request) bool {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || origin.Host == "" {
+		return false
+	}
+	return strings.EqualFold(origin.Host, r.Host)
+}
+
+func (s *Server) RegisterHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req RegisterRequest
 
 		// Decode JSON body
 		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
 			return
 		}
 
-		// Basic validation
-		req.Nickname = strings.TrimSpace(req.Nickname)
-		req.Email = strings.TrimSpace(req.Email)
-		req.Password = strings.TrimSpace(req.Password)
-
-		if req.Nickname == "" || req.Email == "" || req.Password == "" || req.Age <= 0 {
-			http.Error(w, "Missing required fields", http.StatusBadRequest)
+		// Trim and validate every field; the password is checked but never altered
+		req.Normalize()
+		if errs := req.Validate(); len(errs) > 0 {
+			writeValidationErrors(w, errs)
 			return
 		}
 
 		// Check if user already exists
-		exists, err := UserExists(db, req.Email, req.Nickname)
+		exists, err := s.users.UserExists(req.Email, req.Nickname)
 		if err != nil {
-			log.Printf("DB error checking user existence: %v", err)
-			http.Error(w, "Server error", http.StatusInternalServerError)
+			writeServerError(w, "DB error checking user existence", err)
 			return
 		}
 		if exists {
-			http.Error(w, "Email or Nickname already taken", http.StatusConflict)
+			writeError(w, http.StatusConflict, codeConflict, "Email or Nickname already taken")
 			return
 		}
 
 		// Hash password
 		hashedPass, err := HashPassword(req.Password)
 		if err != nil {
-			log.Printf("Error hashing password: %v", err)
-			http.Error(w, "Server error", http.StatusInternalServerError)
+			writeServerError(w, "Error hashing password", err)
 			return
 		}
 
@@ -77,15 +91,30 @@ func RegisterHandler(db *sql.DB) http.HandlerFunc {
 		userUUID := uuid.New().String()
 
 		// Insert user in DB
-		err = InsertUserFull(db, userUUID, req.Nickname, req.Email, hashedPass, req.Age, req.Gender, req.FirstName, req.LastName)
+		err = s.users.CreateUser(User{
+			UUID:      userUUID,
+			Nickname:  req.Nickname,
+			Email:     req.Email,
+			Age:       req.Age,
+			Gender:    req.Gender,
+			FirstName: req.FirstName,
+			LastName:  req.LastName,
+		}, hashedPass)
+		if errors.Is(err, ErrUserExists) {
+			writeError(w, http.StatusConflict, codeConflict, "Email or Nickname already taken")
+			return
+		}
 		if err != nil {
-			log.Printf("Error inserting user: %v", err)
-			http.Error(w, "Server error", http.StatusInternalServerError)
+			writeServerError(w, "Error inserting user", err)
 			return
 		}
+		s.audit(r, userUUID, AuditRegister, "user", userUUID, req.Nickname)
 
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte("User registered successfully"))
+		writeData(w, http.StatusCreated, RegisterResponse{
+			UUID:     userUUID,
+			Nickname: req.Nickname,
+			Email:    req.Email,
+		})
 	}
 }
 
@@ -94,85 +123,133 @@ type LoginRequest struct {
 	Password   string `json:"password"`
 }
 
-func LoginHandler(db *sql.DB) http.HandlerFunc {
+// LoginResponse tells the client who it is and which CSRF token to send
+type LoginResponse struct {
+	UserUUID  string    `json:"user_uuid"`
+	CSRFToken string    `json:"csrf_token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (s *Server) LoginHandler() http.HandlerFunc {
+	cookies := s.cfg.CookieOptions()
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req LoginRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
 			return
 		}
 
-		// Basic input validation
+		// Basic input validation; passwords are compared exactly as sent
+		req.Identifier = strings.TrimSpace(req.Identifier)
 		if req.Identifier == "" || req.Password == "" {
-			http.Error(w, "Missing credentials", http.StatusBadRequest)
+			writeValidationErrors(w, missingCredentials(req))
 			return
 		}
 
 		// Get user by email or nickname
-		userUUID, hashedPassword, err := GetUserByEmailOrNickname(db, req.Identifier)
+		userUUID, hashedPassword, err := s.users.GetUserAuth(req.Identifier)
+		if errors.Is(err, ErrUserNotFound) {
+			s.audit(r, "", AuditLoginFailed, "", "", req.Identifier)
+			writeError(w, http.StatusUnauthorized, codeInvalidCreds, "Invalid email/nickname or password")
+			return
+		}
+
 		if err != nil {
-			http.Error(w, "Invalid email/nickname or password", http.StatusUnauthorized)
+			writeServerError(w, "Error looking up user", err)
 			return
 		}
 
 		// Compare password
 		if !CheckPasswordHash(hashedPassword, req.Password) {
-			http.Error(w, "Invalid email/nickname or password", http.StatusUnauthorized)
+			s.audit(r, "", AuditLoginFailed, "user", userUUID, req.Identifier)
+			writeError(w, http.StatusUnauthorized, codeInvalidCreds, "Invalid email/nickname or password")
 			return
 		}
 
-		// Create session UUID and expiry
+		// Suspended users learn why only after proving who they are
+		susp, err := s.users.GetSuspension(userUUID)
+		if err != nil {
+			writeServerError(w, "Error checking suspension", err)
+			return
+		}
+		if susp != nil {
+			s.audit(r, userUUID, AuditLoginBlocked, "user", userUUID, susp.Message())
+			writeSuspended(w, susp)
+			return
+		}
+
+		// Create session UUID, CSRF token and expiry
 		sessionUUID := uuid.New().String()
-		expiresAt := time.Now().Add(24 * time.Hour)
+		csrfToken, err := GenerateToken()
+		if err != nil {
+			writeServerError(w, "Error generating CSRF token", err)
+			return
+		}
+		expiresAt := time.Now().Add(s.cfg.SessionTTL.Duration())
 
 		// Save session in DB
-		err = CreateSession(db, sessionUUID, userUUID, expiresAt)
+		err = s.sessions.CreateSession(Session{
+			SessionUUID: sessionUUID,
+			UserUUID:    userUUID,
+			CSRFToken:   csrfToken,
+			ExpiresAt:   expiresAt,
+		})
 		if err != nil {
-			http.Error(w, "Server error", http.StatusInternalServerError)
+			writeServerError(w, "Error creating session", err)
 			return
 		}
 
-		// Set cookie with session UUID
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_token",
-			Value:    sessionUUID,
-			Expires:  expiresAt,
-			HttpOnly: true,
-			Path:     "/",
+		s.audit(r, userUUID, AuditLogin, "user", userUUID, "")
+
+		// Set session and CSRF cookies
+		cookies.SetSessionCookies(w, sessionUUID, csrfToken, expiresAt)
+		w.Header().Set(csrfHeaderName, csrfToken)
+
+		writeData(w, http.StatusOK, LoginResponse{
+			UserUUID:  userUUID,
+			CSRFToken: csrfToken,
+			ExpiresAt: expiresAt,
 		})
+	}
+}
 
-		w.Write([]byte("Login successful"))
+func missingCredentials(req LoginRequest) ValidationErrors {
+	errs := ValidationErrors{}
+	if req.Identifier == "" {
+		errs.add("identifier", "email or nickname is required")
+	}
+	if req.Password == "" {
+		errs.add("password", "password is required")
 	}
+	return errs
 }
 
-func LogoutHandler(db *sql.DB) http.HandlerFunc {
+func (s *Server) LogoutHandler() http.HandlerFunc {
+	cookies := s.cfg.CookieOptions()
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session_token")
+		cookie, err := r.Cookie(sessionCookieName)
 		if err != nil {
-			http.Error(w, "No session found", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "No session found")
 			return
 		}
 
 		sessionToken := cookie.Value
 
 		// Delete session from DB
-		err = DeleteSession(db, sessionToken)
+		err = s.sessions.DeleteSession(sessionToken)
 		if err != nil {
-			http.Error(w, "Error logging out", http.StatusInternalServerError)
+			writeServerError(w, "Error logging out", err)
 			return
 		}
+		userUUID, _ := UserUUIDFromContext(r.Context())
+		s.audit(r, userUUID, AuditLogout, "user", userUUID, "")
 
-		// Expire the session cookie
-		expiredCookie := &http.Cookie{
-			Name:     "session_token",
-			Value:    "",
-			Path:     "/",
-			MaxAge:   -1,
-			HttpOnly: true,
-		}
-		http.SetCookie(w, expiredCookie)
+		// Expire the session and CSRF cookies
+		cookies.ClearSessionCookies(w)
 
-		w.Write([]byte("Logged out successfully"))
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
@@ -180,47 +257,276 @@ type CreatePostRequest struct {
 	Title      string   `json:"title"`
 	Content    string   `json:"content"`
 	Categories []string `json:"categories"`
+	// Files uploaded through POST /attachments and not used elsewhere yet
+	AttachmentUUIDs []string `json:"attachment_uuids"`
 }
 
-func CreatePostHandler(db *sql.DB) http.HandlerFunc {
+func (s *Server) CreatePostHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userUUID, ok := UserUUIDFromContext(r.Context())
 		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
 			return
 		}
 
 		var req CreatePostRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
 			return
 		}
 
 		req.Title = strings.TrimSpace(req.Title)
 		req.Content = strings.TrimSpace(req.Content)
 
-		if req.Title == "" || req.Content == "" {
-			http.Error(w, "Title and content are required", http.StatusBadRequest)
+		errs := ValidationErrors{}
+		if req.Title == "" {
+			errs.add("title", "title is required")
+		}
+		if req.Content == "" {
+			errs.add("content", "content is required")
+		} else if tooLong(req.Content, maxPostLength) {
+			errs.add("content", fmt.Sprintf("content must be at most %d characters", maxPostLength))
+		}
+		attachmentUUIDs, problem := checkAttachmentUUIDs(req.AttachmentUUIDs)
+		if problem != "" {
+			errs.add("attachment_uuids", problem)
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
 			return
 		}
 
-		postUUID := uuid.New().String()
-		now := time.Now()
+		post := Post{
+			UUID:       uuid.New().String(),
+			Title:      req.Title,
+			Content:    req.Content,
+			AuthorUUID: userUUID,
+			CreatedAt:  time.Now(),
+			Categories: normalizeCategories(req.Categories),
+		}
+
+		err := s.posts.CreatePost(post, attachmentUUIDs)
+		if errors.Is(err, ErrAttachmentNotFound) {
+			writeValidationErrors(w, ValidationErrors{"attachment_uuids": "unknown or already used attachment"})
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to insert post", err)
+			return
+		}
+
+		posts := []Post{post}
+		if err := s.loadPostAttachments(posts); err != nil {
+			log.Printf("Error loading post attachments: %v", err)
+		}
+		post = posts[0]
+		post.Author = s.lookupAuthor(userUUID)
+		post.ContentHTML = renderMarkdown(post.Content)
+		s.mentionPost(&post)
+		s.publishPostCreated(post)
+		writeData(w, http.StatusCreated, post)
+	}
+}
+
+// normalizeCategories trims names and drops blanks and duplicates
+func normalizeCategories(categories []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, cat := range categories {
+		cat = strings.TrimSpace(cat)
+		if cat == "" || seen[cat] {
+			continue
+		}
+		seen[cat] = true
+		out = append(out, cat)
+	}
+	return out
+}
+
+// PostDetail is a single post with its comments
+type PostDetail struct {
+	Post
+	Comments []Comment `json:"comments"`
+}
+
+func (s *Server) GetPostHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post, err := s.posts.GetPost(mux.Vars(r)["uuid"])
+		if errors.Is(err, ErrPostNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Post not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to fetch post", err)
+			return
+		}
+
+		// Comments stay readable even when the post itself was deleted
+		comments, err := s.comments.GetComments(post.UUID)
+		if err != nil {
+			writeServerError(w, "Failed to fetch comments", err)
+			return
+		}
+		posts := []Post{*post}
+		if err := s.attachPostMentions(posts); err != nil {
+			writeServerError(w, "Failed to resolve mentions", err)
+			return
+		}
+		if err := s.attachCommentMentions(comments); err != nil {
+			writeServerError(w, "Failed to resolve mentions", err)
+			return
+		}
+		if err := s.loadPostAttachments(posts); err != nil {
+			writeServerError(w, "Failed to fetch attachments", err)
+			return
+		}
+		renderPosts(posts)
+		renderComments(comments)
+
+		writeData(w, http.StatusOK, PostDetail{Post: posts[0], Comments: comments})
+	}
+}
+
+// UpdatePostRequest changes only the fields that are present
+type UpdatePostRequest struct {
+	Title      *string   `json:"title"`
+	Content    *string   `json:"content"`
+	Categories *[]string `json:"categories"`
+}
+
+// isModerator reports whether the authenticated user has moderator powers
+func isModerator(r *http.Request) bool {
+	role, _ := RoleFromContext(r.Context())
+	return role.AtLeast(RoleModerator)
+}
 
-		err := InsertPost(db, postUUID, userUUID, req.Title, req.Content, now)
+// editablePost loads the post named in the URL and checks that the current
+// user may change it, writing the error response when not. Moderators pass
+// the check too when staff is set.
+func (s *Server) editablePost(w http.ResponseWriter, r *http.Request, staff bool) (*Post, string, bool) {
+	userUUID, ok := UserUUIDFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return nil, "", false
+	}
+
+	post, err := s.posts.GetPost(mux.Vars(r)["uuid"])
+	if errors.Is(err, ErrPostNotFound) || (err == nil && post.Deleted) {
+		writeError(w, http.StatusNotFound, codeNotFound, "Post not found")
+		return nil, "", false
+	}
+	if err != nil {
+		writeServerError(w, "Failed to fetch post", err)
+		return nil, "", false
+	}
+
+	if post.AuthorUUID != userUUID && !(staff && isModerator(r)) {
+		writeError(w, http.StatusForbidden, codeForbidden, "Only the author can change this post")
+		return nil, "", false
+	}
+	return post, userUUID, true
+}
+
+func (s *Server) UpdatePostHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post, userUUID, ok := s.editablePost(w, r, true)
+		if !ok {
+			return
+		}
+
+		var req UpdatePostRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+			return
+		}
+
+		errs := ValidationErrors{}
+		if req.Title != nil {
+			if post.Title = strings.TrimSpace(*req.Title); post.Title == "" {
+				errs.add("title", "title must not be empty")
+			}
+		}
+		if req.Content != nil {
+			if post.Content = strings.TrimSpace(*req.Content); post.Content == "" {
+				errs.add("content", "content must not be empty")
+			} else if tooLong(post.Content, maxPostLength) {
+				errs.add("content", fmt.Sprintf("content must be at most %d characters", maxPostLength))
+			}
+		}
+		if req.Categories != nil {
+			post.Categories = normalizeCategories(*req.Categories)
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		editedAt := time.Now()
+		err := s.posts.UpdatePost(*post, userUUID, editedAt)
+		if errors.Is(err, ErrPostNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Post not found")
+			return
+		}
 		if err != nil {
-			http.Error(w, "Failed to insert post", http.StatusInternalServerError)
+			writeServerError(w, "Failed to update post", err)
 			return
 		}
 
-		err = InsertPostCategories(db, postUUID, req.Categories)
+		if post.AuthorUUID != userUUID {
+			s.audit(r, userUUID, AuditPostEdit, "post", post.UUID, "")
+		}
+
+		post.EditedAt = &editedAt
+		posts := []Post{*post}
+		if err := s.loadPostAttachments(posts); err != nil {
+			log.Printf("Error loading post attachments: %v", err)
+		}
+		*post = posts[0]
+		post.ContentHTML = renderMarkdown(post.Content)
+		s.mentionPost(post)
+		writeData(w, http.StatusOK, post)
+	}
+}
+
+func (s *Server) DeletePostHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post, userUUID, ok := s.editablePost(w, r, true)
+		if !ok {
+			return
+		}
+
+		err := s.posts.DeletePost(post.UUID, time.Now())
+		if errors.Is(err, ErrPostNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Post not found")
+			return
+		}
 		if err != nil {
-			http.Error(w, "Failed to insert categories", http.StatusInternalServerError)
+			writeServerError(w, "Failed to delete post", err)
 			return
 		}
+		if post.AuthorUUID != userUUID {
+			s.audit(r, userUUID, AuditPostDelete, "post", post.UUID, "")
+		}
 
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte("Post created successfully"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GetPostRevisionsHandler shows a post's edit history to whoever may edit it
+func (s *Server) GetPostRevisionsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post, _, ok := s.editablePost(w, r, true)
+		if !ok {
+			return
+		}
+
+		revisions, err := s.posts.GetPostRevisions(post.UUID)
+		if err != nil {
+			writeServerError(w, "Failed to fetch revisions", err)
+			return
+		}
+
+		writeData(w, http.StatusOK, revisions)
 	}
 }
 
@@ -229,47 +535,198 @@ type CreateCommentRequest struct {
 	Content  string `json:"content"`
 }
 
-func CreateCommentHandler(db *sql.DB) http.HandlerFunc {
+func (s *Server) CreateCommentHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userUUID, ok := UserUUIDFromContext(r.Context())
 		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
 			return
 		}
 
 		var req CreateCommentRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
 			return
 		}
 
 		req.Content = strings.TrimSpace(req.Content)
 		req.PostUUID = strings.TrimSpace(req.PostUUID)
 
-		if req.Content == "" || req.PostUUID == "" {
-			http.Error(w, "Missing content or post ID", http.StatusBadRequest)
+		errs := ValidationErrors{}
+		if req.PostUUID == "" {
+			errs.add("post_uuid", "post_uuid is required")
+		}
+		if req.Content == "" {
+			errs.add("content", "content is required")
+		} else if tooLong(req.Content, maxCommentLength) {
+			errs.add("content", fmt.Sprintf("content must be at most %d characters", maxCommentLength))
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		post, err := s.posts.GetPost(req.PostUUID)
+		if errors.Is(err, ErrPostNotFound) || (err == nil && post.Deleted) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Post not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to fetch post", err)
 			return
 		}
 
-		commentUUID := uuid.New().String()
-		createdAt := time.Now()
+		comment := Comment{
+			UUID:       uuid.New().String(),
+			PostUUID:   req.PostUUID,
+			AuthorUUID: userUUID,
+			Content:    req.Content,
+			CreatedAt:  time.Now(),
+		}
+		notification, err := s.commentNotification(post, comment)
+		if err != nil {
+			writeServerError(w, "Failed to load notification preferences", err)
+			return
+		}
 
-		err := InsertComment(db, commentUUID, req.PostUUID, userUUID, req.Content, createdAt)
+		err = s.comments.CreateComment(comment, notification)
+		if errors.Is(err, ErrPostNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Post not found")
+			return
+		}
 		if err != nil {
-			http.Error(w, "Failed to insert comment", http.StatusInternalServerError)
+			writeServerError(w, "Failed to insert comment", err)
 			return
 		}
+		if notification != nil {
+			s.pushNotification(*notification)
+		}
+
+		comment.Author = s.lookupAuthor(userUUID)
+		comment.ContentHTML = renderMarkdown(comment.Content)
+		s.mentionComment(&comment)
+		s.publishCommentCreated(comment)
+		writeData(w, http.StatusCreated, comment)
+	}
+}
+
+type UpdateCommentRequest struct {
+	Content string `json:"content"`
+}
 
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte("Comment added successfully"))
+// editableComment loads the comment named in the URL and checks that the
+// current user wrote it, or is a moderator when staff is set
+func (s *Server) editableComment(w http.ResponseWriter, r *http.Request, staff bool) (*Comment, bool) {
+	userUUID, ok := UserUUIDFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return nil, false
 	}
+
+	comment, err := s.comments.GetComment(mux.Vars(r)["uuid"])
+	if errors.Is(err, ErrCommentNotFound) || (err == nil && comment.Deleted) {
+		writeError(w, http.StatusNotFound, codeNotFound, "Comment not found")
+		return nil, false
+	}
+	if err != nil {
+		writeServerError(w, "Failed to fetch comment", err)
+		return nil, false
+	}
+
+	if comment.AuthorUUID != userUUID && !(staff && isModerator(r)) {
+		writeError(w, http.StatusForbidden, codeForbidden, "Only the author can change this comment")
+		return nil, false
+	}
+	return comment, true
 }
 
-func WebSocketHandler(db *sql.DB) http.HandlerFunc {
+// UpdateCommentHandler lets authors fix a comment shortly after posting it
+func (s *Server) UpdateCommentHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		comment, ok := s.editableComment(w, r, false)
+		if !ok {
+			return
+		}
+
+		now := time.Now()
+		if now.Sub(comment.CreatedAt) > s.cfg.CommentEditWindow.Duration() {
+			writeError(w, http.StatusForbidden, codeEditWindow, "Comments can only be edited for "+s.cfg.CommentEditWindow.Duration().String()+" after posting")
+			return
+		}
+
+		var req UpdateCommentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+			return
+		}
+
+		req.Content = strings.TrimSpace(req.Content)
+		if req.Content == "" {
+			writeValidationErrors(w, ValidationErrors{"content": "content is required"})
+			return
+		}
+		if tooLong(req.Content, maxCommentLength) {
+			writeValidationErrors(w, ValidationErrors{"content": fmt.Sprintf("content must be at most %d characters", maxCommentLength)})
+			return
+		}
+
+		err := s.comments.UpdateComment(comment.UUID, req.Content, now)
+		if errors.Is(err, ErrCommentNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Comment not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to update comment", err)
+			return
+		}
+
+		comment.Content = req.Content
+		comment.EditedAt = &now
+		comment.ContentHTML = renderMarkdown(comment.Content)
+		s.mentionComment(comment)
+		writeData(w, http.StatusOK, comment)
+	}
+}
+
+// DeleteCommentHandler replaces a comment with a placeholder so replies
+// around it keep their place in the thread
+func (s *Server) DeleteCommentHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		comment, ok := s.editableComment(w, r, true)
+		if !ok {
+			return
+		}
+
+		err := s.comments.DeleteComment(comment.UUID, time.Now())
+		if errors.Is(err, ErrCommentNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Comment not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to delete comment", err)
+			return
+		}
+		if userUUID, _ := UserUUIDFromContext(r.Context()); comment.AuthorUUID != userUUID {
+			s.audit(r, userUUID, AuditCommentDelete, "comment", comment.UUID, "")
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) WebSocketHandler() http.HandlerFunc {
+	upgrader := newUpgrader(s.cfg)
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		userUUID, ok := UserUUIDFromContext(r.Context())
 		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		user, err := s.users.GetUser(userUUID)
+		if err != nil {
+			writeServerError(w, "Failed to fetch user", err)
 			return
 		}
 
@@ -280,58 +737,164 @@ func WebSocketHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		client := &Client{
-			Conn:     conn,
-			UserUUID: userUUID,
-			Send:     make(chan []byte),
+			Conn:      conn,
+			UserUUID:  userUUID,
+			AvatarURL: avatarURL(userUUID, user.AvatarUUID),
+			Send:      make(chan []byte, s.cfg.Chat.SendBuffer),
 		}
 
-		clients[userUUID] = client
-		onlineUsers[userUUID] = &UserPresence{
-			UserUUID:    userUUID,
-			IsOnline:    true,
-			LastMessage: "",
-		}
+		s.hub.Serve(client, s.cfg.Chat.MaxMessageBytes, s.saveMessage)
+	}
+}
+
+// saveMessage stores a chat message read by the hub, claiming the files it
+// references, then notifies the recipient and anyone mentioned
+func (s *Server) saveMessage(msg *Message, sentAt time.Time) error {
+	attachmentUUIDs, problem := checkAttachmentUUIDs(msg.AttachmentUUIDs)
+	if problem != "" {
+		return &FrameError{Code: codeValidation, Message: problem}
+	}
+	err := s.messages.SaveMessage(msg.UUID, *msg, sentAt, attachmentUUIDs)
+	if errors.Is(err, ErrAttachmentNotFound) {
+		return &FrameError{Code: codeValidation, Message: "Unknown or already used attachment"}
+	}
+	if err != nil {
+		return err
+	}
 
-		go writePump(client)
-		readPump(db, client)
+	messages := []Message{*msg}
+	if err := s.loadMessageAttachments(messages); err != nil {
+		log.Printf("Error loading message attachments: %v", err)
 	}
+	msg.Attachments = messages[0].Attachments
+
+	s.notifyMessage(*msg)
+	s.mentionMessage(msg)
+	return nil
 }
 
 // fetch chat history
-func GetMessagesHandler(db *sql.DB) http.HandlerFunc {
+func (s *Server) GetMessagesHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userUUID, ok := UserUUIDFromContext(r.Context())
 		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
 			return
 		}
 
 		otherUser := r.URL.Query().Get("with")
-		offsetStr := r.URL.Query().Get("offset")
-		offset, _ := strconv.Atoi(offsetStr)
+		if otherUser == "" {
+			writeValidationErrors(w, ValidationErrors{"with": "with is required"})
+			return
+		}
+		offset := 0
+		if v := r.URL.Query().Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeValidationErrors(w, ValidationErrors{"offset": "offset must be a non-negative integer"})
+				return
+			}
+			offset = n
+		}
+
+		messages, err := s.messages.LoadMessages(userUUID, otherUser, s.cfg.Chat.HistoryPageSize, offset)
+		if err != nil {
+			writeServerError(w, "Failed to fetch messages", err)
+			return
+		}
+		if err := s.attachMessageMentions(messages); err != nil {
+			writeServerError(w, "Failed to resolve mentions", err)
+			return
+		}
+		if err := s.loadMessageAttachments(messages); err != nil {
+			writeServerError(w, "Failed to fetch attachments", err)
+			return
+		}
+
+		writeData(w, http.StatusOK, messages)
+	}
+}
+
+// PostFeedHandler returns one page of the feed; parseFeedFilter lists the
+// query parameters. Anyone may read it, but the filters on the viewer's
+// own activity need a session.
+func (s *Server) PostFeedHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		viewerUUID, signedIn := UserUUIDFromContext(r.Context())
+		filter, personal, errs := parseFeedFilter(r, viewerUUID, time.Now())
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		if personal && !signedIn {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Sign in to filter the feed by your own activity")
+			return
+		}
 
-		messages, err := LoadMessages(db, userUUID, otherUser, 10, offset)
+		posts, err := s.posts.GetPosts(filter)
 		if err != nil {
-			http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
+			writeServerError(w, "Failed to fetch posts", err)
+			return
+		}
+		if err := s.attachPostMentions(posts); err != nil {
+			writeServerError(w, "Failed to resolve mentions", err)
+			return
+		}
+		if err := s.loadPostAttachments(posts); err != nil {
+			writeServerError(w, "Failed to fetch attachments", err)
 			return
 		}
+		renderPosts(posts)
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(messages)
+		page := FeedPage{Posts: posts}
+		if len(posts) == filter.Limit {
+			page.NextCursor = feedCursorAt(filter, posts[len(posts)-1]).encode()
+		}
+		writeData(w, http.StatusOK, page)
 	}
 }
 
-func PostFeedHandler(db *sql.DB) http.HandlerFunc {
+type SetRoleRequest struct {
+	Role Role `json:"role"`
+}
+
+type UserRole struct {
+	UserUUID string `json:"user_uuid"`
+	Role     Role   `json:"role"`
+}
+
+// SetUserRoleHandler lets admins grant or revoke staff roles
+func (s *Server) SetUserRoleHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		category := r.URL.Query().Get("category") // optional ?category=general
+		userUUID, _ := UserUUIDFromContext(r.Context())
+		targetUUID := mux.Vars(r)["uuid"]
 
-		posts, err := GetPosts(db, category)
+		var req SetRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+			return
+		}
+		if !req.Role.Valid() {
+			writeValidationErrors(w, ValidationErrors{"role": "role must be user, moderator or admin"})
+			return
+		}
+		// Keeps at least one admin around: nobody can demote themselves
+		if targetUUID == userUUID {
+			writeError(w, http.StatusForbidden, codeForbidden, "You cannot change your own role")
+			return
+		}
+
+		err := s.users.SetUserRole(targetUUID, req.Role)
+		if errors.Is(err, ErrUserNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+			return
+		}
 		if err != nil {
-			http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
+			writeServerError(w, "Failed to set role", err)
 			return
 		}
+		s.audit(r, userUUID, AuditRoleChange, "user", targetUUID, string(req.Role))
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(posts)
+		writeData(w, http.StatusOK, UserRole{UserUUID: targetUUID, Role: req.Role})
 	}
 }
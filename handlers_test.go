@@ -0,0 +1,1807 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// storeBackends builds a fresh set of stores per test. Every handler test
+// runs against both so the in-memory fakes cannot drift from SQLite.
+var storeBackends = map[string]func(t *testing.T) Stores{
+	"memory": func(t *testing.T) Stores { return NewMemoryStores() },
+	"sqlite": func(t *testing.T) Stores {
+		db, err := InitDB(filepath.Join(t.TempDir(), "forum.db"))
+		if err != nil {
+			t.Fatalf("InitDB: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return NewSQLiteStores(db)
+	},
+}
+
+// forEachBackend runs test once per store backend
+func forEachBackend(t *testing.T, test func(t *testing.T, ts *testServer)) {
+	for name, stores := range storeBackends {
+		t.Run(name, func(t *testing.T) {
+			test(t, newTestServer(t, stores(t)))
+		})
+	}
+}
+
+type testServer struct {
+	*httptest.Server
+	stores Stores
+	server *Server
+}
+
+func newTestServer(t *testing.T, stores Stores) *testServer {
+	t.Helper()
+	hub := NewHub()
+	go hub.Run()
+
+	server := NewServer(DefaultConfig(), stores, NewMemoryBlobStore(), hub)
+	srv := httptest.NewServer(server.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		hub.Shutdown(context.Background())
+	})
+	return &testServer{Server: srv, stores: stores, server: server}
+}
+
+// testUser is a browser-like client: it keeps cookies and, once logged in,
+// the CSRF token to echo back
+type testUser struct {
+	t      *testing.T
+	ts     *testServer
+	client *http.Client
+	uuid   string
+	csrf   string
+}
+
+func (ts *testServer) anonymous(t *testing.T) *testUser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testUser{t: t, ts: ts, client: &http.Client{Jar: jar}}
+}
+
+// signUp registers nickname with a valid password and logs in
+func (ts *testServer) signUp(t *testing.T, nickname string) *testUser {
+	t.Helper()
+	u := ts.anonymous(t)
+	status, body := u.do("POST", "/register", map[string]any{
+		"nickname": nickname, "email": nickname + "@example.com", "password": "secret123", "age": 20,
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("register %s: %d %v", nickname, status, body)
+	}
+	u.login(nickname, "secret123")
+	return u
+}
+
+func (u *testUser) login(identifier, password string) (int, map[string]any) {
+	u.t.Helper()
+	status, body := u.do("POST", "/login", map[string]any{"identifier": identifier, "password": password})
+	if status == http.StatusOK {
+		data := body["data"].(map[string]any)
+		u.uuid, u.csrf = data["user_uuid"].(string), data["csrf_token"].(string)
+	}
+	return status, body
+}
+
+// do sends body as JSON with the user's CSRF token and decodes the response
+func (u *testUser) do(method, path string, body any) (int, map[string]any) {
+	u.t.Helper()
+	return u.doWithToken(method, path, body, u.csrf)
+}
+
+func (u *testUser) doWithToken(method, path string, body any, csrf string) (int, map[string]any) {
+	u.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			u.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u.ts.URL+path, reader)
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	if csrf != "" {
+		req.Header.Set(csrfHeaderName, csrf)
+	}
+	res, err := u.client.Do(req)
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var decoded map[string]any
+	if data, _ := io.ReadAll(res.Body); len(data) > 0 {
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			u.t.Fatalf("%s %s: %d with non-JSON body %q", method, path, res.StatusCode, data)
+		}
+	}
+	return res.StatusCode, decoded
+}
+
+// dial opens the chat socket with the user's session cookie
+func (u *testUser) dial() (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{Jar: u.client.Jar, HandshakeTimeout: 5 * time.Second}
+	header := http.Header{"Origin": {u.ts.URL}}
+	return dialer.Dial("ws://"+strings.TrimPrefix(u.ts.URL, "http://")+"/ws", header)
+}
+
+// nextFrame reads from conn until a frame of the given type arrives
+func nextFrame(t *testing.T, conn *websocket.Conn, frameType string) map[string]any {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var frame map[string]any
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("waiting for a %s frame: %v", frameType, err)
+		}
+		if frame["type"] == frameType {
+			return frame
+		}
+	}
+}
+
+// errorCode is the error code of an error envelope, or "" for data
+func errorCode(body map[string]any) string {
+	e, _ := body["error"].(map[string]any)
+	code, _ := e["code"].(string)
+	return code
+}
+
+func errorFields(body map[string]any) map[string]any {
+	e, _ := body["error"].(map[string]any)
+	fields, _ := e["fields"].(map[string]any)
+	return fields
+}
+
+func dataOf(t *testing.T, body map[string]any) map[string]any {
+	t.Helper()
+	data, ok := body["data"].(map[string]any)
+	if !ok {
+		t.Fatalf("no data object in %v", body)
+	}
+	return data
+}
+
+// listOf returns the list in a response's data field
+func listOf(t *testing.T, body map[string]any) []any {
+	t.Helper()
+	list, ok := body["data"].([]any)
+	if !ok {
+		t.Fatalf("no data list in %v", body)
+	}
+	return list
+}
+
+// feedPosts returns the posts of a /feed response
+func feedPosts(t *testing.T, body map[string]any) []any {
+	t.Helper()
+	posts, ok := dataOf(t, body)["posts"].([]any)
+	if !ok {
+		t.Fatalf("no post list in %v", body)
+	}
+	return posts
+}
+
+func TestRegisterHandler(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		ts.signUp(t, "Existing")
+
+		tests := []struct {
+			name       string
+			body       any
+			wantStatus int
+			wantCode   string
+			wantFields []string
+		}{
+			{
+				name:       "valid",
+				body:       map[string]any{"nickname": " alice ", "email": "Alice@Example.com", "password": "secret123", "age": 30},
+				wantStatus: http.StatusCreated,
+			},
+			{
+				name:       "nickname taken in another case",
+				body:       map[string]any{"nickname": "EXISTING", "email": "new@example.com", "password": "secret123", "age": 30},
+				wantStatus: http.StatusConflict,
+				wantCode:   codeConflict,
+			},
+			{
+				name:       "email taken in another case",
+				body:       map[string]any{"nickname": "newname", "email": "existing@EXAMPLE.com", "password": "secret123", "age": 30},
+				wantStatus: http.StatusConflict,
+				wantCode:   codeConflict,
+			},
+			{
+				name:       "invalid fields",
+				body:       map[string]any{"nickname": "a b", "email": "not-an-email", "password": "short", "age": 0},
+				wantStatus: http.StatusBadRequest,
+				wantCode:   codeValidation,
+				wantFields: []string{"nickname", "email", "password", "age"},
+			},
+			{
+				name:       "not JSON",
+				body:       "{",
+				wantStatus: http.StatusBadRequest,
+				wantCode:   codeInvalidJSON,
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				status, body := ts.anonymous(t).do("POST", "/register", tt.body)
+				if status != tt.wantStatus || errorCode(body) != tt.wantCode {
+					t.Fatalf("got %d %v; want %d %q", status, body, tt.wantStatus, tt.wantCode)
+				}
+				fields := errorFields(body)
+				for _, field := range tt.wantFields {
+					if _, ok := fields[field]; !ok {
+						t.Errorf("no error for %s in %v", field, fields)
+					}
+				}
+			})
+		}
+
+		// The valid registration stored normalized identities
+		if status, _ := ts.anonymous(t).login("alice@example.com", "secret123"); status != http.StatusOK {
+			t.Errorf("login with normalized email: %d", status)
+		}
+	})
+}
+
+func TestLoginHandler(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		ts.signUp(t, "Bob")
+
+		tests := []struct {
+			name       string
+			identifier string
+			password   string
+			wantStatus int
+		}{
+			{"nickname", "Bob", "secret123", http.StatusOK},
+			{"nickname in another case", "bOB", "secret123", http.StatusOK},
+			{"email", "BOB@example.com", "secret123", http.StatusOK},
+			{"wrong password", "Bob", "secret124", http.StatusUnauthorized},
+			{"password is not trimmed", "Bob", " secret123", http.StatusUnauthorized},
+			{"unknown user", "nobody", "secret123", http.StatusUnauthorized},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				u := ts.anonymous(t)
+				status, body := u.login(tt.identifier, tt.password)
+				if status != tt.wantStatus {
+					t.Fatalf("got %d %v; want %d", status, body, tt.wantStatus)
+				}
+				if status != http.StatusOK {
+					return
+				}
+				if u.csrf == "" {
+					t.Error("no csrf_token in the login response")
+				}
+				// The session cookie alone authenticates safe requests
+				if status, _ := u.do("GET", "/messages?with="+u.uuid, nil); status != http.StatusOK {
+					t.Errorf("authenticated GET: %d", status)
+				}
+			})
+		}
+	})
+}
+
+func TestCSRFRejection(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		_, body := author.do("POST", "/posts", map[string]any{"title": "t", "content": "c"})
+		postUUID := dataOf(t, body)["uuid"].(string)
+		postPath := "/posts/" + postUUID
+
+		requests := []struct {
+			method, path string
+			body         any
+		}{
+			{"POST", "/posts", map[string]any{"title": "t", "content": "c"}},
+			{"PATCH", postPath, map[string]any{"title": "changed"}},
+			{"DELETE", postPath, nil},
+			{"POST", "/comments", map[string]any{"post_uuid": postUUID, "content": "c"}},
+			{"POST", "/logout", nil},
+		}
+		tokens := []struct {
+			name  string
+			token string
+		}{
+			{"missing", ""},
+			{"wrong", "not-the-token"},
+		}
+		for _, req := range requests {
+			for _, tok := range tokens {
+				t.Run(req.method+" "+req.path+" "+tok.name, func(t *testing.T) {
+					status, body := author.doWithToken(req.method, req.path, req.body, tok.token)
+					if status != http.StatusForbidden || errorCode(body) != codeInvalidCSRF {
+						t.Errorf("got %d %v; want 403 %s", status, body, codeInvalidCSRF)
+					}
+				})
+			}
+		}
+
+		// Nothing above took effect: one unchanged post, and the session still works
+		_, body = author.do("GET", "/feed", nil)
+		if posts := feedPosts(t, body); len(posts) != 1 {
+			t.Errorf("feed after rejected requests = %v; want the one post", posts)
+		}
+		status, body := author.do("GET", postPath, nil)
+		if status != http.StatusOK || dataOf(t, body)["title"] != "t" {
+			t.Errorf("post changed by rejected requests: %d %v", status, body)
+		}
+		if status, _ := author.do("POST", "/posts", map[string]any{"title": "t", "content": "c"}); status != http.StatusCreated {
+			t.Errorf("create after rejected logout: %d", status)
+		}
+
+		status, body = ts.anonymous(t).do("POST", "/posts", map[string]any{"title": "t", "content": "c"})
+		if status != http.StatusUnauthorized {
+			t.Errorf("anonymous create: %d %v; want 401", status, body)
+		}
+	})
+}
+
+func TestMessageHistoryQuery(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		user := ts.signUp(t, "user")
+		other := ts.signUp(t, "other")
+
+		tests := []struct {
+			name  string
+			query string
+			field string // the field reported invalid, or "" for 200
+		}{
+			{"no partner", "", "with"},
+			{"first page", "?with=" + other.uuid, ""},
+			{"explicit offset", "?with=" + other.uuid + "&offset=20", ""},
+			{"non-numeric offset", "?with=" + other.uuid + "&offset=abc", "offset"},
+			{"negative offset", "?with=" + other.uuid + "&offset=-1", "offset"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				status, body := user.do("GET", "/messages"+tt.query, nil)
+				if tt.field == "" {
+					if status != http.StatusOK {
+						t.Errorf("got %d %v; want 200", status, body)
+					}
+					return
+				}
+				if status != http.StatusBadRequest || errorFields(body)[tt.field] == nil {
+					t.Errorf("got %d %v; want a 400 on %s", status, body, tt.field)
+				}
+			})
+		}
+	})
+}
+
+func TestPostLifecycle(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		other := ts.signUp(t, "other")
+
+		status, body := author.do("POST", "/posts", map[string]any{"title": " ", "content": ""})
+		if status != http.StatusBadRequest || len(errorFields(body)) != 2 {
+			t.Errorf("empty post: %d %v; want title and content errors", status, body)
+		}
+		status, body = author.do("POST", "/posts", map[string]any{"title": "t", "content": strings.Repeat("x", maxPostLength+1)})
+		if status != http.StatusBadRequest || errorFields(body)["content"] == nil {
+			t.Errorf("oversized post: %d %v; want a content error", status, body)
+		}
+
+		status, body = author.do("POST", "/posts", map[string]any{
+			"title": " Hello ", "content": "world", "categories": []string{"go", " go ", ""},
+		})
+		if status != http.StatusCreated {
+			t.Fatalf("create: %d %v", status, body)
+		}
+		post := dataOf(t, body)
+		postPath := "/posts/" + post["uuid"].(string)
+		if post["title"] != "Hello" || post["author_uuid"] != author.uuid {
+			t.Errorf("created post = %v", post)
+		}
+		if cats, _ := post["categories"].([]any); len(cats) != 1 {
+			t.Errorf("categories = %v; want [go]", post["categories"])
+		}
+
+		_, body = ts.anonymous(t).do("GET", "/feed", nil)
+		if posts := feedPosts(t, body); len(posts) != 1 || posts[0].(map[string]any)["uuid"] != post["uuid"] {
+			t.Errorf("feed = %v; want the new post", posts)
+		}
+		_, body = ts.anonymous(t).do("GET", "/feed?category=other", nil)
+		if posts := feedPosts(t, body); len(posts) != 0 {
+			t.Errorf("feed for another category = %v; want none", posts)
+		}
+
+		edits := []struct {
+			name       string
+			user       *testUser
+			path       string
+			body       any
+			wantStatus int
+		}{
+			{"by another user", other, postPath, map[string]any{"title": "stolen"}, http.StatusForbidden},
+			{"to an empty title", author, postPath, map[string]any{"title": ""}, http.StatusBadRequest},
+			{"to oversized content", author, postPath, map[string]any{"content": strings.Repeat("x", maxPostLength+1)}, http.StatusBadRequest},
+			{"by the author", author, postPath, map[string]any{"title": "Edited", "categories": []string{"rust"}}, http.StatusOK},
+			{"unknown post", author, "/posts/missing", map[string]any{"title": "x"}, http.StatusNotFound},
+		}
+		for _, tt := range edits {
+			t.Run("edit "+tt.name, func(t *testing.T) {
+				if status, body := tt.user.do("PATCH", tt.path, tt.body); status != tt.wantStatus {
+					t.Errorf("got %d %v; want %d", status, body, tt.wantStatus)
+				}
+			})
+		}
+
+		status, body = author.do("GET", postPath, nil)
+		if status != http.StatusOK || dataOf(t, body)["title"] != "Edited" || dataOf(t, body)["edited_at"] == nil {
+			t.Errorf("after edit: %d %v", status, body)
+		}
+		_, body = ts.anonymous(t).do("GET", "/feed?category=rust", nil)
+		if posts := feedPosts(t, body); len(posts) != 1 {
+			t.Errorf("feed for the new category = %v; want the edited post", posts)
+		}
+		status, body = author.do("GET", postPath+"/revisions", nil)
+		if revisions, _ := body["data"].([]any); status != http.StatusOK || len(revisions) != 1 {
+			t.Errorf("revisions: %d %v; want one", status, body)
+		}
+
+		if status, _ := other.do("POST", "/comments", map[string]any{"post_uuid": post["uuid"], "content": "kept"}); status != http.StatusCreated {
+			t.Fatalf("comment: %d", status)
+		}
+		if status, _ := other.do("DELETE", postPath, nil); status != http.StatusForbidden {
+			t.Errorf("delete by another user: %d; want 403", status)
+		}
+		if status, _ := author.do("DELETE", postPath, nil); status != http.StatusNoContent {
+			t.Errorf("delete: %d; want 204", status)
+		}
+		if status, _ := author.do("DELETE", postPath, nil); status != http.StatusNotFound {
+			t.Errorf("second delete: %d; want 404", status)
+		}
+
+		// Deleted posts keep their URL and comments but lose their content and leave the feed
+		status, body = author.do("GET", postPath, nil)
+		deleted := dataOf(t, body)
+		if status != http.StatusOK || deleted["deleted"] != true || deleted["title"] != deletedPlaceholder {
+			t.Errorf("deleted post: %d %v", status, body)
+		}
+		if comments, _ := deleted["comments"].([]any); len(comments) != 1 || comments[0].(map[string]any)["content"] != "kept" {
+			t.Errorf("comments of the deleted post = %v; want the one comment", deleted["comments"])
+		}
+		_, body = author.do("GET", "/feed", nil)
+		if posts := feedPosts(t, body); len(posts) != 0 {
+			t.Errorf("feed still lists the deleted post: %v", posts)
+		}
+	})
+}
+
+func TestComments(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		commenter := ts.signUp(t, "commenter")
+		_, body := author.do("POST", "/posts", map[string]any{"title": "t", "content": "c"})
+		postUUID := dataOf(t, body)["uuid"].(string)
+
+		creates := []struct {
+			name       string
+			body       any
+			wantStatus int
+			wantCode   string
+		}{
+			{"valid", map[string]any{"post_uuid": postUUID, "content": " nice "}, http.StatusCreated, ""},
+			{"empty", map[string]any{"post_uuid": postUUID, "content": " "}, http.StatusBadRequest, codeValidation},
+			{"oversized", map[string]any{"post_uuid": postUUID, "content": strings.Repeat("x", maxCommentLength+1)}, http.StatusBadRequest, codeValidation},
+			{"no post", map[string]any{"content": "x"}, http.StatusBadRequest, codeValidation},
+			{"unknown post", map[string]any{"post_uuid": "missing", "content": "x"}, http.StatusNotFound, codeNotFound},
+		}
+		var commentUUID string
+		for _, tt := range creates {
+			t.Run("create "+tt.name, func(t *testing.T) {
+				status, body := commenter.do("POST", "/comments", tt.body)
+				if status != tt.wantStatus || errorCode(body) != tt.wantCode {
+					t.Fatalf("got %d %v; want %d %q", status, body, tt.wantStatus, tt.wantCode)
+				}
+				if status == http.StatusCreated {
+					comment := dataOf(t, body)
+					commentUUID = comment["uuid"].(string)
+					if comment["content"] != "nice" || comment["author_uuid"] != commenter.uuid {
+						t.Errorf("created comment = %v", comment)
+					}
+				}
+			})
+		}
+		if commentUUID == "" {
+			t.Fatal("no comment created")
+		}
+		commentPath := "/comments/" + commentUUID
+
+		commentCount := func() any {
+			_, body := author.do("GET", "/posts/"+postUUID, nil)
+			return dataOf(t, body)["comment_count"]
+		}
+		if n := commentCount(); n != 1.0 {
+			t.Errorf("comment_count = %v; want 1", n)
+		}
+
+		if status, _ := author.do("PATCH", commentPath, map[string]any{"content": "x"}); status != http.StatusForbidden {
+			t.Errorf("edit by another user: %d; want 403", status)
+		}
+		if status, _ := commenter.do("PATCH", commentPath, map[string]any{"content": strings.Repeat("x", maxCommentLength+1)}); status != http.StatusBadRequest {
+			t.Errorf("oversized edit: %d; want 400", status)
+		}
+		status, body := commenter.do("PATCH", commentPath, map[string]any{"content": "edited"})
+		if status != http.StatusOK || dataOf(t, body)["content"] != "edited" {
+			t.Errorf("edit: %d %v", status, body)
+		}
+
+		if status, _ := author.do("DELETE", commentPath, nil); status != http.StatusForbidden {
+			t.Errorf("delete by the post author: %d; want 403", status)
+		}
+		if status, _ := commenter.do("DELETE", commentPath, nil); status != http.StatusNoContent {
+			t.Errorf("delete: %d; want 204", status)
+		}
+		if n := commentCount(); n != 0.0 {
+			t.Errorf("comment_count after delete = %v; want 0", n)
+		}
+
+		_, body = author.do("GET", "/posts/"+postUUID, nil)
+		comments, _ := dataOf(t, body)["comments"].([]any)
+		if len(comments) != 1 || comments[0].(map[string]any)["content"] != deletedPlaceholder {
+			t.Errorf("comments after delete = %v; want one placeholder", comments)
+		}
+	})
+}
+
+func TestCommentEditWindow(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		_, body := author.do("POST", "/posts", map[string]any{"title": "t", "content": "c"})
+		_, body = author.do("POST", "/comments", map[string]any{"post_uuid": dataOf(t, body)["uuid"], "content": "c"})
+		commentPath := "/comments/" + dataOf(t, body)["uuid"].(string)
+
+		if status, body := author.do("PATCH", commentPath, map[string]any{"content": "in time"}); status != http.StatusOK {
+			t.Fatalf("edit inside the window: %d %v", status, body)
+		}
+
+		ts.server.cfg.CommentEditWindow = Duration(time.Nanosecond)
+		status, body := author.do("PATCH", commentPath, map[string]any{"content": "too late"})
+		if status != http.StatusForbidden || errorCode(body) != codeEditWindow {
+			t.Errorf("edit after the window: %d %v; want 403 %s", status, body, codeEditWindow)
+		}
+		// Deleting is not limited by the window
+		if status, _ := author.do("DELETE", commentPath, nil); status != http.StatusNoContent {
+			t.Errorf("delete after the window: %d; want 204", status)
+		}
+	})
+}
+
+func TestRequireRole(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		admin := ts.signUp(t, "admin")
+		user := ts.signUp(t, "user")
+		rolePath := func(u *testUser) string { return "/admin/users/" + u.uuid + "/role" }
+
+		if status, _ := ts.anonymous(t).do("PUT", rolePath(user), map[string]any{"role": "moderator"}); status != http.StatusUnauthorized {
+			t.Errorf("anonymous: %d; want 401", status)
+		}
+		status, body := user.do("PUT", rolePath(admin), map[string]any{"role": "user"})
+		if status != http.StatusForbidden || errorCode(body) != codeForbidden {
+			t.Errorf("plain user: %d %v; want 403", status, body)
+		}
+
+		// Roles are read per request, so the promotion applies to the
+		// existing session
+		if err := ts.stores.Users.SetUserRole(admin.uuid, RoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			name   string
+			path   string
+			role   string
+			status int
+			code   string
+		}{
+			{"invalid role", rolePath(user), "owner", http.StatusBadRequest, codeValidation},
+			{"own role", rolePath(admin), "user", http.StatusForbidden, codeForbidden},
+			{"unknown user", "/admin/users/missing/role", "moderator", http.StatusNotFound, codeNotFound},
+			{"promote", rolePath(user), "moderator", http.StatusOK, ""},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				status, body := admin.do("PUT", tt.path, map[string]any{"role": tt.role})
+				if status != tt.status || errorCode(body) != tt.code {
+					t.Errorf("got %d %v; want %d %q", status, body, tt.status, tt.code)
+				}
+			})
+		}
+
+		// A moderator still cannot reach admin routes
+		if status, _ := user.do("PUT", rolePath(admin), map[string]any{"role": "user"}); status != http.StatusForbidden {
+			t.Errorf("moderator on an admin route: %d; want 403", status)
+		}
+	})
+}
+
+func TestModeratorsDeleteOthersContent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		mod := ts.signUp(t, "mod")
+		_, body := author.do("POST", "/posts", map[string]any{"title": "t", "content": "c"})
+		postUUID := dataOf(t, body)["uuid"].(string)
+		_, body = author.do("POST", "/comments", map[string]any{"post_uuid": postUUID, "content": "c"})
+		commentPath := "/comments/" + dataOf(t, body)["uuid"].(string)
+
+		if status, _ := mod.do("DELETE", commentPath, nil); status != http.StatusForbidden {
+			t.Fatalf("delete before promotion: %d; want 403", status)
+		}
+		if status, _ := mod.do("PATCH", "/posts/"+postUUID, map[string]any{"content": "x"}); status != http.StatusForbidden {
+			t.Errorf("stranger editing a post: %d; want 403", status)
+		}
+		if err := ts.stores.Users.SetUserRole(mod.uuid, RoleModerator); err != nil {
+			t.Fatal(err)
+		}
+		status, body := mod.do("PATCH", "/posts/"+postUUID, map[string]any{"content": "moderated"})
+		if status != http.StatusOK || dataOf(t, body)["content"] != "moderated" {
+			t.Errorf("moderator editing a post: %d %v; want 200", status, body)
+		}
+		if status, _ := mod.do("PATCH", commentPath, map[string]any{"content": "x"}); status != http.StatusForbidden {
+			t.Errorf("moderator editing a comment: %d; want 403", status)
+		}
+		if status, _ := mod.do("DELETE", commentPath, nil); status != http.StatusNoContent {
+			t.Errorf("moderator deleting a comment: %d; want 204", status)
+		}
+		if status, _ := mod.do("DELETE", "/posts/"+postUUID, nil); status != http.StatusNoContent {
+			t.Errorf("moderator deleting a post: %d; want 204", status)
+		}
+	})
+}
+
+func TestReports(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		reporter := ts.signUp(t, "reporter")
+		mod := ts.signUp(t, "mod")
+		if err := ts.stores.Users.SetUserRole(mod.uuid, RoleModerator); err != nil {
+			t.Fatal(err)
+		}
+		_, body := author.do("POST", "/posts", map[string]any{"title": "t", "content": "c"})
+		postUUID := dataOf(t, body)["uuid"].(string)
+
+		report := func(target, reason string) map[string]any {
+			return map[string]any{"target_type": "post", "target_uuid": target, "reason": reason}
+		}
+		tests := []struct {
+			name   string
+			user   *testUser
+			body   any
+			status int
+			code   string
+		}{
+			{"missing fields", reporter, map[string]any{"target_type": "user"}, http.StatusBadRequest, codeValidation},
+			{"unknown post", reporter, report("missing", "spam"), http.StatusNotFound, codeNotFound},
+			{"own post", author, report(postUUID, "spam"), http.StatusBadRequest, codeInvalidRequest},
+			{"valid", reporter, report(postUUID, "spam"), http.StatusCreated, ""},
+			{"duplicate", reporter, report(postUUID, "again"), http.StatusConflict, codeConflict},
+		}
+		var reportUUID string
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				status, body := tt.user.do("POST", "/reports", tt.body)
+				if status != tt.status || errorCode(body) != tt.code {
+					t.Fatalf("got %d %v; want %d %q", status, body, tt.status, tt.code)
+				}
+				if status == http.StatusCreated {
+					created := dataOf(t, body)
+					reportUUID = created["uuid"].(string)
+					if created["target_author_uuid"] != author.uuid || created["status"] != "open" {
+						t.Errorf("created report = %v", created)
+					}
+				}
+			})
+		}
+		if reportUUID == "" {
+			t.Fatal("no report created")
+		}
+
+		if status, _ := reporter.do("GET", "/moderation/reports", nil); status != http.StatusForbidden {
+			t.Errorf("queue for a plain user: %d; want 403", status)
+		}
+		if status, body := mod.do("GET", "/moderation/reports?status=closed", nil); status != http.StatusBadRequest {
+			t.Errorf("invalid status filter: %d %v; want 400", status, body)
+		}
+		_, body = mod.do("GET", "/moderation/reports?status=open", nil)
+		if open := listOf(t, body); len(open) != 1 || open[0].(map[string]any)["uuid"] != reportUUID {
+			t.Errorf("open reports = %v", open)
+		}
+
+		resolvePath := "/moderation/reports/" + reportUUID + "/resolve"
+		if status, _ := mod.do("POST", resolvePath, map[string]any{"action": "suspend_author"}); status != http.StatusBadRequest {
+			t.Errorf("suspension without a duration: %d; want 400", status)
+		}
+		status, body := mod.do("POST", resolvePath, map[string]any{"action": "delete_content", "note": "spam"})
+		if status != http.StatusOK {
+			t.Fatalf("resolve: %d %v", status, body)
+		}
+		resolved := dataOf(t, body)
+		actions, _ := resolved["actions"].([]any)
+		if resolved["status"] != "resolved" || resolved["resolved_by"] != mod.uuid || len(actions) != 1 {
+			t.Errorf("resolved report = %v", resolved)
+		}
+		if status, _ := mod.do("POST", resolvePath, map[string]any{"action": "dismiss"}); status != http.StatusConflict {
+			t.Errorf("resolving twice: %d; want 409", status)
+		}
+
+		_, body = author.do("GET", "/posts/"+postUUID, nil)
+		if post := dataOf(t, body); post["content"] != deletedPlaceholder {
+			t.Errorf("reported post after delete_content = %v", post)
+		}
+		_, body = mod.do("GET", "/moderation/reports?status=open", nil)
+		if open := listOf(t, body); len(open) != 0 {
+			t.Errorf("open reports after resolving = %v", open)
+		}
+	})
+}
+
+func TestSuspensions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		admin := ts.signUp(t, "admin")
+		mod := ts.signUp(t, "mod")
+		user := ts.signUp(t, "user")
+		for u, role := range map[*testUser]Role{admin: RoleAdmin, mod: RoleModerator} {
+			if err := ts.stores.Users.SetUserRole(u.uuid, role); err != nil {
+				t.Fatal(err)
+			}
+		}
+		userPath := "/moderation/users/" + user.uuid
+
+		conn, _, err := user.dial()
+		if err != nil {
+			t.Fatalf("dial before suspension: %v", err)
+		}
+		defer conn.Close()
+
+		if status, _ := mod.do("POST", "/moderation/users/"+admin.uuid+"/suspend", map[string]any{"duration": "1h", "reason": "x"}); status != http.StatusForbidden {
+			t.Errorf("moderator suspending an admin: %d; want 403", status)
+		}
+		if status, _ := mod.do("POST", userPath+"/suspend", map[string]any{"reason": "x"}); status != http.StatusBadRequest {
+			t.Errorf("suspension without a duration: %d; want 400", status)
+		}
+		status, body := mod.do("POST", userPath+"/suspend", map[string]any{"duration": "1h", "reason": "spam"})
+		if status != http.StatusOK {
+			t.Fatalf("suspend: %d %v", status, body)
+		}
+
+		// The open socket is closed with the reason
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			if _, _, err = conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation || !strings.Contains(closeErr.Text, "spam") {
+			t.Errorf("socket after suspension: %v; want a policy violation close", err)
+		}
+
+		// The existing session, new sockets and new logins are all refused
+		status, body = user.do("GET", "/messages?with="+admin.uuid, nil)
+		if status != http.StatusForbidden || errorCode(body) != codeSuspended {
+			t.Errorf("request while suspended: %d %v", status, body)
+		}
+		if _, res, err := user.dial(); err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+			t.Errorf("dial while suspended: %v; want 403", err)
+		}
+		status, body = ts.anonymous(t).login("user", "secret123")
+		if status != http.StatusForbidden || errorCode(body) != codeSuspended {
+			t.Errorf("login while suspended: %d %v", status, body)
+		}
+		if status, _ := ts.anonymous(t).login("user", "wrong-password"); status != http.StatusUnauthorized {
+			t.Errorf("login with a wrong password while suspended: %d; want 401", status)
+		}
+
+		if status, _ := mod.do("DELETE", userPath+"/suspension", nil); status != http.StatusNoContent {
+			t.Fatalf("lift: %d; want 204", status)
+		}
+		if status, _ := user.do("GET", "/messages?with="+admin.uuid, nil); status != http.StatusOK {
+			t.Errorf("request after lifting: %d; want 200", status)
+		}
+
+		// Bans are admin-only, both ways
+		if status, _ := mod.do("POST", userPath+"/ban", map[string]any{"reason": "x"}); status != http.StatusForbidden {
+			t.Errorf("moderator banning: %d; want 403", status)
+		}
+		if status, _ := admin.do("POST", userPath+"/ban", map[string]any{"reason": "abuse"}); status != http.StatusOK {
+			t.Fatalf("ban: %d; want 200", status)
+		}
+		status, body = ts.anonymous(t).login("user", "secret123")
+		if status != http.StatusForbidden || errorCode(body) != codeBanned {
+			t.Errorf("login while banned: %d %v", status, body)
+		}
+		if status, _ := mod.do("DELETE", userPath+"/suspension", nil); status != http.StatusForbidden {
+			t.Errorf("moderator lifting a ban: %d; want 403", status)
+		}
+		if status, _ := admin.do("DELETE", userPath+"/suspension", nil); status != http.StatusNoContent {
+			t.Errorf("admin lifting a ban: %d; want 204", status)
+		}
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		admin := ts.signUp(t, "admin")
+		user := ts.signUp(t, "user")
+		if err := ts.stores.Users.SetUserRole(admin.uuid, RoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+		ts.anonymous(t).login("user", "wrong-password")
+		admin.do("PUT", "/admin/users/"+user.uuid+"/role", map[string]any{"role": "moderator"})
+
+		if status, _ := user.do("GET", "/admin/audit", nil); status != http.StatusForbidden {
+			t.Errorf("audit log for a moderator: %d; want 403", status)
+		}
+		if status, _ := admin.do("GET", "/admin/audit?since=yesterday", nil); status != http.StatusBadRequest {
+			t.Errorf("invalid since: %d; want 400", status)
+		}
+
+		_, body := admin.do("GET", "/admin/audit", nil)
+		events, _ := dataOf(t, body)["events"].([]any)
+		var actions []string
+		var lastID float64
+		for _, e := range events {
+			event := e.(map[string]any)
+			actions = append(actions, event["action"].(string))
+			if id := event["id"].(float64); id <= lastID {
+				t.Errorf("event ids out of order: %v after %v", id, lastID)
+			} else {
+				lastID = id
+			}
+		}
+		want := []string{"register", "login", "register", "login", "login_failed", "role_change"}
+		if strings.Join(actions, ",") != strings.Join(want, ",") {
+			t.Errorf("audit actions = %v; want %v", actions, want)
+		}
+
+		_, body = admin.do("GET", "/admin/audit?action=role_change&actor="+admin.uuid, nil)
+		events, _ = dataOf(t, body)["events"].([]any)
+		if len(events) != 1 {
+			t.Fatalf("role changes = %v; want 1", events)
+		}
+		if e := events[0].(map[string]any); e["target_uuid"] != user.uuid || e["detail"] != "moderator" || e["ip"] == "" {
+			t.Errorf("role change event = %v", e)
+		}
+
+		req, _ := http.NewRequest("GET", ts.URL+"/admin/audit/export", nil)
+		res, err := admin.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != len(want) {
+			t.Errorf("export has %d lines; want %d:\n%s", len(lines), len(want), data)
+		}
+	})
+}
+
+func TestReactions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		fan := ts.signUp(t, "fan")
+		_, body := author.do("POST", "/posts", map[string]any{"title": "t", "content": "c"})
+		postPath := "/posts/" + dataOf(t, body)["uuid"].(string)
+
+		tests := []struct {
+			name     string
+			method   string
+			path     string
+			body     any
+			status   int
+			likes    float64
+			dislikes float64
+			reaction string
+		}{
+			{"invalid", "PUT", postPath + "/reaction", map[string]any{"reaction": "love"}, http.StatusBadRequest, 0, 0, ""},
+			{"unknown post", "PUT", "/posts/missing/reaction", map[string]any{"reaction": "like"}, http.StatusNotFound, 0, 0, ""},
+			{"unknown comment", "PUT", "/comments/missing/reaction", map[string]any{"reaction": "like"}, http.StatusNotFound, 0, 0, ""},
+			{"like", "PUT", postPath + "/reaction", map[string]any{"reaction": "like"}, http.StatusOK, 1, 0, "like"},
+			{"like again", "PUT", postPath + "/reaction", map[string]any{"reaction": "like"}, http.StatusOK, 1, 0, "like"},
+			{"switch", "PUT", postPath + "/reaction", map[string]any{"reaction": "dislike"}, http.StatusOK, 0, 1, "dislike"},
+			{"remove", "DELETE", postPath + "/reaction", nil, http.StatusOK, 0, 0, ""},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				status, body := fan.do(tt.method, tt.path, tt.body)
+				if status != tt.status {
+					t.Fatalf("got %d %v; want %d", status, body, tt.status)
+				}
+				if status != http.StatusOK {
+					return
+				}
+				counts := dataOf(t, body)
+				if counts["likes"] != tt.likes || counts["dislikes"] != tt.dislikes || counts["reaction"] != tt.reaction {
+					t.Errorf("counts = %v; want %v likes, %v dislikes, reaction %q", counts, tt.likes, tt.dislikes, tt.reaction)
+				}
+			})
+		}
+	})
+}
+
+func TestNotifications(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		fan := ts.signUp(t, "fan")
+		_, body := author.do("POST", "/posts", map[string]any{"title": "t", "content": "c"})
+		postUUID := dataOf(t, body)["uuid"].(string)
+
+		conn, _, err := author.dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// Reacting to your own post notifies nobody
+		author.do("PUT", "/posts/"+postUUID+"/reaction", map[string]any{"reaction": "like"})
+		fan.do("POST", "/comments", map[string]any{"post_uuid": postUUID, "content": "nice post"})
+
+		// The comment is pushed live
+		frame := nextFrame(t, conn, "notification")
+		if n := frame["notification"].(map[string]any); n["type"] != "comment" || n["preview"] != "nice post" {
+			t.Errorf("pushed notification = %v", n)
+		}
+
+		// Switched-off types are not stored
+		status, body := author.do("PUT", "/notifications/preferences", map[string]any{"reaction": false})
+		if status != http.StatusOK || dataOf(t, body)["reaction"] != false || dataOf(t, body)["comment"] != true {
+			t.Errorf("preferences: %d %v", status, body)
+		}
+		if status, _ := author.do("PUT", "/notifications/preferences", map[string]any{"digest": true}); status != http.StatusBadRequest {
+			t.Errorf("unknown preference: %d; want 400", status)
+		}
+		fan.do("PUT", "/posts/"+postUUID+"/reaction", map[string]any{"reaction": "like"})
+
+		_, body = author.do("GET", "/notifications", nil)
+		list := dataOf(t, body)
+		notes := list["notifications"].([]any)
+		if len(notes) != 1 || list["unread"] != 1.0 {
+			t.Fatalf("notifications = %v; want one unread comment", list)
+		}
+		notePath := "/notifications/" + notes[0].(map[string]any)["uuid"].(string) + "/read"
+
+		if status, _ := fan.do("POST", notePath, nil); status != http.StatusNotFound {
+			t.Errorf("marking someone else's notification: %d; want 404", status)
+		}
+		if status, _ := author.do("POST", notePath, nil); status != http.StatusNoContent {
+			t.Errorf("mark read: %d; want 204", status)
+		}
+		_, body = author.do("GET", "/notifications?unread=true", nil)
+		if list := dataOf(t, body); len(list["notifications"].([]any)) != 0 || list["unread"] != 0.0 {
+			t.Errorf("unread after marking read = %v", list)
+		}
+
+		author.do("PUT", "/notifications/preferences", map[string]any{"reaction": true})
+		fan.do("PUT", "/posts/"+postUUID+"/reaction", map[string]any{"reaction": "dislike"})
+		if status, _ := author.do("POST", "/notifications/read-all", nil); status != http.StatusNoContent {
+			t.Errorf("read-all: %d; want 204", status)
+		}
+		_, body = author.do("GET", "/notifications", nil)
+		if list := dataOf(t, body); len(list["notifications"].([]any)) != 2 || list["unread"] != 0.0 {
+			t.Errorf("notifications after read-all = %v; want two read", list)
+		}
+	})
+}
+
+func TestLiveEvents(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		fan := ts.signUp(t, "fan")
+		_, body := author.do("POST", "/posts", map[string]any{"title": "thread", "content": "c"})
+		postUUID := dataOf(t, body)["uuid"].(string)
+
+		// Frames are handled in order, so the error answering a bogus frame
+		// means the subscriptions before it are in place
+		subscribe := func(u *testUser, sub map[string]any) *websocket.Conn {
+			conn, _, err := u.dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			sub["type"] = "subscribe"
+			conn.WriteJSON(sub)
+			conn.WriteJSON(map[string]any{"type": "bogus"})
+			nextFrame(t, conn, "error")
+			return conn
+		}
+		feed := subscribe(fan, map[string]any{"category": "go"})
+		thread := subscribe(fan, map[string]any{"post_uuid": postUUID})
+
+		everything := subscribe(fan, map[string]any{})
+		everything.WriteJSON(map[string]any{"type": "subscribe", "category": "go", "post_uuid": postUUID})
+		if frame := nextFrame(t, everything, "error"); errorCode(frame) != codeInvalidRequest {
+			t.Errorf("subscribing to a category and a post = %v", frame)
+		}
+
+		author.do("POST", "/posts", map[string]any{"title": "rust post", "content": "c", "categories": []string{"rust"}})
+		author.do("POST", "/posts", map[string]any{"title": "go post", "content": "c", "categories": []string{"go"}})
+		if post := nextFrame(t, feed, "post_created")["post"].(map[string]any); post["title"] != "go post" {
+			t.Errorf("first post in the go feed = %v", post)
+		}
+		if post := nextFrame(t, everything, "post_created")["post"].(map[string]any); post["title"] != "rust post" {
+			t.Errorf("first post in the whole feed = %v", post)
+		}
+
+		fan.do("POST", "/comments", map[string]any{"post_uuid": postUUID, "content": "live"})
+		if comment := nextFrame(t, thread, "comment_created")["comment"].(map[string]any); comment["content"] != "live" {
+			t.Errorf("comment event = %v", comment)
+		}
+		author.do("PUT", "/posts/"+postUUID+"/reaction", map[string]any{"reaction": "like"})
+		if frame := nextFrame(t, thread, "reaction_updated"); frame["target_uuid"] != postUUID || frame["likes"] != 1.0 {
+			t.Errorf("reaction event = %v", frame)
+		}
+	})
+}
+
+// notificationsOf lists u's notifications of one type
+func notificationsOf(t *testing.T, u *testUser, notificationType NotificationType) []map[string]any {
+	t.Helper()
+	_, body := u.do("GET", "/notifications", nil)
+	var found []map[string]any
+	for _, n := range dataOf(t, body)["notifications"].([]any) {
+		if n := n.(map[string]any); n["type"] == string(notificationType) {
+			found = append(found, n)
+		}
+	}
+	return found
+}
+
+func TestMentions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		bob := ts.signUp(t, "bob")
+		alice := ts.signUp(t, "alice_1")
+
+		// Offsets count code points, skip e-mail addresses and unknown
+		// users, and leave out a sentence's trailing dot
+		content := "héllo @bob. and @nobody, mail a@bob.com, @ALICE_1! @author"
+		_, body := author.do("POST", "/posts", map[string]any{"title": "t", "content": content})
+		post := dataOf(t, body)
+		postPath := "/posts/" + post["uuid"].(string)
+
+		want := []Mention{
+			{UserUUID: bob.uuid, Nickname: "bob", Start: 6, End: 10},
+			{UserUUID: alice.uuid, Nickname: "alice_1", Start: 41, End: 49},
+			{UserUUID: author.uuid, Nickname: "author", Start: 51, End: 58},
+		}
+		_, body = author.do("GET", postPath, nil)
+		for name, mentions := range map[string]any{"create": post["mentions"], "get": dataOf(t, body)["mentions"]} {
+			data, _ := json.Marshal(mentions)
+			var got []Mention
+			json.Unmarshal(data, &got)
+			if len(got) != len(want) {
+				t.Errorf("%s: mentions = %+v; want %+v", name, got, want)
+				continue
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("%s: mention %d = %+v; want %+v", name, i, got[i], want[i])
+				}
+			}
+		}
+
+		// Editing notifies only users mentioned for the first time, and
+		// nobody is notified about mentioning themselves
+		carol := ts.signUp(t, "carol")
+		if status, body := author.do("PATCH", postPath, map[string]any{"title": "t", "content": content + " @carol"}); status != http.StatusOK {
+			t.Fatalf("edit: %d %v", status, body)
+		}
+		for _, u := range []*testUser{bob, alice, carol} {
+			if n := notificationsOf(t, u, NotifyMention); len(n) != 1 || n[0]["target_type"] != "post" {
+				t.Errorf("%s mention notifications = %v; want one for the post", u.uuid, n)
+			}
+		}
+		if n := notificationsOf(t, author, NotifyMention); len(n) != 0 {
+			t.Errorf("self-mention notifications = %v", n)
+		}
+	})
+}
+
+func TestPrivateMessageMentions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		sender := ts.signUp(t, "sender")
+		bob := ts.signUp(t, "bob")
+		outsider := ts.signUp(t, "outsider")
+
+		conns := map[*testUser]*websocket.Conn{}
+		for _, u := range []*testUser{sender, bob} {
+			conn, _, err := u.dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conns[u] = conn
+		}
+		if err := conns[sender].WriteJSON(map[string]any{"to": bob.uuid, "content": "@bob ask @outsider"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Mentions are recorded before the message is delivered
+		conns[bob].SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var frame map[string]any
+			if err := conns[bob].ReadJSON(&frame); err != nil {
+				t.Fatalf("waiting for the message: %v", err)
+			}
+			if frame["content"] != nil {
+				break
+			}
+		}
+
+		_, body := bob.do("GET", "/messages?with="+sender.uuid, nil)
+		messages := listOf(t, body)
+		if len(messages) != 1 {
+			t.Fatalf("messages = %v; want one", messages)
+		}
+		mentions, _ := messages[0].(map[string]any)["mentions"].([]any)
+		if len(mentions) != 1 || mentions[0].(map[string]any)["user_uuid"] != bob.uuid {
+			t.Errorf("message mentions = %v; want only the recipient", mentions)
+		}
+
+		if n := notificationsOf(t, bob, NotifyMention); len(n) != 1 || n[0]["target_type"] != "message" {
+			t.Errorf("recipient mention notifications = %v; want one", n)
+		}
+		if n := notificationsOf(t, outsider, NotifyMention); len(n) != 0 {
+			t.Errorf("outsider was notified about a private message: %v", n)
+		}
+	})
+}
+
+// uploadFile sends data as the "file" part of a multipart form
+func (u *testUser) uploadFile(filename string, data []byte) (int, map[string]any) {
+	u.t.Helper()
+	return u.sendForm("POST", "/attachments", nil, filename, data)
+}
+
+// sendForm sends a multipart form with the given text fields followed by
+// data as the "file" part
+func (u *testUser) sendForm(method, path string, fields map[string]string, filename string, data []byte) (int, map[string]any) {
+	u.t.Helper()
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req, err := http.NewRequest(method, u.ts.URL+path, &buf)
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set(csrfHeaderName, u.csrf)
+	res, err := u.client.Do(req)
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var body map[string]any
+	json.NewDecoder(res.Body).Decode(&body)
+	return res.StatusCode, body
+}
+
+// upload sends a small text file to /attachments and returns its UUID
+func (u *testUser) upload(content string) string {
+	u.t.Helper()
+	status, body := u.uploadFile("notes.txt", []byte(content))
+	if status != http.StatusCreated {
+		u.t.Fatalf("upload: %d %v", status, body)
+	}
+	return dataOf(u.t, body)["uuid"].(string)
+}
+
+// fetch GETs path and returns the status, headers and raw body
+func (u *testUser) fetch(path string) (int, http.Header, []byte) {
+	u.t.Helper()
+	res, err := u.client.Get(u.ts.URL + path)
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	return res.StatusCode, res.Header, data
+}
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, 0, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUploadAttachments(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		user := ts.signUp(t, "user")
+		limits := ts.server.cfg.Uploads
+
+		tests := []struct {
+			name     string
+			filename string
+			data     []byte
+			status   int
+			code     string
+		}{
+			{"empty", "a.txt", nil, http.StatusBadRequest, codeValidation},
+			{"unsupported type", "a.exe", []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff"), http.StatusUnsupportedMediaType, codeUnsupportedType},
+			{"too large", "a.txt", bytes.Repeat([]byte("a"), int(limits.MaxBytes)+1), http.StatusRequestEntityTooLarge, codeTooLarge},
+			{"not an image", "a.png", append(encodePNG(t, 4, 4)[:40], 0), http.StatusBadRequest, codeValidation},
+			{"oversized image", "a.png", encodePNG(t, limits.MaxImageDimension+1, 1), http.StatusBadRequest, codeValidation},
+			{"text", "../notes.txt", []byte("hello"), http.StatusCreated, ""},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				status, body := user.uploadFile(tt.filename, tt.data)
+				if status != tt.status || errorCode(body) != tt.code {
+					t.Fatalf("got %d %v; want %d %q", status, body, tt.status, tt.code)
+				}
+				if status == http.StatusCreated {
+					if a := dataOf(t, body); a["filename"] != "notes.txt" || a["size"] != 5.0 {
+						t.Errorf("attachment = %v", a)
+					}
+				}
+			})
+		}
+
+		status, body := user.uploadFile("wide.png", encodePNG(t, 600, 300))
+		if status != http.StatusCreated {
+			t.Fatalf("image upload: %d %v", status, body)
+		}
+		a := dataOf(t, body)
+		if a["width"] != 600.0 || a["height"] != 300.0 {
+			t.Errorf("image attachment = %v", a)
+		}
+		status, header, data := user.fetch("/attachments/" + a["uuid"].(string) + "/thumbnail")
+		if status != http.StatusOK || header.Get("Content-Type") != "image/png" {
+			t.Fatalf("thumbnail: %d %v", status, header)
+		}
+		thumb, err := png.DecodeConfig(bytes.NewReader(data))
+		size := limits.ThumbnailSize
+		if err != nil || thumb.Width != size || thumb.Height != size/2 {
+			t.Errorf("thumbnail is %dx%d, %v; want %dx%d", thumb.Width, thumb.Height, err, size, size/2)
+		}
+	})
+}
+
+func TestAttachmentAccess(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		other := ts.signUp(t, "other")
+		anonymous := ts.anonymous(t)
+		file := author.upload("hello")
+		filePath := "/attachments/" + file
+
+		// Until it is attached, only the uploader sees the file
+		if status, header, data := author.fetch(filePath); status != http.StatusOK || string(data) != "hello" ||
+			header.Get("X-Content-Type-Options") != "nosniff" || !strings.HasPrefix(header.Get("Content-Disposition"), "attachment") {
+			t.Errorf("uploader: %d %v %q", status, header, data)
+		}
+		if status, _, _ := other.fetch(filePath); status != http.StatusNotFound {
+			t.Errorf("another user before posting: %d; want 404", status)
+		}
+		if status, _, _ := anonymous.fetch(filePath); status != http.StatusUnauthorized {
+			t.Errorf("anonymous before posting: %d; want 401", status)
+		}
+
+		// Nobody else can claim it
+		status, body := other.do("POST", "/posts", map[string]any{"title": "t", "content": "c", "attachment_uuids": []string{file}})
+		if status != http.StatusBadRequest || errorFields(body)["attachment_uuids"] == nil {
+			t.Errorf("claiming someone else's upload: %d %v", status, body)
+		}
+
+		status, body = author.do("POST", "/posts", map[string]any{"title": "t", "content": "c", "attachment_uuids": []string{file}})
+		if status != http.StatusCreated {
+			t.Fatalf("post: %d %v", status, body)
+		}
+		postPath := "/posts/" + dataOf(t, body)["uuid"].(string)
+		if attachments, _ := dataOf(t, body)["attachments"].([]any); len(attachments) != 1 {
+			t.Errorf("post attachments = %v", attachments)
+		}
+		if status, header, _ := anonymous.fetch(filePath); status != http.StatusOK || header.Get("Cache-Control") != "public, max-age=3600" {
+			t.Errorf("anonymous after posting: %d %v", status, header)
+		}
+
+		// Files of deleted posts stay with their author
+		author.do("DELETE", postPath, nil)
+		if status, _, _ := other.fetch(filePath); status != http.StatusNotFound {
+			t.Errorf("another user after deletion: %d; want 404", status)
+		}
+		if status, _, _ := author.fetch(filePath); status != http.StatusOK {
+			t.Errorf("author after deletion: %d; want 200", status)
+		}
+	})
+}
+
+func TestAvatars(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		user := ts.signUp(t, "user")
+		avatarPath := "/users/" + user.uuid + "/avatar"
+
+		pngSize := func(path string) (int, int, http.Header) {
+			t.Helper()
+			status, header, data := user.fetch(path)
+			if status != http.StatusOK || header.Get("Content-Type") != "image/png" {
+				t.Fatalf("GET %s: %d %v", path, status, header)
+			}
+			cfg, err := png.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+			return cfg.Width, cfg.Height, header
+		}
+
+		// Without an upload everyone gets a generated identicon
+		_, body := user.do("GET", "/users/"+user.uuid, nil)
+		if url := dataOf(t, body)["avatar_url"]; url != avatarPath+"?v=default" {
+			t.Errorf("default avatar_url = %v", url)
+		}
+		if w, h, _ := pngSize(avatarPath); w != defaultAvatarSize || h != defaultAvatarSize {
+			t.Errorf("default avatar is %dx%d", w, h)
+		}
+		if w, _, _ := pngSize(avatarPath + "?size=64"); w != 64 {
+			t.Errorf("?size=64 avatar is %d wide", w)
+		}
+		if status, _, _ := user.fetch(avatarPath + "?size=100"); status != http.StatusBadRequest {
+			t.Errorf("unsupported size: %d; want 400", status)
+		}
+		if status, _, _ := user.fetch("/users/missing/avatar"); status != http.StatusNotFound {
+			t.Errorf("unknown user: %d; want 404", status)
+		}
+
+		tests := []struct {
+			name   string
+			user   *testUser
+			fields map[string]string
+			data   []byte
+			status int
+		}{
+			{"anonymous", ts.anonymous(t), nil, encodePNG(t, 10, 10), http.StatusUnauthorized},
+			{"not an image", user, nil, []byte("hello"), http.StatusUnsupportedMediaType},
+			{"crop outside the image", user, map[string]string{"crop_x": "250", "crop_y": "0", "crop_size": "100"}, encodePNG(t, 300, 200), http.StatusBadRequest},
+			{"partial crop", user, map[string]string{"crop_x": "0"}, encodePNG(t, 300, 200), http.StatusBadRequest},
+			{"crop", user, map[string]string{"crop_x": "10", "crop_y": "10", "crop_size": "100"}, encodePNG(t, 300, 200), http.StatusOK},
+			{"centred", user, nil, encodePNG(t, 300, 200), http.StatusOK},
+		}
+		var avatarURL string
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				status, body := tt.user.sendForm("PUT", "/me/avatar", tt.fields, "me.png", tt.data)
+				if status != tt.status {
+					t.Fatalf("got %d %v; want %d", status, body, tt.status)
+				}
+				if status == http.StatusOK {
+					avatarURL = dataOf(t, body)["avatar_url"].(string)
+				}
+			})
+		}
+		if !strings.HasPrefix(avatarURL, avatarPath+"?v=") || strings.HasSuffix(avatarURL, "=default") {
+			t.Fatalf("avatar_url after upload = %q", avatarURL)
+		}
+		avatarUUID := strings.TrimPrefix(avatarURL, avatarPath+"?v=")
+
+		// The current URL is cacheable and revalidates by ETag
+		w, h, header := pngSize(avatarURL + "&size=256")
+		if w != 256 || h != 256 || header.Get("Cache-Control") != "public, max-age=86400" {
+			t.Errorf("uploaded avatar: %dx%d %v", w, h, header)
+		}
+		req, _ := http.NewRequest("GET", ts.URL+avatarPath+"?size=256", nil)
+		req.Header.Set("If-None-Match", header.Get("ETag"))
+		if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusNotModified {
+			t.Errorf("revalidation: %v %v; want 304", res, err)
+		} else {
+			res.Body.Close()
+		}
+
+		// A lost file falls back to the identicon rather than failing
+		if err := ts.server.blobs.Delete(avatarKey(avatarUUID, 64)); err != nil {
+			t.Fatal(err)
+		}
+		w, _, header = pngSize(avatarURL + "&size=64")
+		if w != 64 || header.Get("Cache-Control") != "public, no-cache" {
+			t.Errorf("avatar with a missing file: %d wide %v; want an uncached identicon", w, header)
+		}
+
+		author := ts.signUp(t, "author")
+		author.do("POST", "/posts", map[string]any{"title": "t", "content": "c"})
+		user.do("POST", "/posts", map[string]any{"title": "t", "content": "c"})
+		_, body = user.do("GET", "/feed", nil)
+		for _, p := range feedPosts(t, body) {
+			p := p.(map[string]any)
+			want := "/users/" + author.uuid + "/avatar?v=default"
+			if p["author_uuid"] == user.uuid {
+				want = avatarURL
+			}
+			if got := p["author"].(map[string]any)["avatar_url"]; got != want {
+				t.Errorf("feed author avatar_url = %v; want %v", got, want)
+			}
+		}
+
+		// Removing the avatar also removes its files
+		status, body := user.do("DELETE", "/me/avatar", nil)
+		if status != http.StatusOK || dataOf(t, body)["avatar_url"] != avatarPath+"?v=default" {
+			t.Errorf("delete: %d %v", status, body)
+		}
+		for _, size := range avatarSizes {
+			if _, err := ts.server.blobs.Open(avatarKey(avatarUUID, size)); !errors.Is(err, ErrBlobNotFound) {
+				t.Errorf("size %d after delete: %v; want ErrBlobNotFound", size, err)
+			}
+		}
+	})
+}
+
+func TestAuthors(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		alice := ts.signUp(t, "Alice")
+		bob := ts.signUp(t, "bob")
+		if err := ts.stores.Users.SetUserRole(alice.uuid, RoleModerator); err != nil {
+			t.Fatal(err)
+		}
+		alice.do("POST", "/posts", map[string]any{"title": "a1", "content": "c", "categories": []string{"go"}})
+		alice.do("POST", "/posts", map[string]any{"title": "a2", "content": "c"})
+		_, body := bob.do("POST", "/posts", map[string]any{"title": "b1", "content": "c", "categories": []string{"go"}})
+		bobPost := dataOf(t, body)
+		if author := bobPost["author"].(map[string]any); author["nickname"] != "bob" || author["role"] != "user" {
+			t.Errorf("author of a new post = %v", author)
+		}
+
+		_, body = alice.do("POST", "/comments", map[string]any{"post_uuid": bobPost["uuid"], "content": "c"})
+		if author := dataOf(t, body)["author"].(map[string]any); author["nickname"] != "Alice" || author["role"] != "moderator" {
+			t.Errorf("author of a new comment = %v", author)
+		}
+		_, body = bob.do("GET", "/posts/"+bobPost["uuid"].(string), nil)
+		comments := dataOf(t, body)["comments"].([]any)
+		if author := comments[0].(map[string]any)["author"].(map[string]any); author["nickname"] != "Alice" || author["role"] != "moderator" ||
+			author["avatar_url"] != "/users/"+alice.uuid+"/avatar?v=default" {
+			t.Errorf("author of a listed comment = %v", author)
+		}
+
+		tests := []struct {
+			query  string
+			titles []string
+		}{
+			{"", []string{"b1", "a2", "a1"}},
+			{"?author=alice", []string{"a2", "a1"}},
+			{"?author=+ALICE+", []string{"a2", "a1"}},
+			{"?author=alice&category=go", []string{"a1"}},
+			{"?author=nobody", []string{}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.query, func(t *testing.T) {
+				_, body := bob.do("GET", "/feed"+tt.query, nil)
+				titles := []string{}
+				for _, p := range feedPosts(t, body) {
+					p := p.(map[string]any)
+					titles = append(titles, p["title"].(string))
+					if p["title"] == "a1" {
+						if author := p["author"].(map[string]any); author["nickname"] != "Alice" || author["role"] != "moderator" {
+							t.Errorf("author in the feed = %v", author)
+						}
+					}
+				}
+				if strings.Join(titles, ",") != strings.Join(tt.titles, ",") {
+					t.Errorf("feed = %v; want %v", titles, tt.titles)
+				}
+			})
+		}
+	})
+}
+
+// walkFeed follows next_cursor from the first page of query, pageSize posts
+// at a time, and returns the titles in order
+func walkFeed(t *testing.T, u *testUser, query string, pageSize int) []string {
+	t.Helper()
+	var titles []string
+	path := "/feed?limit=" + strconv.Itoa(pageSize) + query
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatalf("%s: next_cursor never ran out", query)
+		}
+		status, body := u.do("GET", path, nil)
+		if status != http.StatusOK {
+			t.Fatalf("GET %s: %d %v", path, status, body)
+		}
+		for _, p := range feedPosts(t, body) {
+			titles = append(titles, p.(map[string]any)["title"].(string))
+		}
+		cursor, _ := dataOf(t, body)["next_cursor"].(string)
+		if cursor == "" {
+			return titles
+		}
+		path = "/feed?limit=" + strconv.Itoa(pageSize) + query + "&cursor=" + url.QueryEscape(cursor)
+	}
+}
+
+func TestFeedPagination(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		fans := []*testUser{ts.signUp(t, "fan1"), ts.signUp(t, "fan2"), ts.signUp(t, "fan3")}
+
+		// p0 is the oldest; post i gets i%4 likes and i%3 comments, so
+		// several posts tie on every key but the newest
+		var uuids []string
+		for i := 0; i < 7; i++ {
+			_, body := author.do("POST", "/posts", map[string]any{"title": "p" + strconv.Itoa(i), "content": "c"})
+			uuids = append(uuids, dataOf(t, body)["uuid"].(string))
+		}
+		for i, postUUID := range uuids {
+			for _, fan := range fans[:i%4] {
+				fan.do("PUT", "/posts/"+postUUID+"/reaction", map[string]any{"reaction": "like"})
+			}
+			for n := 0; n < i%3; n++ {
+				fans[0].do("POST", "/comments", map[string]any{"post_uuid": postUUID, "content": "c"})
+			}
+		}
+
+		// Every page size walks the same order as one big page, with no
+		// post missing or repeated
+		for _, sort := range []string{"newest", "top", "hot", "commented"} {
+			t.Run(sort, func(t *testing.T) {
+				query := "&sort=" + sort
+				if sort == "top" {
+					query += "&window=all"
+				}
+				want := walkFeed(t, author, query, maxFeedPageSize)
+				if len(want) != len(uuids) {
+					t.Fatalf("feed = %v; want all %d posts", want, len(uuids))
+				}
+				for _, pageSize := range []int{1, 2, 3} {
+					if got := walkFeed(t, author, query, pageSize); strings.Join(got, ",") != strings.Join(want, ",") {
+						t.Errorf("pages of %d = %v; want %v", pageSize, got, want)
+					}
+				}
+			})
+		}
+		if got := walkFeed(t, author, "&sort=newest", 3); strings.Join(got, ",") != "p6,p5,p4,p3,p2,p1,p0" {
+			t.Errorf("newest = %v", got)
+		}
+		// Net likes first, newest first among equals
+		if got := walkFeed(t, author, "&sort=top&window=all", 3); strings.Join(got, ",") != "p3,p6,p2,p5,p1,p4,p0" {
+			t.Errorf("top = %v", got)
+		}
+		if got := walkFeed(t, author, "&sort=commented", 3); strings.Join(got, ",") != "p5,p2,p4,p1,p6,p3,p0" {
+			t.Errorf("commented = %v", got)
+		}
+
+		// New posts do not shift later pages of a feed being read
+		_, body := author.do("GET", "/feed?limit=3", nil)
+		cursor := dataOf(t, body)["next_cursor"].(string)
+		author.do("POST", "/posts", map[string]any{"title": "late", "content": "c"})
+		_, body = author.do("GET", "/feed?limit=3&cursor="+url.QueryEscape(cursor), nil)
+		var titles []string
+		for _, p := range feedPosts(t, body) {
+			titles = append(titles, p.(map[string]any)["title"].(string))
+		}
+		if strings.Join(titles, ",") != "p3,p2,p1" {
+			t.Errorf("second page after a new post = %v; want p3,p2,p1", titles)
+		}
+
+		for _, query := range []string{
+			"sort=best", "limit=0", "limit=101", "sort=newest&window=day", "sort=top&window=decade",
+			"cursor=garbage", "sort=top&cursor=" + url.QueryEscape(cursor),
+		} {
+			if status, body := author.do("GET", "/feed?"+query, nil); status != http.StatusBadRequest || errorCode(body) != codeValidation {
+				t.Errorf("?%s: %d %v; want 400", query, status, body)
+			}
+		}
+	})
+}
+
+func TestPersonalFeeds(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		alice := ts.signUp(t, "alice")
+		bob := ts.signUp(t, "bob")
+		posts := map[string]string{}
+		for _, p := range []struct {
+			author   *testUser
+			title    string
+			category string
+		}{{alice, "a1", "go"}, {bob, "b1", "go"}, {alice, "a2", "rust"}, {bob, "b2", "js"}} {
+			_, body := p.author.do("POST", "/posts", map[string]any{"title": p.title, "content": "c", "categories": []string{p.category}})
+			posts[p.title] = dataOf(t, body)["uuid"].(string)
+		}
+		alice.do("PUT", "/posts/"+posts["b1"]+"/reaction", map[string]any{"reaction": "like"})
+		alice.do("PUT", "/posts/"+posts["b2"]+"/reaction", map[string]any{"reaction": "dislike"})
+
+		followed := func(method, category string) []any {
+			t.Helper()
+			status, body := alice.do(method, "/categories/"+category+"/follow", nil)
+			if status != http.StatusOK {
+				t.Fatalf("%s follow %s: %d %v", method, category, status, body)
+			}
+			return listOf(t, body)
+		}
+		followed("PUT", "go")
+		if categories := followed("PUT", "go"); len(categories) != 1 || categories[0] != "go" {
+			t.Errorf("following twice = %v; want [go]", categories)
+		}
+		followed("PUT", "rust")
+		if categories := followed("DELETE", "rust"); len(categories) != 1 {
+			t.Errorf("after unfollowing = %v; want [go]", categories)
+		}
+		followed("DELETE", "rust")
+		_, body := alice.do("GET", "/me/categories", nil)
+		if categories := listOf(t, body); len(categories) != 1 || categories[0] != "go" {
+			t.Errorf("/me/categories = %v; want [go]", categories)
+		}
+
+		tests := []struct {
+			query  string
+			titles string
+		}{
+			{"mine=true", "a2,a1"},
+			{"mine=false", "b2,a2,b1,a1"},
+			{"liked=true", "b1"},
+			{"followed=true", "b1,a1"},
+			{"mine=true&followed=true", "a1"},
+			{"liked=true&category=js", ""},
+		}
+		for _, tt := range tests {
+			t.Run(tt.query, func(t *testing.T) {
+				if got := strings.Join(walkFeed(t, alice, "&"+tt.query, 10), ","); got != tt.titles {
+					t.Errorf("feed = %s; want %s", got, tt.titles)
+				}
+			})
+		}
+
+		// bob's view of the same filters is his own
+		if got := strings.Join(walkFeed(t, bob, "&mine=true", 10), ","); got != "b2,b1" {
+			t.Errorf("bob's posts = %s", got)
+		}
+		if got := walkFeed(t, bob, "&followed=true", 10); len(got) != 0 {
+			t.Errorf("bob follows nothing but sees %v", got)
+		}
+
+		anonymous := ts.anonymous(t)
+		for _, query := range []string{"mine=true", "liked=true", "followed=true", "category=go&liked=1"} {
+			if status, body := anonymous.do("GET", "/feed?"+query, nil); status != http.StatusUnauthorized || errorCode(body) != codeUnauthorized {
+				t.Errorf("anonymous ?%s: %d %v; want 401", query, status, body)
+			}
+		}
+		if status, _ := anonymous.do("GET", "/feed?mine=false", nil); status != http.StatusOK {
+			t.Errorf("anonymous ?mine=false: %d; want 200", status)
+		}
+		if status, _ := alice.do("GET", "/feed?mine=maybe", nil); status != http.StatusBadRequest {
+			t.Errorf("?mine=maybe: %d; want 400", status)
+		}
+		if status, _ := anonymous.do("PUT", "/categories/go/follow", nil); status != http.StatusUnauthorized {
+			t.Errorf("anonymous follow: %d; want 401", status)
+		}
+	})
+}
+
+func TestCommentAndReactionNotifications(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		fan := ts.signUp(t, "fan")
+		_, body := author.do("POST", "/posts", map[string]any{"title": "t", "content": "c"})
+		postPath := "/posts/" + dataOf(t, body)["uuid"].(string)
+
+		if status, _ := fan.do("POST", "/comments", map[string]any{"post_uuid": dataOf(t, body)["uuid"], "content": "nice"}); status != http.StatusCreated {
+			t.Fatalf("comment: %d", status)
+		}
+		for _, step := range []struct{ method, reaction string }{
+			{"PUT", "like"}, {"PUT", "dislike"}, {"PUT", "like"}, {"DELETE", ""}, {"PUT", "like"},
+		} {
+			var req any
+			if step.reaction != "" {
+				req = map[string]any{"reaction": step.reaction}
+			}
+			if status, body := fan.do(step.method, postPath+"/reaction", req); status >= 300 {
+				t.Fatalf("%s reaction %q: %d %v", step.method, step.reaction, status, body)
+			}
+		}
+
+		_, body = author.do("GET", "/notifications", nil)
+		counts := map[NotificationType]int{}
+		for _, n := range dataOf(t, body)["notifications"].([]any) {
+			counts[NotificationType(n.(map[string]any)["type"].(string))]++
+		}
+		if counts[NotifyComment] != 1 || counts[NotifyReaction] != 1 {
+			t.Errorf("notifications by type = %v; want one comment and one reaction", counts)
+		}
+	})
+}
+
+func TestPostClaimsAttachmentsAtomically(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		file := author.upload("hello")
+
+		// The unknown file fails the post, which must leave the good one unclaimed
+		status, body := author.do("POST", "/posts", map[string]any{
+			"title": "t", "content": "c", "attachment_uuids": []string{file, "missing"},
+		})
+		if status != http.StatusBadRequest || errorFields(body)["attachment_uuids"] == nil {
+			t.Fatalf("post with an unknown attachment: %d %v; want an attachment_uuids error", status, body)
+		}
+		_, body = author.do("GET", "/feed", nil)
+		if posts, _ := dataOf(t, body)["posts"].([]any); len(posts) != 0 {
+			t.Errorf("failed post was stored: %v", posts)
+		}
+
+		status, body = author.do("POST", "/posts", map[string]any{
+			"title": "t", "content": "c", "attachment_uuids": []string{file},
+		})
+		if status != http.StatusCreated {
+			t.Fatalf("retry: %d %v", status, body)
+		}
+		if attachments, _ := dataOf(t, body)["attachments"].([]any); len(attachments) != 1 {
+			t.Errorf("attachments = %v; want the uploaded file", attachments)
+		}
+	})
+}
+
+func TestSweepUnclaimedAttachments(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, ts *testServer) {
+		author := ts.signUp(t, "author")
+		claimed, unclaimed := author.upload("kept"), author.upload("dropped")
+		if status, body := author.do("POST", "/posts", map[string]any{
+			"title": "t", "content": "c", "attachment_uuids": []string{claimed},
+		}); status != http.StatusCreated {
+			t.Fatalf("post: %d %v", status, body)
+		}
+
+		ttl := ts.server.cfg.Uploads.UnclaimedTTL.Duration()
+		if n, err := ts.server.deleteUnclaimedAttachments(time.Now().Add(ttl - time.Minute)); err != nil || n != 0 {
+			t.Fatalf("before the TTL: deleted %d, %v; want 0", n, err)
+		}
+		if n, err := ts.server.deleteUnclaimedAttachments(time.Now().Add(ttl + time.Minute)); err != nil || n != 1 {
+			t.Fatalf("after the TTL: deleted %d, %v; want 1", n, err)
+		}
+
+		if _, err := ts.stores.Attachments.GetAttachment(unclaimed); !errors.Is(err, ErrAttachmentNotFound) {
+			t.Errorf("unclaimed attachment: %v; want ErrAttachmentNotFound", err)
+		}
+		if _, err := ts.server.blobs.Open(unclaimed); !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("unclaimed blob: %v; want ErrBlobNotFound", err)
+		}
+		if _, err := ts.server.blobs.Open(claimed); err != nil {
+			t.Errorf("claimed blob: %v", err)
+		}
+	})
+}
@@ -4,10 +4,26 @@ import "context"
 
 type contextKey string
 
-const userContextKey = contextKey("userUUID")
+const (
+	userContextKey    = contextKey("userUUID")
+	sessionContextKey = contextKey("session")
+	roleContextKey    = contextKey("role")
+)
 
 // Helper to get user UUID from context
 func UserUUIDFromContext(ctx context.Context) (string, bool) {
 	userUUID, ok := ctx.Value(userContextKey).(string)
 	return userUUID, ok
 }
+
+// Helper to get the authenticated user's role from context
+func RoleFromContext(ctx context.Context) (Role, bool) {
+	role, ok := ctx.Value(roleContextKey).(Role)
+	return role, ok
+}
+
+// Helper to get the authenticated session from context
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	session, ok := ctx.Value(sessionContextKey).(*Session)
+	return session, ok
+}
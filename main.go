@@ -1,36 +1,125 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
-
-	"github.com/gorilla/mux"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	db, err := InitDB("forum.db")
+	if len(os.Args) > 1 && os.Args[1] == "promote-admin" {
+		if err := runPromoteAdmin(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg, err := LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
+	if err := run(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves until SIGINT or SIGTERM, then shuts down in order: stop
+// accepting connections and finish in-flight requests, close every
+// WebSocket with a "server restarting" frame, then close the database
+func run(cfg *Config) error {
+	db, err := InitDB(cfg.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
 	defer db.Close()
 
-	r := mux.NewRouter()
+	blobs, err := NewDiskBlobStore(cfg.Uploads.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to prepare uploads directory: %w", err)
+	}
+
+	hub := NewHub()
+	go hub.Run()
+
+	server := NewServer(cfg, NewSQLiteStores(db), blobs, hub)
+
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           server.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         serverTLSConfig(),
+	}
+
+	// Optional plain HTTP listener that only redirects to HTTPS
+	var redirectSrv *http.Server
+	if cfg.RedirectAddr != "" {
+		redirectSrv = &http.Server{
+			Addr:              cfg.RedirectAddr,
+			Handler:           RedirectToHTTPS(cfg.Addr),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	r.HandleFunc("/register", RegisterHandler(db)).Methods("POST")
-	r.HandleFunc("/login", LoginHandler(db)).Methods("POST")
-	r.Handle("/logout", AuthMiddleware(db, LogoutHandler(db))).Methods("POST")
-	r.HandleFunc("/feed", PostFeedHandler(db)).Methods("GET")
-	r.Handle("/posts", AuthMiddleware(db, CreatePostHandler(db))).Methods("POST")
-	r.Handle("/comments", AuthMiddleware(db, CreateCommentHandler(db))).Methods("POST")
-	r.Handle("/ws", AuthMiddleware(db, WebSocketHandler(db))).Methods("GET")
-	r.Handle("/messages", AuthMiddleware(db, GetMessagesHandler(db))).Methods("GET")
+	go server.SweepUnclaimedAttachments(ctx)
 
-	go handleMessages()
 	// Start server
-	log.Println("Starting server on http://localhost:8080")
-	err = http.ListenAndServe(":8080", r)
-	if err != nil {
-		log.Fatalf("Server failed: %v", err)
+	serveErr := make(chan error, 2)
+	go func() {
+		if cfg.TLSEnabled() {
+			log.Printf("Starting server on %s (HTTPS)", cfg.Addr)
+			serveErr <- srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+			return
+		}
+		log.Printf("Starting server on %s", cfg.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+	if redirectSrv != nil {
+		go func() {
+			log.Printf("Redirecting HTTP on %s to HTTPS", cfg.RedirectAddr)
+			serveErr <- redirectSrv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("server failed: %w", err)
+	case <-ctx.Done():
 	}
+	stop()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration())
+	defer cancel()
+
+	if redirectSrv != nil {
+		if err := redirectSrv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Redirect shutdown: %v", err)
+		}
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("WebSocket drain: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		return fmt.Errorf("closing database: %w", err)
+	}
+
+	log.Println("Server stopped")
+	return nil
 }
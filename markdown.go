@@ -0,0 +1,726 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Markdown rendering for posts and comments. A CommonMark subset is
+// supported: paragraphs, ATX headings, thematic breaks, block quotes,
+// bullet and ordered lists, fenced code blocks, code spans, emphasis,
+// strong emphasis, links, autolinks, backslash escapes and hard line
+// breaks. Raw HTML in the source is escaped like any other text, so the
+// output only holds tags the renderer writes itself, and those are
+// filtered through markdownPolicy.
+
+// markdownPolicy lists the tags the renderer may emit and the attributes
+// allowed on each
+var markdownPolicy = map[string]map[string]bool{
+	"p": {}, "br": {}, "hr": {}, "blockquote": {}, "pre": {}, "code": {},
+	"em": {}, "strong": {}, "ul": {}, "li": {},
+	"h1": {}, "h2": {}, "h3": {}, "h4": {}, "h5": {}, "h6": {},
+	"ol": {"start": true},
+	"a":  {"href": true, "title": true, "rel": true},
+}
+
+// allowedURLSchemes may appear in links; relative URLs are always allowed
+var allowedURLSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+const (
+	// Nesting limit for block quotes, lists and emphasis; deeper markup is
+	// rendered as text
+	maxMarkdownDepth = 16
+	// Longest link destination or autolink looked for, in code points
+	maxLinkLength = 2048
+)
+
+// renderMarkdown converts Markdown to HTML that is safe to insert into a page
+func renderMarkdown(src string) string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\r", "\n")
+	lines := strings.Split(src, "\n")
+	for i, line := range lines {
+		lines[i] = expandLeadingTabs(line)
+	}
+
+	var r markdownRenderer
+	r.blocks(lines, 0, false)
+	return r.b.String()
+}
+
+// renderPosts fills ContentHTML from each post's Content
+func renderPosts(posts []Post) {
+	for i := range posts {
+		posts[i].ContentHTML = renderMarkdown(posts[i].Content)
+	}
+}
+
+func renderComments(comments []Comment) {
+	for i := range comments {
+		comments[i].ContentHTML = renderMarkdown(comments[i].Content)
+	}
+}
+
+type markdownRenderer struct {
+	b strings.Builder
+}
+
+// open writes a start tag if the policy allows it, keeping only allowed
+// attributes; attrs alternate names and values
+func (r *markdownRenderer) open(tag string, attrs ...string) {
+	allowed, ok := markdownPolicy[tag]
+	if !ok {
+		return
+	}
+	r.b.WriteString("<" + tag)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if allowed[attrs[i]] {
+			r.b.WriteString(" " + attrs[i] + `="` + html.EscapeString(attrs[i+1]) + `"`)
+		}
+	}
+	r.b.WriteString(">")
+}
+
+func (r *markdownRenderer) close(tag string) {
+	if _, ok := markdownPolicy[tag]; ok {
+		r.b.WriteString("</" + tag + ">")
+	}
+}
+
+func (r *markdownRenderer) text(s string) {
+	r.b.WriteString(html.EscapeString(s))
+}
+
+// Block structure
+
+var (
+	thematicBreakPattern = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fencePattern         = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})(.*)$")
+	quotePattern         = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+	bulletPattern        = regexp.MustCompile(`^( {0,3})([-+*])( +)(.*)$`)
+	orderedPattern       = regexp.MustCompile(`^( {0,3})(\d{1,9})([.)])( +)(.*)$`)
+)
+
+func expandLeadingTabs(line string) string {
+	i := 0
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	if !strings.Contains(line[:i], "\t") {
+		return line
+	}
+	width := 0
+	for _, c := range line[:i] {
+		if c == '\t' {
+			width += 4 - width%4
+		} else {
+			width++
+		}
+	}
+	return strings.Repeat(" ", width) + line[i:]
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// openingFence returns the fence and its indentation if line opens a fenced
+// code block
+func openingFence(line string) (indent int, fence string, ok bool) {
+	m := fencePattern.FindStringSubmatch(line)
+	if m == nil || (m[2][0] == '`' && strings.Contains(m[3], "`")) {
+		return 0, "", false
+	}
+	return len(m[1]), m[2], true
+}
+
+// headingLevel returns the level and text of an ATX heading
+func headingLevel(line string) (int, string, bool) {
+	if indentOf(line) > 3 {
+		return 0, "", false
+	}
+	line = strings.TrimLeft(line, " ")
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || (level < len(line) && line[level] != ' ' && line[level] != '\t') {
+		return 0, "", false
+	}
+
+	text := strings.TrimSpace(line[level:])
+	// Drop an optional closing sequence of #s
+	if trimmed := strings.TrimRight(text, "#"); trimmed == "" || strings.HasSuffix(trimmed, " ") || strings.HasSuffix(trimmed, "\t") {
+		text = strings.TrimSpace(trimmed)
+	}
+	return level, text, true
+}
+
+// listItem is the first line of a list item
+type listItem struct {
+	ordered bool
+	marker  byte // bullet character, or . or ) after the number
+	start   int
+	indent  int // column where the item's content starts
+	content string
+}
+
+func parseListItem(line string) (listItem, bool) {
+	if m := bulletPattern.FindStringSubmatch(line); m != nil {
+		return listItem{marker: m[2][0], indent: listContentIndent(len(m[1])+1, len(m[3])), content: m[4]}, true
+	}
+	if m := orderedPattern.FindStringSubmatch(line); m != nil {
+		start, _ := strconv.Atoi(m[2])
+		return listItem{
+			ordered: true,
+			marker:  m[3][0],
+			start:   start,
+			indent:  listContentIndent(len(m[1])+len(m[2])+1, len(m[4])),
+			content: m[5],
+		}, true
+	}
+	return listItem{}, false
+}
+
+// listContentIndent follows CommonMark: five or more spaces after the
+// marker mean the content is indented code, which counts from one space
+func listContentIndent(markerEnd, spaces int) int {
+	if spaces > 4 {
+		spaces = 1
+	}
+	return markerEnd + spaces
+}
+
+func (item listItem) sameList(other listItem) bool {
+	return item.ordered == other.ordered && item.marker == other.marker
+}
+
+// startsBlock reports whether line interrupts a paragraph
+func startsBlock(line string) bool {
+	if _, _, ok := openingFence(line); ok {
+		return true
+	}
+	if _, _, ok := headingLevel(line); ok {
+		return true
+	}
+	if _, ok := parseListItem(line); ok {
+		return true
+	}
+	return thematicBreakPattern.MatchString(line) || quotePattern.MatchString(line)
+}
+
+// blocks renders lines as a sequence of blocks. In tight lists paragraphs
+// are written without <p> tags.
+func (r *markdownRenderer) blocks(lines []string, depth int, tight bool) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if isBlank(line) {
+			i++
+			continue
+		}
+
+		if indent, fence, ok := openingFence(line); ok {
+			i = r.fencedCode(lines, i, indent, fence)
+		} else if level, text, ok := headingLevel(line); ok {
+			tag := "h" + strconv.Itoa(level)
+			r.open(tag)
+			r.inline(text, depth)
+			r.close(tag)
+			r.b.WriteString("\n")
+			i++
+		} else if thematicBreakPattern.MatchString(line) {
+			r.open("hr")
+			r.b.WriteString("\n")
+			i++
+		} else if _, ok := parseListItem(line); ok && depth < maxMarkdownDepth {
+			i = r.list(lines, i, depth)
+		} else if quotePattern.MatchString(line) && depth < maxMarkdownDepth {
+			i = r.blockquote(lines, i, depth)
+		} else {
+			i = r.paragraph(lines, i, depth, tight)
+		}
+	}
+}
+
+func (r *markdownRenderer) fencedCode(lines []string, i, indent int, fence string) int {
+	var code []string
+	for i++; i < len(lines); i++ {
+		if closesFence(lines[i], fence) {
+			i++
+			break
+		}
+		line := lines[i]
+		line = line[min(indent, indentOf(line)):]
+		code = append(code, line)
+	}
+
+	r.open("pre")
+	r.open("code")
+	if len(code) > 0 {
+		r.text(strings.Join(code, "\n") + "\n")
+	}
+	r.close("code")
+	r.close("pre")
+	r.b.WriteString("\n")
+	return i
+}
+
+// closesFence reports whether line is a run of the fence character at least
+// as long as fence
+func closesFence(line, fence string) bool {
+	if indentOf(line) > 3 {
+		return false
+	}
+	line = strings.TrimRight(strings.TrimLeft(line, " "), " \t")
+	return len(line) >= len(fence) && strings.Trim(line, fence[:1]) == ""
+}
+
+func (r *markdownRenderer) blockquote(lines []string, i, depth int) int {
+	var inner []string
+	for ; i < len(lines) && !isBlank(lines[i]); i++ {
+		if m := quotePattern.FindStringSubmatch(lines[i]); m != nil {
+			inner = append(inner, m[1])
+		} else if len(inner) > 0 && !startsBlock(lines[i]) {
+			// Lazy continuation of a quoted paragraph
+			inner = append(inner, lines[i])
+		} else {
+			break
+		}
+	}
+
+	r.open("blockquote")
+	r.b.WriteString("\n")
+	r.blocks(inner, depth+1, false)
+	r.close("blockquote")
+	r.b.WriteString("\n")
+	return i
+}
+
+func (r *markdownRenderer) list(lines []string, i, depth int) int {
+	first, _ := parseListItem(lines[i])
+	var items [][]string
+	loose := false
+
+items:
+	for i < len(lines) {
+		item, ok := parseListItem(lines[i])
+		if !ok || !item.sameList(first) || thematicBreakPattern.MatchString(lines[i]) {
+			break
+		}
+		body := []string{item.content}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if isBlank(line) {
+				next := i
+				for next < len(lines) && isBlank(lines[next]) {
+					next++
+				}
+				if next < len(lines) && indentOf(lines[next]) >= item.indent {
+					// A later paragraph of the same item
+					body = append(body, lines[i:next]...)
+					loose = true
+					i = next - 1
+					continue
+				}
+				items = append(items, body)
+				if next < len(lines) {
+					if following, ok := parseListItem(lines[next]); ok && following.sameList(first) {
+						loose = true
+						i = next
+						continue items
+					}
+				}
+				i = next
+				break items
+			}
+			if indentOf(line) >= item.indent {
+				body = append(body, line[item.indent:])
+				continue
+			}
+			if startsBlock(line) {
+				break
+			}
+			// Lazy continuation of the item's paragraph
+			body = append(body, strings.TrimLeft(line, " "))
+		}
+		items = append(items, body)
+	}
+
+	tag := "ul"
+	var attrs []string
+	if first.ordered {
+		tag = "ol"
+		if first.start != 1 {
+			attrs = []string{"start", strconv.Itoa(first.start)}
+		}
+	}
+
+	r.open(tag, attrs...)
+	r.b.WriteString("\n")
+	for _, body := range items {
+		r.open("li")
+		r.blocks(body, depth+1, !loose)
+		r.close("li")
+		r.b.WriteString("\n")
+	}
+	r.close(tag)
+	r.b.WriteString("\n")
+	return i
+}
+
+func (r *markdownRenderer) paragraph(lines []string, i, depth int, tight bool) int {
+	var text []string
+	for start := i; i < len(lines) && !isBlank(lines[i]) && (i == start || !startsBlock(lines[i])); i++ {
+		text = append(text, strings.TrimLeft(lines[i], " "))
+	}
+	for j := 0; j < len(text)-1; j++ {
+		// Two trailing spaces make a hard break, written the same way as a
+		// trailing backslash
+		if strings.HasSuffix(text[j], "  ") {
+			text[j] = strings.TrimRight(text[j], " ") + "\\"
+		} else {
+			text[j] = strings.TrimRight(text[j], " ")
+		}
+	}
+	text[len(text)-1] = strings.TrimRight(text[len(text)-1], " ")
+
+	if !tight {
+		r.open("p")
+	}
+	r.inline(strings.Join(text, "\n"), depth)
+	if !tight {
+		r.close("p")
+		r.b.WriteString("\n")
+	}
+	return i
+}
+
+// Inline content
+
+// delimiterRun is a run of identical delimiter characters
+type delimiterRun struct {
+	start, length int
+}
+
+// inlineText indexes the delimiters of one block's text up front, so every
+// search for a closing delimiter is a binary search and rendering stays fast
+// on hostile input
+type inlineText struct {
+	src       []rune
+	backticks map[int][]int           // start positions of backtick runs by length
+	closers   map[rune][]delimiterRun // runs of * or _ that can close emphasis
+	strong    map[rune][]delimiterRun // the closers long enough for strong emphasis
+	brackets  map[int]int             // [ position to its matching ]
+}
+
+func newInlineText(s string) *inlineText {
+	t := &inlineText{
+		src:       []rune(s),
+		backticks: map[int][]int{},
+		closers:   map[rune][]delimiterRun{},
+		strong:    map[rune][]delimiterRun{},
+		brackets:  map[int]int{},
+	}
+
+	var open []int
+	for i := 0; i < len(t.src); {
+		c := t.src[i]
+		switch c {
+		case '\\':
+			i += 2
+			continue
+		case '[':
+			open = append(open, i)
+		case ']':
+			if len(open) > 0 {
+				t.brackets[open[len(open)-1]] = i
+				open = open[:len(open)-1]
+			}
+		case '`', '*', '_':
+			n := t.runLength(i, len(t.src))
+			if c == '`' {
+				t.backticks[n] = append(t.backticks[n], i)
+			} else if t.canClose(i, n) {
+				t.closers[c] = append(t.closers[c], delimiterRun{i, n})
+				if n >= 2 {
+					t.strong[c] = append(t.strong[c], delimiterRun{i, n})
+				}
+			}
+			i += n
+			continue
+		}
+		i++
+	}
+	return t
+}
+
+func (t *inlineText) runLength(i, end int) int {
+	n := 1
+	for i+n < end && t.src[i+n] == t.src[i] {
+		n++
+	}
+	return n
+}
+
+// canClose reports whether the run at i can end emphasis: it must follow
+// non-space text and, for _, not be followed by a letter or digit
+func (t *inlineText) canClose(i, n int) bool {
+	if i == 0 || unicode.IsSpace(t.src[i-1]) {
+		return false
+	}
+	if t.src[i] == '_' && i+n < len(t.src) && isAlphanumeric(t.src[i+n]) {
+		return false
+	}
+	return true
+}
+
+// canOpen reports whether the run at i of length n can start emphasis
+func (t *inlineText) canOpen(i, n, end int) bool {
+	if i+n >= end || unicode.IsSpace(t.src[i+n]) {
+		return false
+	}
+	if t.src[i] == '_' && i > 0 && isAlphanumeric(t.src[i-1]) {
+		return false
+	}
+	return true
+}
+
+func isAlphanumeric(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+func isASCIIPunctuation(c rune) bool {
+	return c < 128 && (unicode.IsPunct(c) || unicode.IsSymbol(c))
+}
+
+func (r *markdownRenderer) inline(s string, depth int) {
+	t := newInlineText(s)
+	r.spans(t, 0, len(t.src), depth, false)
+}
+
+// spans renders t.src[start:end]. Inside link text no further links are
+// recognised.
+func (r *markdownRenderer) spans(t *inlineText, start, end, depth int, inLink bool) {
+	src := t.src
+	for i := start; i < end; {
+		switch c := src[i]; {
+		case c == '\\' && i+1 < end && src[i+1] == '\n':
+			r.open("br")
+			r.b.WriteString("\n")
+			i += 2
+		case c == '\\' && i+1 < end && isASCIIPunctuation(src[i+1]):
+			r.text(string(src[i+1]))
+			i += 2
+		case c == '`':
+			i = r.codeSpan(t, i, end)
+		case c == '<' && !inLink:
+			i = r.autolink(t, i, end)
+		case c == '[' && !inLink && depth < maxMarkdownDepth:
+			i = r.link(t, i, end, depth)
+		case (c == '*' || c == '_') && depth < maxMarkdownDepth:
+			i = r.emphasis(t, i, end, depth, inLink)
+		default:
+			j := i + 1
+			for j < end && !strings.ContainsRune("\\`<[*_", src[j]) {
+				j++
+			}
+			r.text(string(src[i:j]))
+			i = j
+		}
+	}
+}
+
+func (r *markdownRenderer) codeSpan(t *inlineText, i, end int) int {
+	n := t.runLength(i, end)
+	starts := t.backticks[n]
+	k := sort.SearchInts(starts, i+n)
+	if k == len(starts) || starts[k]+n > end || t.runLength(starts[k], end) != n {
+		r.text(string(t.src[i : i+n]))
+		return i + n
+	}
+
+	code := strings.ReplaceAll(string(t.src[i+n:starts[k]]), "\n", " ")
+	if len(code) > 1 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+		code = code[1 : len(code)-1]
+	}
+	r.open("code")
+	r.text(code)
+	r.close("code")
+	return starts[k] + n
+}
+
+func (r *markdownRenderer) emphasis(t *inlineText, i, end, depth int, inLink bool) int {
+	c := t.src[i]
+	n := t.runLength(i, end)
+	if !t.canOpen(i, n, end) {
+		r.text(string(t.src[i : i+n]))
+		return i + n
+	}
+
+	// Prefer strong emphasis. A longer opening run keeps its extra
+	// delimiters inside, where they can open nested emphasis that closes
+	// against the start of the closing run.
+	for _, size := range []int{2, 1} {
+		if n < size {
+			continue
+		}
+		closer, ok := t.findCloser(c, i+n, end, size)
+		if !ok {
+			continue
+		}
+		tag := "em"
+		if size == 2 {
+			tag = "strong"
+		}
+		r.open(tag)
+		r.spans(t, i+size, closer, depth+1, inLink)
+		r.close(tag)
+		return closer + size
+	}
+
+	r.text(string(t.src[i : i+n]))
+	return i + n
+}
+
+// findCloser returns where the last size delimiters of the first closing
+// run of c between from and end begin
+func (t *inlineText) findCloser(c rune, from, end, size int) (int, bool) {
+	runs := t.closers[c]
+	if size == 2 {
+		runs = t.strong[c]
+	}
+	k := sort.Search(len(runs), func(k int) bool { return runs[k].start >= from })
+	if k == len(runs) || runs[k].start >= end {
+		return 0, false
+	}
+	// Only a run straddling end can be cut short by it
+	length := min(runs[k].length, end-runs[k].start)
+	if length < size {
+		return 0, false
+	}
+	return runs[k].start + length - size, true
+}
+
+// link renders [text](destination "title"). Anything that does not parse as
+// a link, or links to an unsafe URL, is written as text.
+func (r *markdownRenderer) link(t *inlineText, i, end, depth int) int {
+	src := t.src
+	closeBracket, ok := t.brackets[i]
+	if !ok || closeBracket+1 >= end || src[closeBracket+1] != '(' {
+		r.text("[")
+		return i + 1
+	}
+
+	dest, title, next, ok := parseLinkTarget(src, closeBracket+2, end)
+	if !ok {
+		r.text("[")
+		return i + 1
+	}
+	if !safeURL(dest) {
+		// Keep the text, drop the link
+		r.spans(t, i+1, closeBracket, depth+1, true)
+		return next
+	}
+
+	attrs := []string{"href", dest, "rel", "nofollow"}
+	if title != "" {
+		attrs = append(attrs, "title", title)
+	}
+	r.open("a", attrs...)
+	r.spans(t, i+1, closeBracket, depth+1, true)
+	r.close("a")
+	return next
+}
+
+// parseLinkTarget reads `destination "title")` starting at i and returns the
+// position after the closing parenthesis
+func parseLinkTarget(src []rune, i, end int) (dest, title string, next int, ok bool) {
+	limit := min(end, i+maxLinkLength)
+	for i < limit && src[i] == ' ' {
+		i++
+	}
+
+	destStart, parens := i, 0
+	for ; i < limit; i++ {
+		c := src[i]
+		if c == '(' {
+			parens++
+		} else if c == ')' {
+			if parens == 0 {
+				break
+			}
+			parens--
+		} else if c <= ' ' || unicode.IsSpace(c) || unicode.IsControl(c) {
+			break
+		}
+	}
+	destEnd := i
+
+	for i < limit && src[i] == ' ' {
+		i++
+	}
+	titleStart, titleEnd := 0, 0
+	if i < limit && (src[i] == '"' || src[i] == '\'') && destEnd > destStart {
+		quote := src[i]
+		titleStart = i + 1
+		for i = titleStart; i < limit && src[i] != quote; i++ {
+		}
+		if i == limit {
+			return "", "", 0, false
+		}
+		titleEnd = i
+		for i++; i < limit && src[i] == ' '; i++ {
+		}
+	}
+	if i >= limit || src[i] != ')' {
+		return "", "", 0, false
+	}
+	return string(src[destStart:destEnd]), string(src[titleStart:titleEnd]), i + 1, true
+}
+
+// autolink renders <https://example.com>
+func (r *markdownRenderer) autolink(t *inlineText, i, end int) int {
+	src := t.src
+	limit := min(end, i+maxLinkLength)
+	j := i + 1
+	for j < limit && src[j] != '>' && src[j] != '<' && !unicode.IsSpace(src[j]) && !unicode.IsControl(src[j]) {
+		j++
+	}
+
+	dest := string(src[i+1 : min(j, end)])
+	if j >= limit || src[j] != '>' || !strings.Contains(dest, ":") || !safeURL(dest) {
+		r.text("<")
+		return i + 1
+	}
+
+	r.open("a", "href", dest, "rel", "nofollow")
+	r.text(dest)
+	r.close("a")
+	return j + 1
+}
+
+// safeURL reports whether dest may be used as a link target: relative, or
+// absolute with an allowed scheme
+func safeURL(dest string) bool {
+	if dest == "" {
+		return false
+	}
+	for _, c := range dest {
+		if unicode.IsSpace(c) || unicode.IsControl(c) {
+			return false
+		}
+	}
+	scheme, _, found := strings.Cut(dest, ":")
+	if !found || strings.ContainsAny(scheme, "/?#") {
+		return true
+	}
+	return allowedURLSchemes[strings.ToLower(scheme)]
+}
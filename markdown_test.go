@@ -0,0 +1,136 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+// The renderer escapes all text, so every < in its output starts a tag it
+// wrote itself, always in this form
+var renderedTagPattern = regexp.MustCompile(`^<(/?)([a-z0-9]+)((?: [a-z]+="[^"<>]*")*)>`)
+var renderedAttrPattern = regexp.MustCompile(` ([a-z]+)="([^"]*)"`)
+
+type renderedTag struct {
+	name    string
+	closing bool
+	attrs   map[string]string
+}
+
+// renderedTags lists the tags in out, failing the test on any < that does
+// not start a well-formed tag
+func renderedTags(t *testing.T, out string) []renderedTag {
+	t.Helper()
+	var tags []renderedTag
+	for i := strings.IndexByte(out, '<'); i >= 0; i = strings.IndexByte(out, '<') {
+		out = out[i:]
+		m := renderedTagPattern.FindStringSubmatch(out)
+		if m == nil {
+			t.Fatalf("malformed markup at %q", out[:min(len(out), 40)])
+		}
+		tag := renderedTag{name: m[2], closing: m[1] == "/", attrs: map[string]string{}}
+		for _, a := range renderedAttrPattern.FindAllStringSubmatch(m[3], -1) {
+			tag.attrs[a[1]] = html.UnescapeString(a[2])
+		}
+		tags = append(tags, tag)
+		out = out[len(m[0]):]
+	}
+	return tags
+}
+
+// urlScheme returns the scheme a browser would see in an attribute value,
+// which ignores case, leading spaces and embedded tabs and newlines
+func urlScheme(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, strings.TrimLeftFunc(value, func(r rune) bool { return r <= ' ' }))
+	scheme, _, found := strings.Cut(value, ":")
+	if !found || strings.ContainsAny(scheme, "/?#") {
+		return ""
+	}
+	return scheme
+}
+
+func TestRenderMarkdownPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"raw html is escaped", `<script>alert(1)</script>`, "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"inline event handler", `<img src=x onerror=alert(1)>`, "<p>&lt;img src=x onerror=alert(1)&gt;</p>\n"},
+		{"emphasis", `*a* **b**`, "<p><em>a</em> <strong>b</strong></p>\n"},
+		{"heading", `## Title`, "<h2>Title</h2>\n"},
+		{"ordered list start", "3. a\n4. b", "<ol start=\"3\">\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"code", "`<b>`", "<p><code>&lt;b&gt;</code></p>\n"},
+		{"link", `[a](https://example.com "T")`, "<p><a href=\"https://example.com\" rel=\"nofollow\" title=\"T\">a</a></p>\n"},
+		{"relative link", `[a](/posts/1)`, "<p><a href=\"/posts/1\" rel=\"nofollow\">a</a></p>\n"},
+		{"autolink", `<mailto:a@example.com>`, "<p><a href=\"mailto:a@example.com\" rel=\"nofollow\">mailto:a@example.com</a></p>\n"},
+		{"quote in title", `[a](/x "say \"hi")`, "<p>[a](/x &#34;say &#34;hi&#34;)</p>\n"},
+		{"javascript link", `[a](javascript:alert(1))`, "<p>a</p>\n"},
+		{"mixed case scheme", `[a](JaVaScRiPt:alert(1))`, "<p>a</p>\n"},
+		{"data link", `[a](data:text/html,<b>)`, "<p>a</p>\n"},
+		{"vbscript autolink", `<VBScript:msgbox>`, "<p>&lt;VBScript:msgbox&gt;</p>\n"},
+		{"entity in scheme", `[a](javascript&#58;alert(1))`, "<p><a href=\"javascript&amp;#58;alert(1)\" rel=\"nofollow\">a</a></p>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderMarkdown(tt.src); got != tt.want {
+				t.Errorf("renderMarkdown(%q)\n got %q\nwant %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderMarkdownLinksAreNofollow(t *testing.T) {
+	for _, src := range []string{
+		`[a](https://example.com)`,
+		`[a](/relative)`,
+		`<https://example.com>`,
+		"- [nested *a*](http://x)\n> [q](http://y)",
+	} {
+		for _, tag := range renderedTags(t, renderMarkdown(src)) {
+			if tag.name == "a" && !tag.closing && tag.attrs["rel"] != "nofollow" {
+				t.Errorf("%q: link without rel=\"nofollow\": %v", src, tag.attrs)
+			}
+		}
+	}
+}
+
+func FuzzRenderMarkdown(f *testing.F) {
+	for _, seed := range []string{
+		"# h\n\n*a* **b** `c`\n\n- x\n- y\n\n1. z\n\n> q\n\n```\ncode\n```\n---",
+		`[a](https://example.com "t") <http://x> <mailto:a@b>`,
+		`[a](javascript:alert(1)) [b](DATA:text/html,x) <vbscript:x> [c](jAvAsCrIpT:x)`,
+		`[a](java	script:x) [b]( javascript:x) [c](javascript&colon;x)`,
+		`<script>x</script><img src=x onerror=y><a href="javascript:x">`,
+		strings.Repeat("[a](", 50) + strings.Repeat("*_", 50),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		for _, tag := range renderedTags(t, renderMarkdown(src)) {
+			allowed, ok := markdownPolicy[tag.name]
+			if !ok {
+				t.Fatalf("tag <%s> is not in markdownPolicy", tag.name)
+			}
+			for name, value := range tag.attrs {
+				if !allowed[name] {
+					t.Fatalf("attribute %s on <%s> is not in markdownPolicy", name, tag.name)
+				}
+				if name != "href" && name != "src" {
+					continue
+				}
+				switch urlScheme(value) {
+				case "javascript", "data", "vbscript":
+					t.Fatalf("unsafe %s=%q", name, value)
+				}
+			}
+		}
+	})
+}
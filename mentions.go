@@ -0,0 +1,229 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// Mention links part of a text to a user. Start and End are offsets in
+// Unicode code points, End exclusive, and cover the whole "@nickname".
+type Mention struct {
+	UserUUID string `json:"user_uuid"`
+	Nickname string `json:"nickname"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+}
+
+// mentionCandidate is an "@word" that may name a user
+type mentionCandidate struct {
+	start, end int // code points, including the @
+	nickname   string
+}
+
+func isNicknameRune(r rune) bool {
+	return r < 128 && (r == '_' || r == '.' || r == '-' ||
+		('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9'))
+}
+
+// parseMentions finds "@nickname" tokens. An @ only starts a mention at the
+// beginning of the text or after a character that cannot be part of a
+// nickname, so addresses like a@b.com are skipped.
+func parseMentions(content string) []mentionCandidate {
+	runes := []rune(content)
+	var found []mentionCandidate
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '@' || (i > 0 && isNicknameRune(runes[i-1])) {
+			continue
+		}
+		end := i + 1
+		for end < len(runes) && isNicknameRune(runes[end]) {
+			end++
+		}
+		if end-i-1 >= minNicknameLength {
+			found = append(found, mentionCandidate{start: i, end: end, nickname: string(runes[i+1 : end])})
+		}
+		i = end - 1
+	}
+	return found
+}
+
+// lookupNames are the nicknames a candidate may stand for: the whole token
+// and, since "@bob." usually ends a sentence, the token without trailing
+// dots and hyphens
+func (c mentionCandidate) lookupNames() []string {
+	names := []string{NormalizeNickname(c.nickname)}
+	if trimmed := strings.TrimRight(c.nickname, ".-"); trimmed != c.nickname && len(trimmed) >= minNicknameLength {
+		names = append(names, NormalizeNickname(trimmed))
+	}
+	return names
+}
+
+// resolveMentions returns the mentions in each text, in order. Tokens that
+// do not name an existing user are left out.
+func (s *Server) resolveMentions(texts ...string) ([][]Mention, error) {
+	candidates := make([][]mentionCandidate, len(texts))
+	var names []string
+	for i, text := range texts {
+		candidates[i] = parseMentions(text)
+		for _, c := range candidates[i] {
+			names = append(names, c.lookupNames()...)
+		}
+	}
+
+	users := map[string]User{}
+	if len(names) > 0 {
+		var err error
+		if users, err = s.users.GetUsersByNickname(names); err != nil {
+			return nil, err
+		}
+	}
+
+	mentions := make([][]Mention, len(texts))
+	for i := range texts {
+		mentions[i] = []Mention{}
+		for _, c := range candidates[i] {
+			for _, name := range c.lookupNames() {
+				u, ok := users[name]
+				if !ok {
+					continue
+				}
+				// A trimmed match stops before the trailing punctuation
+				end := c.start + 1 + len(name)
+				mentions[i] = append(mentions[i], Mention{UserUUID: u.UUID, Nickname: u.Nickname, Start: c.start, End: end})
+				break
+			}
+		}
+	}
+	return mentions, nil
+}
+
+// attachPostMentions fills Mentions for each post's content
+func (s *Server) attachPostMentions(posts []Post) error {
+	texts := make([]string, len(posts))
+	for i := range posts {
+		texts[i] = posts[i].Content
+	}
+	mentions, err := s.resolveMentions(texts...)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].Mentions = mentions[i]
+	}
+	return nil
+}
+
+func (s *Server) attachCommentMentions(comments []Comment) error {
+	texts := make([]string, len(comments))
+	for i := range comments {
+		texts[i] = comments[i].Content
+	}
+	mentions, err := s.resolveMentions(texts...)
+	if err != nil {
+		return err
+	}
+	for i := range comments {
+		comments[i].Mentions = mentions[i]
+	}
+	return nil
+}
+
+func (s *Server) attachMessageMentions(messages []Message) error {
+	texts := make([]string, len(messages))
+	for i := range messages {
+		texts[i] = messages[i].Content
+	}
+	mentions, err := s.resolveMentions(texts...)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Mentions = participantMentions(messages[i], mentions[i])
+	}
+	return nil
+}
+
+// participantMentions keeps the mentions of a message's sender or
+// recipient, so a private message never notifies an outsider
+func participantMentions(msg Message, mentions []Mention) []Mention {
+	kept := []Mention{}
+	for _, m := range mentions {
+		if m.UserUUID == msg.From || m.UserUUID == msg.To {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// recordMentions stores who is mentioned in a piece of content and notifies
+// the users mentioned there for the first time, so editing a post does not
+// repeat earlier notifications. Failures are logged, not returned.
+func (s *Server) recordMentions(mentions []Mention, n Notification) {
+	if len(mentions) == 0 {
+		return
+	}
+	userUUIDs := make([]string, 0, len(mentions))
+	for _, m := range mentions {
+		userUUIDs = append(userUUIDs, m.UserUUID)
+	}
+
+	added, err := s.mentions.AddMentions(n.TargetType, n.TargetUUID, userUUIDs, time.Now())
+	if err != nil {
+		log.Printf("Error saving mentions: %v", err)
+		return
+	}
+	n.Type = NotifyMention
+	for _, userUUID := range added {
+		n.UserUUID = userUUID
+		s.notify(n)
+	}
+}
+
+// mentionPost resolves and records the mentions in a new or edited post
+func (s *Server) mentionPost(post *Post) {
+	mentions, err := s.resolveMentions(post.Content)
+	if err != nil {
+		log.Printf("Error resolving mentions: %v", err)
+		return
+	}
+	post.Mentions = mentions[0]
+	s.recordMentions(post.Mentions, Notification{
+		ActorUUID:  post.AuthorUUID,
+		TargetType: "post",
+		TargetUUID: post.UUID,
+		PostUUID:   post.UUID,
+		Preview:    preview(post.Title),
+	})
+}
+
+func (s *Server) mentionComment(comment *Comment) {
+	mentions, err := s.resolveMentions(comment.Content)
+	if err != nil {
+		log.Printf("Error resolving mentions: %v", err)
+		return
+	}
+	comment.Mentions = mentions[0]
+	s.recordMentions(comment.Mentions, Notification{
+		ActorUUID:  comment.AuthorUUID,
+		TargetType: "comment",
+		TargetUUID: comment.UUID,
+		PostUUID:   comment.PostUUID,
+		Preview:    preview(comment.Content),
+	})
+}
+
+func (s *Server) mentionMessage(msg *Message) {
+	mentions, err := s.resolveMentions(msg.Content)
+	if err != nil {
+		log.Printf("Error resolving mentions: %v", err)
+		return
+	}
+	msg.Mentions = participantMentions(*msg, mentions[0])
+	s.recordMentions(msg.Mentions, Notification{
+		ActorUUID:  msg.From,
+		TargetType: "message",
+		TargetUUID: msg.UUID,
+		Preview:    preview(msg.Content),
+	})
+}
@@ -2,27 +2,86 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"crypto/subtle"
 	"net/http"
 )
 
 // Session Middleware for Authentication
-func AuthMiddleware(db *sql.DB, next http.Handler) http.Handler {
+func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session_token")
+		cookie, err := r.Cookie(sessionCookieName)
 		if err != nil {
-			http.Error(w, "Unauthorized: missing session token", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized: missing session token")
 			return
 		}
 
-		session, err := GetSession(db, cookie.Value)
+		session, err := s.sessions.GetSession(cookie.Value)
 		if err != nil {
-			http.Error(w, "Unauthorized: invalid or expired session", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized: invalid or expired session")
+			return
+		}
+		if session.Suspension != nil {
+			writeSuspended(w, session.Suspension)
+			return
+		}
+
+		next.ServeHTTP(w, withSession(r, session))
+	})
+}
+
+// OptionalAuthMiddleware identifies the user when a valid session cookie is
+// present but lets anonymous requests through. Handlers check
+// UserUUIDFromContext to tell the two apart.
+func (s *Server) OptionalAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, err := s.sessions.GetSession(cookie.Value)
+		if err != nil || session.Suspension != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, withSession(r, session))
+	})
+}
+
+// withSession adds the user UUID, role and session to the request context
+func withSession(r *http.Request, session *Session) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, session.UserUUID)
+	ctx = context.WithValue(ctx, roleContextKey, session.Role)
+	ctx = context.WithValue(ctx, sessionContextKey, session)
+	return r.WithContext(ctx)
+}
+
+// CSRFMiddleware rejects state-changing requests whose X-CSRF-Token header
+// does not match the token issued with the session. It must run inside
+// AuthMiddleware so the session is already in the context.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, ok := SessionFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		token := r.Header.Get(csrfHeaderName)
+		if token == "" || session.CSRFToken == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+			writeError(w, http.StatusForbidden, codeInvalidCSRF, "Forbidden: invalid CSRF token")
 			return
 		}
 
-		// Add user UUID to request context
-		ctx := context.WithValue(r.Context(), userContextKey, session.UserUUID)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type NotificationType string
+
+const (
+	NotifyComment  NotificationType = "comment"
+	NotifyReaction NotificationType = "reaction"
+	NotifyMessage  NotificationType = "message"
+	NotifyMention  NotificationType = "mention"
+)
+
+// notificationTypes lists every type a user can switch on or off
+var notificationTypes = []NotificationType{NotifyComment, NotifyReaction, NotifyMessage, NotifyMention}
+
+const (
+	notificationsPageSize = 20
+	maxPreviewRunes       = 100
+)
+
+var ErrNotificationNotFound = errors.New("notification not found")
+
+// Notification tells UserUUID that ActorUUID did something to their content
+type Notification struct {
+	UUID       string           `json:"uuid"`
+	UserUUID   string           `json:"-"`
+	Type       NotificationType `json:"type"`
+	ActorUUID  string           `json:"actor_uuid"`
+	TargetType string           `json:"target_type"` // post, comment or message
+	TargetUUID string           `json:"target_uuid"`
+	PostUUID   string           `json:"post_uuid,omitempty"` // the thread, for comments and reactions
+	Preview    string           `json:"preview"`
+	CreatedAt  time.Time        `json:"created_at"`
+	ReadAt     *time.Time       `json:"read_at,omitempty"`
+}
+
+// NotificationPreferences says which notification types a user receives.
+// Types a user never changed are enabled.
+type NotificationPreferences map[NotificationType]bool
+
+func defaultNotificationPreferences() NotificationPreferences {
+	prefs := NotificationPreferences{}
+	for _, t := range notificationTypes {
+		prefs[t] = true
+	}
+	return prefs
+}
+
+// notificationFrame is pushed over /ws when a notification is created
+type notificationFrame struct {
+	Type         string       `json:"type"`
+	Notification Notification `json:"notification"`
+}
+
+// prepareNotification gives n its UUID and time, or returns nil when the
+// recipient caused it themselves or switched the type off
+func (s *Server) prepareNotification(n Notification) (*Notification, error) {
+	if n.UserUUID == "" || n.UserUUID == n.ActorUUID {
+		return nil, nil
+	}
+
+	prefs, err := s.notifications.GetNotificationPreferences(n.UserUUID)
+	if err != nil {
+		return nil, err
+	}
+	if !prefs[n.Type] {
+		return nil, nil
+	}
+
+	n.UUID = uuid.New().String()
+	n.CreatedAt = time.Now()
+	return &n, nil
+}
+
+// pushNotification sends a stored notification to the recipient's open sockets
+func (s *Server) pushNotification(n Notification) {
+	s.hub.SendToUser(n.UserUUID, notificationFrame{Type: "notification", Notification: n})
+}
+
+// notify stores n for its recipient and pushes it to their open sockets,
+// unless they caused it themselves or switched the type off. Failures are
+// logged; they never fail the action that caused the notification.
+func (s *Server) notify(n Notification) {
+	pending, err := s.prepareNotification(n)
+	if err != nil {
+		log.Printf("Error loading notification preferences: %v", err)
+		return
+	}
+	if pending == nil {
+		return
+	}
+
+	if err := s.notifications.CreateNotification(*pending); err != nil {
+		log.Printf("Error saving notification: %v", err)
+		return
+	}
+	s.pushNotification(*pending)
+}
+
+// preview shortens content for display in a notification
+func preview(content string) string {
+	runes := []rune(content)
+	if len(runes) <= maxPreviewRunes {
+		return content
+	}
+	return string(runes[:maxPreviewRunes-1]) + "…"
+}
+
+// commentNotification is what the post author is told about a new comment;
+// it is stored in the same transaction as the comment
+func (s *Server) commentNotification(post *Post, comment Comment) (*Notification, error) {
+	return s.prepareNotification(Notification{
+		UserUUID:   post.AuthorUUID,
+		Type:       NotifyComment,
+		ActorUUID:  comment.AuthorUUID,
+		TargetType: "comment",
+		TargetUUID: comment.UUID,
+		PostUUID:   post.UUID,
+		Preview:    preview(comment.Content),
+	})
+}
+
+// notifyReaction tells the author of a post or comment the first time a user
+// reacts to it. Switching between like and dislike, or taking a reaction
+// back and reacting again, does not notify them again.
+func (s *Server) notifyReaction(actorUUID string, targetType ReactionTarget, targetUUID, reaction string) {
+	n := Notification{
+		Type:       NotifyReaction,
+		ActorUUID:  actorUUID,
+		TargetType: string(targetType),
+		TargetUUID: targetUUID,
+		Preview:    reaction,
+	}
+
+	switch targetType {
+	case ReactionOnPost:
+		post, err := s.posts.GetPost(targetUUID)
+		if err != nil {
+			log.Printf("Error loading reacted post: %v", err)
+			return
+		}
+		n.UserUUID, n.PostUUID = post.AuthorUUID, post.UUID
+	case ReactionOnComment:
+		comment, err := s.comments.GetComment(targetUUID)
+		if err != nil {
+			log.Printf("Error loading reacted comment: %v", err)
+			return
+		}
+		n.UserUUID, n.PostUUID = comment.AuthorUUID, comment.PostUUID
+	}
+
+	pending, err := s.prepareNotification(n)
+	if err != nil {
+		log.Printf("Error loading notification preferences: %v", err)
+		return
+	}
+	if pending == nil {
+		return
+	}
+	created, err := s.notifications.CreateNotificationOnce(*pending)
+	if err != nil {
+		log.Printf("Error saving notification: %v", err)
+		return
+	}
+	if created {
+		s.pushNotification(*pending)
+	}
+}
+
+func (s *Server) notifyMessage(msg Message) {
+	s.notify(Notification{
+		UserUUID:   msg.To,
+		Type:       NotifyMessage,
+		ActorUUID:  msg.From,
+		TargetType: "message",
+		TargetUUID: msg.UUID,
+		Preview:    preview(msg.Content),
+	})
+}
+
+type NotificationList struct {
+	Notifications []Notification `json:"notifications"`
+	Unread        int            `json:"unread"`
+}
+
+// ListNotificationsHandler returns the user's notifications newest first,
+// only unread ones with ?unread=true, paged with ?offset=
+func (s *Server) ListNotificationsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		unreadOnly, _ := strconv.ParseBool(r.URL.Query().Get("unread"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		if offset < 0 {
+			offset = 0
+		}
+
+		list, err := s.notifications.ListNotifications(userUUID, unreadOnly, notificationsPageSize, offset)
+		if err != nil {
+			writeServerError(w, "Failed to fetch notifications", err)
+			return
+		}
+		unread, err := s.notifications.CountUnread(userUUID)
+		if err != nil {
+			writeServerError(w, "Failed to count notifications", err)
+			return
+		}
+
+		writeData(w, http.StatusOK, NotificationList{Notifications: list, Unread: unread})
+	}
+}
+
+func (s *Server) MarkNotificationReadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		err := s.notifications.MarkNotificationRead(userUUID, mux.Vars(r)["uuid"], time.Now())
+		if errors.Is(err, ErrNotificationNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Notification not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to mark notification read", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) MarkAllNotificationsReadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		if err := s.notifications.MarkAllNotificationsRead(userUUID, time.Now()); err != nil {
+			writeServerError(w, "Failed to mark notifications read", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) GetNotificationPreferencesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		prefs, err := s.notifications.GetNotificationPreferences(userUUID)
+		if err != nil {
+			writeServerError(w, "Failed to fetch notification preferences", err)
+			return
+		}
+
+		writeData(w, http.StatusOK, prefs)
+	}
+}
+
+// UpdateNotificationPreferencesHandler changes only the types present in
+// the body, e.g. {"reaction": false}
+func (s *Server) UpdateNotificationPreferencesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		var changes NotificationPreferences
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+			return
+		}
+
+		errs := ValidationErrors{}
+		for t := range changes {
+			if _, known := defaultNotificationPreferences()[t]; !known {
+				errs.add(string(t), "unknown notification type")
+			}
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		if err := s.notifications.SetNotificationPreferences(userUUID, changes); err != nil {
+			writeServerError(w, "Failed to save notification preferences", err)
+			return
+		}
+		prefs, err := s.notifications.GetNotificationPreferences(userUUID)
+		if err != nil {
+			writeServerError(w, "Failed to fetch notification preferences", err)
+			return
+		}
+
+		writeData(w, http.StatusOK, prefs)
+	}
+}
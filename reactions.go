@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// ReactionTarget matches the target_type values allowed by likes_dislikes
+type ReactionTarget string
+
+const (
+	ReactionOnPost    ReactionTarget = "post"
+	ReactionOnComment ReactionTarget = "comment"
+)
+
+// ReactionCounts are a target's totals after a change, plus the current
+// user's own reaction ("like", "dislike" or "")
+type ReactionCounts struct {
+	Likes    int    `json:"likes"`
+	Dislikes int    `json:"dislikes"`
+	Reaction string `json:"reaction"`
+}
+
+func reactionName(like bool) string {
+	if like {
+		return "like"
+	}
+	return "dislike"
+}
+
+type ReactionRequest struct {
+	Reaction string `json:"reaction"` // like or dislike
+}
+
+// SetReactionHandler likes or dislikes a post or comment, replacing the
+// user's previous reaction
+func (s *Server) SetReactionHandler(targetType ReactionTarget) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		var req ReactionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+			return
+		}
+		if req.Reaction != "like" && req.Reaction != "dislike" {
+			writeValidationErrors(w, ValidationErrors{"reaction": "reaction must be like or dislike"})
+			return
+		}
+
+		targetUUID := mux.Vars(r)["uuid"]
+		counts, err := s.reactions.SetReaction(userUUID, targetType, targetUUID, req.Reaction == "like")
+		if s.reactionError(w, err) {
+			return
+		}
+
+		s.notifyReaction(userUUID, targetType, targetUUID, req.Reaction)
+		s.publishReaction(targetType, targetUUID, counts)
+		writeData(w, http.StatusOK, counts)
+	}
+}
+
+func (s *Server) RemoveReactionHandler(targetType ReactionTarget) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		targetUUID := mux.Vars(r)["uuid"]
+		counts, err := s.reactions.RemoveReaction(userUUID, targetType, targetUUID)
+		if s.reactionError(w, err) {
+			return
+		}
+
+		s.publishReaction(targetType, targetUUID, counts)
+		writeData(w, http.StatusOK, counts)
+	}
+}
+
+// reactionError writes the response for a failed reaction change and
+// reports whether there was one
+func (s *Server) reactionError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrPostNotFound):
+		writeError(w, http.StatusNotFound, codeNotFound, "Post not found")
+	case errors.Is(err, ErrCommentNotFound):
+		writeError(w, http.StatusNotFound, codeNotFound, "Comment not found")
+	default:
+		writeServerError(w, "Failed to save reaction", err)
+	}
+	return true
+}
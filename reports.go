@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type ReportTarget string
+
+const (
+	ReportTargetPost    ReportTarget = "post"
+	ReportTargetComment ReportTarget = "comment"
+	ReportTargetMessage ReportTarget = "message"
+)
+
+func (t ReportTarget) Valid() bool {
+	switch t {
+	case ReportTargetPost, ReportTargetComment, ReportTargetMessage:
+		return true
+	}
+	return false
+}
+
+type ReportStatus string
+
+const (
+	ReportOpen      ReportStatus = "open"
+	ReportResolved  ReportStatus = "resolved"
+	ReportDismissed ReportStatus = "dismissed"
+)
+
+func (s ReportStatus) Valid() bool {
+	switch s {
+	case ReportOpen, ReportResolved, ReportDismissed:
+		return true
+	}
+	return false
+}
+
+// ResolutionAction is what a moderator did about a report
+type ResolutionAction string
+
+const (
+	ResolveDismiss       ResolutionAction = "dismiss"
+	ResolveDeleteContent ResolutionAction = "delete_content"
+	ResolveSuspendAuthor ResolutionAction = "suspend_author"
+)
+
+const (
+	maxReportReasonRunes = 1000
+	reportsPageSize      = 50
+)
+
+type Report struct {
+	UUID             string         `json:"uuid"`
+	ReporterUUID     string         `json:"reporter_uuid"`
+	TargetType       ReportTarget   `json:"target_type"`
+	TargetUUID       string         `json:"target_uuid"`
+	TargetAuthorUUID string         `json:"target_author_uuid"`
+	Reason           string         `json:"reason"`
+	Status           ReportStatus   `json:"status"`
+	CreatedAt        time.Time      `json:"created_at"`
+	ResolvedAt       *time.Time     `json:"resolved_at,omitempty"`
+	ResolvedBy       string         `json:"resolved_by,omitempty"`
+	Actions          []ReportAction `json:"actions,omitempty"`
+}
+
+// ReportAction is one entry in a report's audit trail
+type ReportAction struct {
+	ReportUUID    string           `json:"report_uuid"`
+	ModeratorUUID string           `json:"moderator_uuid"`
+	Action        ResolutionAction `json:"action"`
+	Note          string           `json:"note"`
+	CreatedAt     time.Time        `json:"created_at"`
+}
+
+// ReportFilter selects reports for the moderation queue; empty fields match all
+type ReportFilter struct {
+	Status     ReportStatus
+	TargetType ReportTarget
+	Limit      int
+	Offset     int
+}
+
+type CreateReportRequest struct {
+	TargetType ReportTarget `json:"target_type"`
+	TargetUUID string       `json:"target_uuid"`
+	Reason     string       `json:"reason"`
+}
+
+// CreateReportHandler lets any signed-in user flag a post, comment or a
+// message from one of their own conversations
+func (s *Server) CreateReportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		var req CreateReportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+			return
+		}
+
+		req.TargetUUID = strings.TrimSpace(req.TargetUUID)
+		req.Reason = strings.TrimSpace(req.Reason)
+
+		errs := ValidationErrors{}
+		if !req.TargetType.Valid() {
+			errs.add("target_type", "target_type must be post, comment or message")
+		}
+		if req.TargetUUID == "" {
+			errs.add("target_uuid", "target_uuid is required")
+		}
+		if req.Reason == "" {
+			errs.add("reason", "reason is required")
+		} else if utf8.RuneCountInString(req.Reason) > maxReportReasonRunes {
+			errs.add("reason", "reason must be at most "+strconv.Itoa(maxReportReasonRunes)+" characters")
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		authorUUID, found, err := s.reportTargetAuthor(req.TargetType, req.TargetUUID, userUUID)
+		if err != nil {
+			writeServerError(w, "Failed to fetch report target", err)
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, codeNotFound, "Reported content not found")
+			return
+		}
+		if authorUUID == userUUID {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "You cannot report your own content")
+			return
+		}
+
+		report := Report{
+			UUID:             uuid.New().String(),
+			ReporterUUID:     userUUID,
+			TargetType:       req.TargetType,
+			TargetUUID:       req.TargetUUID,
+			TargetAuthorUUID: authorUUID,
+			Reason:           req.Reason,
+			Status:           ReportOpen,
+			CreatedAt:        time.Now(),
+		}
+
+		err = s.reports.CreateReport(report)
+		if errors.Is(err, ErrReportExists) {
+			writeError(w, http.StatusConflict, codeConflict, "You already reported this")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to create report", err)
+			return
+		}
+
+		writeData(w, http.StatusCreated, report)
+	}
+}
+
+// reportTargetAuthor finds who wrote the reported content. Deleted content
+// and messages from conversations the reporter is not part of count as not
+// found.
+func (s *Server) reportTargetAuthor(targetType ReportTarget, targetUUID, reporterUUID string) (string, bool, error) {
+	switch targetType {
+	case ReportTargetPost:
+		post, err := s.posts.GetPost(targetUUID)
+		if errors.Is(err, ErrPostNotFound) || (err == nil && post.Deleted) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return post.AuthorUUID, true, nil
+
+	case ReportTargetComment:
+		comment, err := s.comments.GetComment(targetUUID)
+		if errors.Is(err, ErrCommentNotFound) || (err == nil && comment.Deleted) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return comment.AuthorUUID, true, nil
+
+	case ReportTargetMessage:
+		msg, err := s.messages.GetMessage(targetUUID)
+		if errors.Is(err, ErrMessageNotFound) || (err == nil && (msg.Deleted || (msg.From != reporterUUID && msg.To != reporterUUID))) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return msg.From, true, nil
+	}
+	return "", false, nil
+}
+
+// ListReportsHandler serves the moderation queue, filtered by ?status= and
+// ?type= and paged with ?offset=
+func (s *Server) ListReportsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := ReportFilter{
+			Status:     ReportStatus(query.Get("status")),
+			TargetType: ReportTarget(query.Get("type")),
+			Limit:      reportsPageSize,
+		}
+		filter.Offset, _ = strconv.Atoi(query.Get("offset"))
+
+		errs := ValidationErrors{}
+		if filter.Status != "" && !filter.Status.Valid() {
+			errs.add("status", "status must be open, resolved or dismissed")
+		}
+		if filter.TargetType != "" && !filter.TargetType.Valid() {
+			errs.add("type", "type must be post, comment or message")
+		}
+		if filter.Offset < 0 {
+			errs.add("offset", "offset must not be negative")
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		reports, err := s.reports.ListReports(filter)
+		if err != nil {
+			writeServerError(w, "Failed to fetch reports", err)
+			return
+		}
+
+		writeData(w, http.StatusOK, reports)
+	}
+}
+
+func (s *Server) GetReportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := s.reports.GetReport(mux.Vars(r)["uuid"])
+		if errors.Is(err, ErrReportNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Report not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to fetch report", err)
+			return
+		}
+
+		writeData(w, http.StatusOK, report)
+	}
+}
+
+type ResolveReportRequest struct {
+	Action ResolutionAction `json:"action"`
+	Note   string           `json:"note"`
+	// Only for suspend_author, e.g. "72h"
+	SuspendFor Duration `json:"suspend_for"`
+}
+
+// ResolveReportHandler applies a moderator's decision to an open report and
+// records it in the report's audit trail
+func (s *Server) ResolveReportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moderatorUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		var req ResolveReportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+			return
+		}
+		req.Note = strings.TrimSpace(req.Note)
+
+		errs := ValidationErrors{}
+		switch req.Action {
+		case ResolveDismiss, ResolveDeleteContent:
+		case ResolveSuspendAuthor:
+			if req.SuspendFor <= 0 {
+				errs.add("suspend_for", "suspend_for is required to suspend the author")
+			}
+		default:
+			errs.add("action", "action must be dismiss, delete_content or suspend_author")
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		report, err := s.reports.GetReport(mux.Vars(r)["uuid"])
+		if errors.Is(err, ErrReportNotFound) {
+			writeError(w, http.StatusNotFound, codeNotFound, "Report not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to fetch report", err)
+			return
+		}
+		if report.Status != ReportOpen {
+			writeError(w, http.StatusConflict, codeConflict, "Report is already closed")
+			return
+		}
+
+		now := time.Now()
+		status := ReportResolved
+		switch req.Action {
+		case ResolveDismiss:
+			status = ReportDismissed
+		case ResolveDeleteContent:
+			if err := s.deleteReportTarget(report, now); err != nil {
+				writeServerError(w, "Failed to delete reported content", err)
+				return
+			}
+		case ResolveSuspendAuthor:
+			reason := req.Note
+			if reason == "" {
+				reason = report.Reason
+			}
+			author, err := s.users.GetUser(report.TargetAuthorUUID)
+			if err != nil {
+				writeServerError(w, "Failed to fetch user", err)
+				return
+			}
+			if role, _ := RoleFromContext(r.Context()); !role.Outranks(author.Role) {
+				writeError(w, http.StatusForbidden, codeForbidden, "You can only restrict users below your role")
+				return
+			}
+			err = s.users.SuspendUser(author.UUID, now.Add(req.SuspendFor.Duration()), reason)
+			if err != nil {
+				writeServerError(w, "Failed to suspend user", err)
+				return
+			}
+			s.disconnectRestricted(author.UUID)
+			s.audit(r, moderatorUUID, AuditUserSuspend, "user", author.UUID, reason)
+		}
+
+		err = s.reports.ResolveReport(status, ReportAction{
+			ReportUUID:    report.UUID,
+			ModeratorUUID: moderatorUUID,
+			Action:        req.Action,
+			Note:          req.Note,
+			CreatedAt:     now,
+		})
+		if errors.Is(err, ErrReportNotFound) {
+			writeError(w, http.StatusConflict, codeConflict, "Report is already closed")
+			return
+		}
+		if err != nil {
+			writeServerError(w, "Failed to resolve report", err)
+			return
+		}
+		s.audit(r, moderatorUUID, AuditReportResolve, "report", report.UUID, string(req.Action))
+
+		report, err = s.reports.GetReport(report.UUID)
+		if err != nil {
+			writeServerError(w, "Failed to fetch report", err)
+			return
+		}
+		writeData(w, http.StatusOK, report)
+	}
+}
+
+// deleteReportTarget soft-deletes the reported content. Content that is
+// already gone is not an error.
+func (s *Server) deleteReportTarget(report *Report, deletedAt time.Time) error {
+	var err error
+	switch report.TargetType {
+	case ReportTargetPost:
+		err = s.posts.DeletePost(report.TargetUUID, deletedAt)
+	case ReportTargetComment:
+		err = s.comments.DeleteComment(report.TargetUUID, deletedAt)
+	case ReportTargetMessage:
+		err = s.messages.DeleteMessage(report.TargetUUID, deletedAt)
+	}
+	if errors.Is(err, ErrPostNotFound) || errors.Is(err, ErrCommentNotFound) || errors.Is(err, ErrMessageNotFound) {
+		return nil
+	}
+	return err
+}
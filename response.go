@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Error codes returned in APIError.Code; clients should switch on these
+// rather than on the message text
+const (
+	codeInvalidJSON     = "invalid_json"
+	codeValidation      = "validation_failed"
+	codeUnauthorized    = "unauthorized"
+	codeForbidden       = "forbidden"
+	codeNotFound        = "not_found"
+	codeConflict        = "conflict"
+	codeInternal        = "internal_error"
+	codeInvalidRequest  = "invalid_request"
+	codeInvalidCSRF     = "invalid_csrf_token"
+	codeInvalidCreds    = "invalid_credentials"
+	codeEditWindow      = "edit_window_closed"
+	codeSuspended       = "account_suspended"
+	codeBanned          = "account_banned"
+	codeTooLarge        = "file_too_large"
+	codeUnsupportedType = "unsupported_media_type"
+)
+
+// APIError is the body of every error response: {"error": {...}}
+type APIError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	// Set with codeSuspended and codeBanned
+	Suspension *Suspension `json:"suspension,omitempty"`
+}
+
+type errorEnvelope struct {
+	Error APIError `json:"error"`
+}
+
+type dataEnvelope struct {
+	Data interface{} `json:"data"`
+}
+
+// writeJSON encodes v as the response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// writeData wraps a successful result as {"data": ...}
+func writeData(w http.ResponseWriter, status int, data interface{}) {
+	writeJSON(w, status, dataEnvelope{Data: data})
+}
+
+// writeError sends an error envelope without field details
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorEnvelope{Error: APIError{Code: code, Message: message}})
+}
+
+// writeValidationErrors responds 400 with per-field problems
+func writeValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	writeJSON(w, http.StatusBadRequest, errorEnvelope{Error: APIError{
+		Code:    codeValidation,
+		Message: "Validation failed",
+		Fields:  errs,
+	}})
+}
+
+// writeServerError logs err and hides the details from the client
+func writeServerError(w http.ResponseWriter, context string, err error) {
+	log.Printf("%s: %v", context, err)
+	writeError(w, http.StatusInternalServerError, codeInternal, "Server error")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Role decides what a user may do beyond managing their own content
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// Higher ranks include every power of the lower ones
+var roleRanks = map[Role]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// AtLeast reports whether r grants every power of min
+func (r Role) AtLeast(min Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[min]
+}
+
+// Outranks reports whether r is strictly above other
+func (r Role) Outranks(other Role) bool {
+	return r.Valid() && roleRanks[r] > roleRanks[other]
+}
+
+// RequireRole only lets through users holding at least the given role. It
+// must run inside AuthMiddleware, which puts the role in the context:
+//
+//	s.AuthMiddleware(RequireRole(RoleModerator)(handler))
+func RequireRole(min Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, ok := RoleFromContext(r.Context())
+			if !ok {
+				writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+				return
+			}
+			if !role.AtLeast(min) {
+				writeError(w, http.StatusForbidden, codeForbidden, "Forbidden: requires the "+string(min)+" role")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// runPromoteAdmin implements "promote-admin [flags] <email-or-nickname>",
+// which makes an existing account the first admin. Later role changes go
+// through the admin API.
+func runPromoteAdmin(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: promote-admin [flags] <email-or-nickname>")
+	}
+	identifier := args[len(args)-1]
+
+	cfg, err := LoadConfig(args[:len(args)-1])
+	if err != nil {
+		return err
+	}
+
+	db, err := InitDB(cfg.DBPath)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer db.Close()
+
+	userUUID, err := PromoteFirstAdmin(db, identifier)
+	if err != nil {
+		return fmt.Errorf("promote %s: %w", identifier, err)
+	}
+	log.Printf("%s (%s) is now an admin", identifier, userUUID)
+	return nil
+}
@@ -3,12 +3,18 @@ CREATE TABLE IF NOT EXISTS users (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     uuid TEXT UNIQUE NOT NULL,
     nickname TEXT UNIQUE NOT NULL,
+    nickname_normalized TEXT NOT NULL DEFAULT '',
     email TEXT UNIQUE NOT NULL,
     age INTEGER NOT NULL,
     gender TEXT,
     first_name TEXT,
     last_name TEXT,
     password_hash TEXT NOT NULL,
+    role TEXT NOT NULL DEFAULT 'user', -- user, moderator or admin
+    suspended_until DATETIME,
+    banned_at DATETIME, -- permanent; takes precedence over suspended_until
+    suspension_reason TEXT NOT NULL DEFAULT '',
+    avatar_uuid TEXT NOT NULL DEFAULT '', -- empty: generated identicon
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -17,6 +23,7 @@ CREATE TABLE IF NOT EXISTS sessions (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     session_uuid TEXT UNIQUE NOT NULL,
     user_uuid TEXT NOT NULL,
+    csrf_token TEXT NOT NULL DEFAULT '',
     expires_at DATETIME NOT NULL,
     FOREIGN KEY(user_uuid) REFERENCES users(uuid)
 );
@@ -35,14 +42,34 @@ CREATE TABLE IF NOT EXISTS posts (
     title TEXT NOT NULL,
     content TEXT NOT NULL,
     created_at DATETIME NOT NULL,
+    edited_at DATETIME,
+    deleted_at DATETIME,
+    comment_count INTEGER NOT NULL DEFAULT 0, -- live comments, kept in step by comment writes
+    likes INTEGER NOT NULL DEFAULT 0, -- counters kept in step with likes_dislikes
+    dislikes INTEGER NOT NULL DEFAULT 0,
+    hot_score REAL NOT NULL DEFAULT 0, -- recomputed from the counters on every reaction
     FOREIGN KEY(user_uuid) REFERENCES users(uuid)
 );
 
+-- Previous versions of edited posts; categories is a JSON array
+CREATE TABLE IF NOT EXISTS post_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    post_uuid TEXT NOT NULL,
+    editor_uuid TEXT NOT NULL,
+    title TEXT NOT NULL,
+    content TEXT NOT NULL,
+    categories TEXT NOT NULL,
+    replaced_at DATETIME NOT NULL,
+    FOREIGN KEY(post_uuid) REFERENCES posts(uuid) ON DELETE CASCADE,
+    FOREIGN KEY(editor_uuid) REFERENCES users(uuid)
+);
+
 -- PostCategories (Many-to-Many relation)
 CREATE TABLE IF NOT EXISTS post_categories (
     post_uuid TEXT NOT NULL,
     category TEXT NOT NULL,
-    FOREIGN KEY(post_uuid) REFERENCES posts(uuid)
+    PRIMARY KEY (post_uuid, category),
+    FOREIGN KEY(post_uuid) REFERENCES posts(uuid) ON DELETE CASCADE
 );
 
 -- Comments table
@@ -53,6 +80,10 @@ CREATE TABLE IF NOT EXISTS comments (
     user_uuid TEXT NOT NULL,
     content TEXT NOT NULL,
     created_at DATETIME NOT NULL,
+    edited_at DATETIME,
+    deleted_at DATETIME,
+    likes INTEGER NOT NULL DEFAULT 0,
+    dislikes INTEGER NOT NULL DEFAULT 0,
     FOREIGN KEY(post_uuid) REFERENCES posts(uuid),
     FOREIGN KEY(user_uuid) REFERENCES users(uuid)
 );
@@ -79,3 +110,162 @@ CREATE TABLE IF NOT EXISTS private_messages (
     FOREIGN KEY(sender_uuid) REFERENCES users(uuid),
     FOREIGN KEY(receiver_uuid) REFERENCES users(uuid)
 );
+
+-- Messages table (private chat history written by the WebSocket hub)
+CREATE TABLE IF NOT EXISTS messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT UNIQUE NOT NULL,
+    sender_uuid TEXT NOT NULL,
+    receiver_uuid TEXT NOT NULL,
+    content TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    deleted_at DATETIME,
+    FOREIGN KEY(sender_uuid) REFERENCES users(uuid),
+    FOREIGN KEY(receiver_uuid) REFERENCES users(uuid)
+);
+
+-- Reports of abusive posts, comments or messages awaiting moderation
+CREATE TABLE IF NOT EXISTS reports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT UNIQUE NOT NULL,
+    reporter_uuid TEXT NOT NULL,
+    target_type TEXT NOT NULL, -- post, comment or message
+    target_uuid TEXT NOT NULL,
+    target_author_uuid TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'open', -- open, resolved or dismissed
+    created_at DATETIME NOT NULL,
+    resolved_at DATETIME,
+    resolved_by TEXT,
+    FOREIGN KEY(reporter_uuid) REFERENCES users(uuid),
+    FOREIGN KEY(target_author_uuid) REFERENCES users(uuid),
+    FOREIGN KEY(resolved_by) REFERENCES users(uuid)
+);
+
+-- What moderators did about each report
+CREATE TABLE IF NOT EXISTS report_actions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    report_uuid TEXT NOT NULL,
+    moderator_uuid TEXT NOT NULL,
+    action TEXT NOT NULL, -- dismiss, delete_content or suspend_author
+    note TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY(report_uuid) REFERENCES reports(uuid) ON DELETE CASCADE,
+    FOREIGN KEY(moderator_uuid) REFERENCES users(uuid)
+);
+
+-- Notifications about activity on a user's content or conversations
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT UNIQUE NOT NULL,
+    user_uuid TEXT NOT NULL, -- recipient
+    type TEXT NOT NULL, -- comment, reaction, message or mention
+    actor_uuid TEXT NOT NULL,
+    target_type TEXT NOT NULL,
+    target_uuid TEXT NOT NULL,
+    post_uuid TEXT NOT NULL DEFAULT '',
+    preview TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    read_at DATETIME,
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid),
+    FOREIGN KEY(actor_uuid) REFERENCES users(uuid)
+);
+
+-- Users mentioned by @nickname in a post, comment or message
+CREATE TABLE IF NOT EXISTS mentions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_uuid TEXT NOT NULL, -- mentioned user
+    target_type TEXT NOT NULL CHECK(target_type IN ('post','comment','message')),
+    target_uuid TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    UNIQUE(target_type, target_uuid, user_uuid),
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid)
+);
+
+-- Uploaded files; the bytes live in the blob store under uuid (and
+-- uuid-thumb). owner_type is empty until a post or message claims them.
+CREATE TABLE IF NOT EXISTS attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT NOT NULL UNIQUE,
+    uploader_uuid TEXT NOT NULL,
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    width INTEGER NOT NULL DEFAULT 0,
+    height INTEGER NOT NULL DEFAULT 0,
+    has_thumbnail BOOLEAN NOT NULL DEFAULT 0,
+    owner_type TEXT NOT NULL DEFAULT '' CHECK(owner_type IN ('','post','message')),
+    owner_uuid TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY(uploader_uuid) REFERENCES users(uuid)
+);
+
+-- Notification types a user switched off or back on; missing rows mean enabled
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_uuid TEXT NOT NULL,
+    type TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    PRIMARY KEY(user_uuid, type),
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid)
+);
+
+-- Categories each user follows; names match post_categories.category
+CREATE TABLE IF NOT EXISTS category_follows (
+    user_uuid TEXT NOT NULL,
+    category TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY(user_uuid, category),
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid)
+);
+
+-- Append-only log of security and moderation events
+CREATE TABLE IF NOT EXISTS audit_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    actor_uuid TEXT, -- NULL when nobody was signed in
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL DEFAULT '',
+    target_uuid TEXT NOT NULL DEFAULT '',
+    detail TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL
+);
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit_events is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit_events is append-only');
+END;
+
+-- Nicknames are unique regardless of case
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_nickname_normalized ON users(nickname_normalized);
+
+-- Indexes for the feed and chat history queries. Lookups of a post's
+-- categories use the post_categories primary key (post_uuid, category).
+CREATE INDEX IF NOT EXISTS idx_posts_created_at ON posts(created_at);
+CREATE INDEX IF NOT EXISTS idx_posts_user ON posts(user_uuid, created_at);
+CREATE INDEX IF NOT EXISTS idx_posts_top ON posts((likes - dislikes), created_at);
+CREATE INDEX IF NOT EXISTS idx_posts_hot ON posts(hot_score, created_at);
+CREATE INDEX IF NOT EXISTS idx_posts_comment_count ON posts(comment_count, created_at);
+CREATE INDEX IF NOT EXISTS idx_post_revisions_post ON post_revisions(post_uuid);
+CREATE INDEX IF NOT EXISTS idx_post_categories_category ON post_categories(category, post_uuid);
+CREATE INDEX IF NOT EXISTS idx_comments_post ON comments(post_uuid, created_at);
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_uuid);
+CREATE INDEX IF NOT EXISTS idx_messages_sender_receiver ON messages(sender_uuid, receiver_uuid, created_at);
+CREATE INDEX IF NOT EXISTS idx_messages_receiver_sender ON messages(receiver_uuid, sender_uuid, created_at);
+CREATE INDEX IF NOT EXISTS idx_mentions_user ON mentions(user_uuid, created_at);
+CREATE INDEX IF NOT EXISTS idx_attachments_owner ON attachments(owner_type, owner_uuid);
+CREATE INDEX IF NOT EXISTS idx_attachments_unclaimed ON attachments(created_at) WHERE owner_type = '';
+CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(user_uuid, created_at);
+CREATE INDEX IF NOT EXISTS idx_notifications_unread ON notifications(user_uuid) WHERE read_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_notifications_target ON notifications(target_uuid, actor_uuid);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON audit_events(actor_uuid, id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events(action, id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
+CREATE INDEX IF NOT EXISTS idx_reports_queue ON reports(status, target_type, created_at);
+-- One open report per reporter and target
+CREATE UNIQUE INDEX IF NOT EXISTS idx_reports_open_target ON reports(reporter_uuid, target_type, target_uuid) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS idx_report_actions_report ON report_actions(report_uuid);
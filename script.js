@@ -1,18 +1,109 @@
 let messagesOffset = 0
 let chatWith = ""; // user UUID you're chatting with
+// user_uuid from the login response; kept for reloads while the session
+// cookie lives
+let currentUserUUID = sessionStorage.getItem("user_uuid")
 let loading = false
 const chatHistory = document.getElementById("chat-history")
+const chatHeader = document.getElementById("chat-header")
+const sendButton = document.getElementById("send-button")
+
+//----------api-----------
+
+// csrfToken is the token the server set in a script-readable cookie at login
+function csrfToken() {
+  const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/)
+  return match ? decodeURIComponent(match[1]) : ""
+}
+
+const SAFE_METHODS = ["GET", "HEAD", "OPTIONS"]
+
+// api is fetch for this server's endpoints: cookies are always sent and every
+// state-changing request carries the X-CSRF-Token header the server requires.
+// A plain object body is sent as JSON.
+function api(url, options = {}) {
+  const method = (options.method || "GET").toUpperCase()
+  const headers = new Headers(options.headers)
+  let body = options.body
+  if (body !== undefined && !(body instanceof FormData) && typeof body !== "string") {
+    headers.set("Content-Type", "application/json")
+    body = JSON.stringify(body)
+  }
+  if (!SAFE_METHODS.includes(method)) {
+    headers.set("X-CSRF-Token", csrfToken())
+  }
+  return fetch(url, { ...options, method, headers, body, credentials: "include" })
+}
+
+//----------session-----------
+
+const loginForm = document.getElementById("login-form")
+const loginError = document.getElementById("login-error")
+const logoutButton = document.getElementById("logout-button")
+
+function showSignedIn(signedIn) {
+  loginForm.hidden = signedIn
+  logoutButton.hidden = !signedIn
+}
+
+loginForm.addEventListener("submit", function (e) {
+  e.preventDefault()
+  loginError.textContent = ""
+
+  api("/login", {
+    method: "POST",
+    body: {
+      identifier: document.getElementById("login-identifier").value,
+      password: document.getElementById("login-password").value,
+    },
+  })
+    .then((res) => res.json())
+    .then((body) => {
+      if (body.error) {
+        loginError.textContent = body.error.message
+        return
+      }
+      currentUserUUID = body.data.user_uuid
+      sessionStorage.setItem("user_uuid", currentUserUUID)
+      loginForm.reset()
+      showSignedIn(true)
+      connectWebSocket()
+    })
+})
+
+logoutButton.addEventListener("click", function () {
+  api("/logout", { method: "POST" }).finally(signedOut)
+})
+
+// signedOut forgets the user and stops the socket from reconnecting
+function signedOut() {
+  currentUserUUID = null
+  sessionStorage.removeItem("user_uuid")
+  chatWith = ""
+  chatHistory.innerHTML = ""
+  chatHeader.textContent = "Select a user to chat"
+  chatInput.disabled = true
+  sendButton.disabled = true
+  document.getElementById("online-users").innerHTML = ""
+  showSignedIn(false)
+  if (socket) {
+    socket.onclose = null
+    socket.close()
+  }
+}
 
 function loadMessages() {
   if (loading) return
   loading = true
 
-  fetch(`/messages?with=${chatWith}&offset=${messagesOffset}`, {
-    method: "GET",
-    credentials: "include",
-  })
-    .then((res) => res.json())
-    .then((messages) => {
+  api(`/messages?with=${chatWith}&offset=${messagesOffset}`)
+    .then((res) => {
+      // The session expired or was revoked
+      if (res.status === 401) signedOut()
+      return res.json()
+    })
+    .then((body) => {
+      const messages = body.data || []
       messagesOffset += messages.length
 
       const oldHeight = chatHistory.scrollHeight
@@ -45,7 +136,11 @@ chatHistory.addEventListener("scroll", function () {
 function openChat(userUUID) {
   chatWith = userUUID
   messagesOffset = 0
+  chatHeader.textContent = `Chatting with ${userUUID}`
+  chatInput.disabled = false
+  sendButton.disabled = false
   chatHistory.innerHTML = ""
+  chatInput.focus()
   loadMessages() // Load first 10 messages
 }
 
@@ -53,9 +148,15 @@ function openChat(userUUID) {
 
 let socket
 
+// Same host as the page; wss:// whenever the page itself came over HTTPS
+function webSocketURL() {
+  const scheme = location.protocol === "https:" ? "wss:" : "ws:"
+  return `${scheme}//${location.host}/ws`
+}
+
 //Connect WebSocket
 function connectWebSocket() {
-  socket = new WebSocket("ws://localhost:8080/ws")
+  socket = new WebSocket(webSocketURL())
 
   socket.onopen = () => {
     console.log("WebSocket connected")
@@ -66,12 +167,23 @@ function connectWebSocket() {
 
     if (data.type === "user_list") {
       renderOnlineUsers(data.users)
+    } else if (data.type === "notification") {
+      console.log("Notification:", data.notification)
+    } else if (data.type) {
+      // Live feed events and errors; chat messages carry no type
+      console.log("Event:", data)
     } else {
       renderIncomingMessage(data)
     }
   }
 
-  socket.onclose = () => {
+  socket.onclose = (event) => {
+    // 1008 = policy violation: the account was suspended or banned
+    if (event.code === 1008) {
+      alert(event.reason || "Your account has been suspended")
+      signedOut()
+      return
+    }
     console.log("WebSocket closed. Reconnecting...")
     setTimeout(connectWebSocket, 2000); // retry
   };
@@ -81,19 +193,22 @@ function connectWebSocket() {
 const chatInput = document.getElementById("chat-input");
 
 //Sending Messages via WebSocket
-chatInput.addEventListener("keydown", function (e) {
-  if (e.key === "Enter") {
-    const content = chatInput.value.trim()
-    if (!content || !chatWith) return
-
-    const msg = {
-      to: chatWith,
-      content: content,
-    }
+function sendMessage() {
+  const content = chatInput.value.trim()
+  if (!content || !chatWith) return
 
-    socket.send(JSON.stringify(msg))
-    chatInput.value = ""
+  const msg = {
+    to: chatWith,
+    content: content,
   }
+
+  socket.send(JSON.stringify(msg))
+  chatInput.value = ""
+}
+
+sendButton.addEventListener("click", sendMessage)
+chatInput.addEventListener("keydown", function (e) {
+  if (e.key === "Enter") sendMessage()
 })
 
 //Render Received Messages
@@ -128,7 +243,14 @@ function renderOnlineUsers(users) {
     if (user.UserUUID === currentUserUUID) return
 
     const li = document.createElement("li")
-    li.textContent = `${user.UserUUID} (${user.IsOnline ? "🟢" : "⚪️"})`
+    if (user.AvatarURL) {
+      const img = document.createElement("img")
+      img.className = "avatar"
+      img.src = `${user.AvatarURL}&size=64`
+      img.alt = ""
+      li.appendChild(img)
+    }
+    li.appendChild(document.createTextNode(`${user.UserUUID} (${user.IsOnline ? "🟢" : "⚪️"})`))
 
     li.onclick = () => {
       openChat(user.UserUUID)
@@ -136,4 +258,7 @@ function renderOnlineUsers(users) {
 
     list.appendChild(li)
   })
-}
\ No newline at end of file
+}
+
+showSignedIn(currentUserUUID !== null)
+if (currentUserUUID) connectWebSocket()
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Server holds the dependencies shared by every HTTP handler
+type Server struct {
+	cfg      *Config
+	users    UserStore
+	sessions SessionStore
+	posts    PostStore
+	comments CommentStore
+	messages MessageStore
+	reports  ReportStore
+	auditLog AuditStore
+	hub      *Hub
+
+	reactions     ReactionStore
+	notifications NotificationStore
+	mentions      MentionStore
+	attachments   AttachmentStore
+	follows       CategoryFollowStore
+	blobs         BlobStore
+
+	// Decoded images are held uncompressed, so only a few may be in
+	// memory at once
+	decodeSlots chan struct{}
+}
+
+func NewServer(cfg *Config, stores Stores, blobs BlobStore, hub *Hub) *Server {
+	return &Server{
+		cfg:      cfg,
+		users:    stores.Users,
+		sessions: stores.Sessions,
+		posts:    stores.Posts,
+		comments: stores.Comments,
+		messages: stores.Messages,
+		reports:  stores.Reports,
+		auditLog: stores.Audit,
+		hub:      hub,
+
+		reactions:     stores.Reactions,
+		notifications: stores.Notifications,
+		mentions:      stores.Mentions,
+		attachments:   stores.Attachments,
+		follows:       stores.Follows,
+		blobs:         blobs,
+
+		decodeSlots: make(chan struct{}, maxConcurrentDecodes),
+	}
+}
+
+// Routes registers every endpoint on a new router
+func (s *Server) Routes() *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/register", s.RegisterHandler()).Methods("POST")
+	r.HandleFunc("/login", s.LoginHandler()).Methods("POST")
+	r.Handle("/logout", s.AuthMiddleware(CSRFMiddleware(s.LogoutHandler()))).Methods("POST")
+	r.Handle("/feed", s.OptionalAuthMiddleware(s.PostFeedHandler())).Methods("GET")
+	r.Handle("/posts", s.AuthMiddleware(CSRFMiddleware(s.CreatePostHandler()))).Methods("POST")
+	r.HandleFunc("/posts/{uuid}", s.GetPostHandler()).Methods("GET")
+	r.Handle("/posts/{uuid}", s.AuthMiddleware(CSRFMiddleware(s.UpdatePostHandler()))).Methods("PATCH")
+	r.Handle("/posts/{uuid}", s.AuthMiddleware(CSRFMiddleware(s.DeletePostHandler()))).Methods("DELETE")
+	r.Handle("/posts/{uuid}/revisions", s.AuthMiddleware(s.GetPostRevisionsHandler())).Methods("GET")
+	r.Handle("/comments", s.AuthMiddleware(CSRFMiddleware(s.CreateCommentHandler()))).Methods("POST")
+	r.Handle("/comments/{uuid}", s.AuthMiddleware(CSRFMiddleware(s.UpdateCommentHandler()))).Methods("PATCH")
+	r.Handle("/comments/{uuid}", s.AuthMiddleware(CSRFMiddleware(s.DeleteCommentHandler()))).Methods("DELETE")
+	r.Handle("/reports", s.AuthMiddleware(CSRFMiddleware(s.CreateReportHandler()))).Methods("POST")
+	r.Handle("/posts/{uuid}/reaction", s.AuthMiddleware(CSRFMiddleware(s.SetReactionHandler(ReactionOnPost)))).Methods("PUT")
+	r.Handle("/posts/{uuid}/reaction", s.AuthMiddleware(CSRFMiddleware(s.RemoveReactionHandler(ReactionOnPost)))).Methods("DELETE")
+	r.Handle("/comments/{uuid}/reaction", s.AuthMiddleware(CSRFMiddleware(s.SetReactionHandler(ReactionOnComment)))).Methods("PUT")
+	r.Handle("/comments/{uuid}/reaction", s.AuthMiddleware(CSRFMiddleware(s.RemoveReactionHandler(ReactionOnComment)))).Methods("DELETE")
+	r.Handle("/attachments", s.AuthMiddleware(CSRFMiddleware(s.UploadAttachmentHandler()))).Methods("POST")
+	r.Handle("/attachments/{uuid}", s.OptionalAuthMiddleware(s.ServeAttachmentHandler(false))).Methods("GET", "HEAD")
+	r.Handle("/attachments/{uuid}/thumbnail", s.OptionalAuthMiddleware(s.ServeAttachmentHandler(true))).Methods("GET", "HEAD")
+	r.HandleFunc("/users/{uuid}", s.GetProfileHandler()).Methods("GET")
+	r.HandleFunc("/users/{uuid}/avatar", s.ServeAvatarHandler()).Methods("GET", "HEAD")
+	r.Handle("/me/avatar", s.AuthMiddleware(CSRFMiddleware(s.UploadAvatarHandler()))).Methods("PUT")
+	r.Handle("/me/avatar", s.AuthMiddleware(CSRFMiddleware(s.DeleteAvatarHandler()))).Methods("DELETE")
+	r.Handle("/me/categories", s.AuthMiddleware(s.FollowedCategoriesHandler())).Methods("GET")
+	r.Handle("/categories/{name}/follow", s.AuthMiddleware(CSRFMiddleware(s.FollowCategoryHandler(true)))).Methods("PUT")
+	r.Handle("/categories/{name}/follow", s.AuthMiddleware(CSRFMiddleware(s.FollowCategoryHandler(false)))).Methods("DELETE")
+	r.Handle("/ws", s.AuthMiddleware(s.WebSocketHandler())).Methods("GET")
+	r.Handle("/messages", s.AuthMiddleware(s.GetMessagesHandler())).Methods("GET")
+
+	notes := r.PathPrefix("/notifications").Subrouter()
+	notes.Use(s.AuthMiddleware, CSRFMiddleware)
+	notes.Handle("", s.ListNotificationsHandler()).Methods("GET")
+	notes.Handle("/read-all", s.MarkAllNotificationsReadHandler()).Methods("POST")
+	notes.Handle("/preferences", s.GetNotificationPreferencesHandler()).Methods("GET")
+	notes.Handle("/preferences", s.UpdateNotificationPreferencesHandler()).Methods("PUT")
+	notes.Handle("/{uuid}/read", s.MarkNotificationReadHandler()).Methods("POST")
+
+	// Staff-only API
+	mod := r.PathPrefix("/moderation").Subrouter()
+	mod.Use(s.AuthMiddleware, CSRFMiddleware, RequireRole(RoleModerator))
+	mod.Handle("/reports", s.ListReportsHandler()).Methods("GET")
+	mod.Handle("/reports/{uuid}", s.GetReportHandler()).Methods("GET")
+	mod.Handle("/reports/{uuid}/resolve", s.ResolveReportHandler()).Methods("POST")
+	mod.Handle("/users/{uuid}/suspend", s.SuspendUserHandler()).Methods("POST")
+	mod.Handle("/users/{uuid}/ban", RequireRole(RoleAdmin)(s.BanUserHandler())).Methods("POST")
+	mod.Handle("/users/{uuid}/suspension", s.LiftSuspensionHandler()).Methods("DELETE")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(s.AuthMiddleware, CSRFMiddleware, RequireRole(RoleAdmin))
+	admin.Handle("/users/{uuid}/role", s.SetUserRoleHandler()).Methods("PUT")
+	admin.Handle("/audit", s.ListAuditEventsHandler()).Methods("GET")
+	admin.Handle("/audit/export", s.ExportAuditEventsHandler()).Methods("GET")
+
+	// Web client; registered last so API routes take precedence
+	r.PathPrefix("/").Handler(StaticHandler(s.cfg.Dev)).Methods("GET", "HEAD")
+
+	return r
+}
+
+// Handler returns the full HTTP handler including transport middleware
+func (s *Server) Handler() http.Handler {
+	var handler http.Handler = s.Routes()
+	if s.cfg.TLSEnabled() {
+		handler = HSTSMiddleware(s.cfg.HSTSMaxAge.Duration(), handler)
+	}
+	return handler
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed index.html script.js styles.css
+var webAssets embed.FS
+
+const spaIndex = "index.html"
+
+// staticAsset is a file of the web client ready to be served
+type staticAsset struct {
+	content []byte
+	etag    string
+	modTime time.Time
+}
+
+// StaticHandler serves the web client. Embedded assets are hashed once at
+// startup; in dev mode files are read from disk on every request so edits
+// to index.html, script.js and styles.css show up without a rebuild.
+// Unknown paths without a file extension fall back to index.html so the
+// client can handle its own routes.
+func StaticHandler(dev bool) http.Handler {
+	var load func(name string) (*staticAsset, error)
+	if dev {
+		disk := os.DirFS(".")
+		load = func(name string) (*staticAsset, error) {
+			return readAsset(disk, name)
+		}
+	} else {
+		assets, err := loadEmbeddedAssets()
+		if err != nil {
+			panic(err) // the embed directive guarantees these files exist
+		}
+		load = func(name string) (*staticAsset, error) {
+			if a, ok := assets[name]; ok {
+				return a, nil
+			}
+			return nil, fs.ErrNotExist
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" {
+			name = spaIndex
+		}
+
+		asset, err := load(name)
+		if err != nil {
+			// Missing files are a 404; anything else is a client-side route
+			if path.Ext(name) != "" {
+				writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+				return
+			}
+			name = spaIndex
+			if asset, err = load(name); err != nil {
+				writeServerError(w, "Failed to load web client", err)
+				return
+			}
+		}
+
+		w.Header().Set("ETag", asset.etag)
+		if dev || name == spaIndex {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=300")
+		}
+		http.ServeContent(w, r, name, asset.modTime, bytes.NewReader(asset.content))
+	})
+}
+
+func loadEmbeddedAssets() (map[string]*staticAsset, error) {
+	assets := map[string]*staticAsset{}
+	err := fs.WalkDir(webAssets, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		a, err := readAsset(webAssets, name)
+		if err != nil {
+			return err
+		}
+		assets[name] = a
+		return nil
+	})
+	return assets, err
+}
+
+func readAsset(fsys fs.FS, name string) (*staticAsset, error) {
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Embedded files carry no modification time, so the ETag alone drives revalidation
+	var modTime time.Time
+	if info, err := fs.Stat(fsys, name); err == nil {
+		modTime = info.ModTime()
+	}
+
+	sum := sha256.Sum256(content)
+	return &staticAsset{
+		content: content,
+		etag:    `"` + hex.EncodeToString(sum[:8]) + `"`,
+		modTime: modTime,
+	}, nil
+}
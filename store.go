@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+// User is an account as stored, without its password hash
+type User struct {
+	UUID      string    `json:"uuid"`
+	Nickname  string    `json:"nickname"`
+	Email     string    `json:"email"`
+	Age       int       `json:"age"`
+	Gender    string    `json:"gender"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Role      Role      `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	AvatarURL string    `json:"avatar_url"`
+	// Uploaded avatar; empty while the user has the generated default
+	AvatarUUID string `json:"-"`
+}
+
+// UserStore persists accounts. Emails and nicknames are matched case-insensitively.
+type UserStore interface {
+	UserExists(email, nickname string) (bool, error)
+	// CreateUser returns ErrUserExists if the email or nickname is taken
+	CreateUser(user User, passwordHash string) error
+	// GetUserAuth looks up a user by email or nickname and returns the UUID
+	// and password hash, or ErrUserNotFound
+	GetUserAuth(identifier string) (userUUID, passwordHash string, err error)
+	// SetUserRole returns ErrUserNotFound for unknown UUIDs
+	SetUserRole(userUUID string, role Role) error
+	// GetUser returns ErrUserNotFound for unknown UUIDs
+	GetUser(userUUID string) (*User, error)
+	// GetUsers returns the users found among userUUIDs, keyed by UUID
+	GetUsers(userUUIDs []string) (map[string]User, error)
+	// SetAvatar records the user's new avatar, or "" for the generated
+	// default, and returns the previous one. Unknown users return
+	// ErrUserNotFound.
+	SetAvatar(userUUID, avatarUUID string) (previous string, err error)
+	// GetUsersByNickname looks up normalized nicknames and returns the users
+	// found, keyed by normalized nickname
+	GetUsersByNickname(nicknames []string) (map[string]User, error)
+	// SuspendUser blocks the user until the given time
+	SuspendUser(userUUID string, until time.Time, reason string) error
+	// BanUser blocks the user until the ban is lifted
+	BanUser(userUUID string, bannedAt time.Time, reason string) error
+	// LiftSuspension ends any suspension or ban
+	LiftSuspension(userUUID string) error
+	// GetSuspension returns the user's active suspension or ban, or nil
+	GetSuspension(userUUID string) (*Suspension, error)
+}
+
+// SessionStore persists login sessions
+type SessionStore interface {
+	CreateSession(session Session) error
+	// GetSession returns ErrSessionNotFound for unknown or expired sessions.
+	// The returned session carries the user's current role.
+	GetSession(sessionUUID string) (*Session, error)
+	DeleteSession(sessionUUID string) error
+}
+
+// PostStore persists posts together with their categories
+type PostStore interface {
+	// CreatePost stores the post and claims its attachments, all or
+	// nothing. It returns ErrAttachmentNotFound unless every file was
+	// uploaded by the author and is not attached to anything yet.
+	CreatePost(post Post, attachmentUUIDs []string) error
+	// GetPosts returns up to filter.Limit live posts matching the filter in
+	// its sort order, each with its author
+	GetPosts(filter FeedFilter) ([]Post, error)
+	// GetPost returns ErrPostNotFound for unknown UUIDs; deleted posts are
+	// returned with Deleted set and their content replaced by a placeholder
+	GetPost(postUUID string) (*Post, error)
+	// UpdatePost records the current version as a revision and replaces the
+	// title, content and categories. Deleted posts return ErrPostNotFound.
+	UpdatePost(post Post, editorUUID string, editedAt time.Time) error
+	// DeletePost soft-deletes a post, returning ErrPostNotFound if it is
+	// unknown or already deleted
+	DeletePost(postUUID string, deletedAt time.Time) error
+	GetPostRevisions(postUUID string) ([]PostRevision, error)
+}
+
+// CommentStore persists comments on posts
+type CommentStore interface {
+	// CreateComment stores the comment together with the notification for
+	// the post author, if any, both or neither. It returns ErrPostNotFound
+	// if the post is unknown or deleted.
+	CreateComment(comment Comment, notification *Notification) error
+	// GetComments returns a post's comments, oldest first. Deleted comments
+	// keep their place with Deleted set and placeholder content.
+	GetComments(postUUID string) ([]Comment, error)
+	// GetComment returns ErrCommentNotFound for unknown UUIDs
+	GetComment(commentUUID string) (*Comment, error)
+	// UpdateComment replaces the content; deleted comments return ErrCommentNotFound
+	UpdateComment(commentUUID, content string, editedAt time.Time) error
+	// DeleteComment soft-deletes a comment, returning ErrCommentNotFound if it
+	// is unknown or already deleted
+	DeleteComment(commentUUID string, deletedAt time.Time) error
+}
+
+// MessageStore persists private chat messages
+type MessageStore interface {
+	// SaveMessage stores the message and claims its attachments like CreatePost
+	SaveMessage(messageUUID string, msg Message, createdAt time.Time, attachmentUUIDs []string) error
+	// LoadMessages returns one page of the conversation, oldest first
+	LoadMessages(userA, userB string, limit, offset int) ([]Message, error)
+	// GetMessage returns ErrMessageNotFound for unknown UUIDs
+	GetMessage(messageUUID string) (*Message, error)
+	// DeleteMessage soft-deletes a message, returning ErrMessageNotFound if
+	// it is unknown or already deleted
+	DeleteMessage(messageUUID string, deletedAt time.Time) error
+}
+
+// ReportStore persists content reports and the moderation actions on them
+type ReportStore interface {
+	// CreateReport returns ErrReportExists if the reporter already has an
+	// open report on the same target
+	CreateReport(report Report) error
+	// GetReport returns the report with its actions, or ErrReportNotFound
+	GetReport(reportUUID string) (*Report, error)
+	// ListReports returns reports matching the filter, oldest first
+	ListReports(filter ReportFilter) ([]Report, error)
+	// ResolveReport closes an open report and records the action taken,
+	// returning ErrReportNotFound if the report is unknown or already closed
+	ResolveReport(status ReportStatus, action ReportAction) error
+}
+
+// ReactionStore persists likes and dislikes on posts and comments. Missing
+// or deleted targets return ErrPostNotFound or ErrCommentNotFound.
+type ReactionStore interface {
+	SetReaction(userUUID string, targetType ReactionTarget, targetUUID string, like bool) (ReactionCounts, error)
+	RemoveReaction(userUUID string, targetType ReactionTarget, targetUUID string) (ReactionCounts, error)
+}
+
+// MentionStore records which users a post, comment or message mentions
+type MentionStore interface {
+	// AddMentions records the users mentioned by a target and returns those
+	// not recorded for it before
+	AddMentions(targetType, targetUUID string, userUUIDs []string, at time.Time) (added []string, err error)
+}
+
+// AttachmentStore persists metadata about uploaded files; the contents
+// live in a BlobStore
+type AttachmentStore interface {
+	CreateAttachment(a Attachment) error
+	// GetAttachment returns ErrAttachmentNotFound for unknown UUIDs
+	GetAttachment(attachmentUUID string) (*Attachment, error)
+	// DeleteUnclaimedAttachments removes the attachments uploaded before
+	// cutoff that no post or message claimed, returning what it removed
+	DeleteUnclaimedAttachments(cutoff time.Time) ([]Attachment, error)
+	// ListAttachments returns each owner's attachments in upload order
+	ListAttachments(ownerType string, ownerUUIDs []string) (map[string][]Attachment, error)
+}
+
+// NotificationStore persists notifications and the types each user wants
+type NotificationStore interface {
+	CreateNotification(n Notification) error
+	// CreateNotificationOnce stores n unless the recipient already has a
+	// notification of the same type from the same actor about the same
+	// target, and reports whether it did
+	CreateNotificationOnce(n Notification) (bool, error)
+	// ListNotifications returns one page, newest first
+	ListNotifications(userUUID string, unreadOnly bool, limit, offset int) ([]Notification, error)
+	CountUnread(userUUID string) (int, error)
+	// MarkNotificationRead returns ErrNotificationNotFound unless the
+	// notification belongs to the user
+	MarkNotificationRead(userUUID, notificationUUID string, readAt time.Time) error
+	MarkAllNotificationsRead(userUUID string, readAt time.Time) error
+	// GetNotificationPreferences returns every type, enabled by default
+	GetNotificationPreferences(userUUID string) (NotificationPreferences, error)
+	// SetNotificationPreferences changes only the types present in changes
+	SetNotificationPreferences(userUUID string, changes NotificationPreferences) error
+}
+
+// CategoryFollowStore records which categories each user follows
+type CategoryFollowStore interface {
+	// FollowCategory and UnfollowCategory succeed whether or not the user
+	// already follows the category
+	FollowCategory(userUUID, category string, at time.Time) error
+	UnfollowCategory(userUUID, category string) error
+	// FollowedCategories returns the user's categories in name order
+	FollowedCategories(userUUID string) ([]string, error)
+}
+
+// AuditStore is the append-only audit log
+type AuditStore interface {
+	RecordEvent(event AuditEvent) error
+	// ListEvents returns events matching the filter, oldest first
+	ListEvents(filter AuditFilter) ([]AuditEvent, error)
+}
+
+// Stores bundles every repository the server depends on
+type Stores struct {
+	Users    UserStore
+	Sessions SessionStore
+	Posts    PostStore
+	Comments CommentStore
+	Messages MessageStore
+	Reports  ReportStore
+	Audit    AuditStore
+
+	Reactions     ReactionStore
+	Notifications NotificationStore
+	Mentions      MentionStore
+	Attachments   AttachmentStore
+	Follows       CategoryFollowStore
+}
@@ -0,0 +1,965 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-memory implementation of every store interface,
+// meant for tests and local experiments. It is safe for concurrent use.
+type MemoryStore struct {
+	mu       sync.Mutex
+	users    map[string]memoryUser // key = user UUID
+	sessions map[string]Session    // key = session UUID
+	posts    []Post                // raw content, even when Deleted is set
+	comments []Comment             // raw content, even when Deleted is set
+	messages []memoryMessage
+
+	revisions map[string][]PostRevision // key = post UUID
+	reports   []Report                  // with their actions attached
+	audit     []AuditEvent
+
+	reactions     map[memoryReactionKey]bool // true = like
+	notifications []Notification
+	mentions      map[memoryMentionKey]bool
+	notifyPrefs   map[string]NotificationPreferences // key = user UUID, changed types only
+	attachments   []Attachment
+	follows       map[string]map[string]bool // key = user UUID, then category
+}
+
+type memoryMentionKey struct {
+	targetType, targetUUID, userUUID string
+}
+
+type memoryReactionKey struct {
+	userUUID   string
+	targetType ReactionTarget
+	targetUUID string
+}
+
+type memoryUser struct {
+	User
+	passwordHash     string
+	bannedAt         time.Time
+	suspendedUntil   time.Time
+	suspensionReason string
+}
+
+type memoryMessage struct {
+	Message   // raw content, even when Deleted is set
+	createdAt time.Time
+}
+
+// NewMemoryStores returns Stores backed by a single fresh MemoryStore
+func NewMemoryStores() Stores {
+	s := NewMemoryStore()
+	return Stores{
+		Users: s, Sessions: s, Posts: s, Comments: s, Messages: s, Reports: s, Audit: s,
+		Reactions: s, Notifications: s, Mentions: s, Attachments: s, Follows: s,
+	}
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:     make(map[string]memoryUser),
+		sessions:  make(map[string]Session),
+		revisions: make(map[string][]PostRevision),
+
+		reactions:   make(map[memoryReactionKey]bool),
+		mentions:    make(map[memoryMentionKey]bool),
+		notifyPrefs: make(map[string]NotificationPreferences),
+		follows:     make(map[string]map[string]bool),
+	}
+}
+
+func (s *MemoryStore) UserExists(email, nickname string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.userExistsLocked(email, nickname), nil
+}
+
+func (s *MemoryStore) userExistsLocked(email, nickname string) bool {
+	email, nickname = NormalizeEmail(email), NormalizeNickname(nickname)
+	for _, u := range s.users {
+		if u.Email == email || NormalizeNickname(u.Nickname) == nickname {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) CreateUser(u User, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.userExistsLocked(u.Email, u.Nickname) {
+		return ErrUserExists
+	}
+	u.Email = NormalizeEmail(u.Email)
+	if u.Role == "" {
+		u.Role = RoleUser
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now()
+	}
+	s.users[u.UUID] = memoryUser{User: u, passwordHash: passwordHash}
+	return nil
+}
+
+func (s *MemoryStore) GetUserAuth(identifier string) (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	email, nickname := NormalizeEmail(identifier), NormalizeNickname(identifier)
+	for _, u := range s.users {
+		if u.Email == email || NormalizeNickname(u.Nickname) == nickname {
+			return u.UUID, u.passwordHash, nil
+		}
+	}
+	return "", "", ErrUserNotFound
+}
+
+func (s *MemoryStore) SetUserRole(userUUID string, role Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userUUID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.Role = role
+	s.users[userUUID] = u
+	return nil
+}
+
+func (s *MemoryStore) SuspendUser(userUUID string, until time.Time, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userUUID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.suspendedUntil, u.suspensionReason = until, reason
+	s.users[userUUID] = u
+	return nil
+}
+
+func (s *MemoryStore) BanUser(userUUID string, bannedAt time.Time, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userUUID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.bannedAt, u.suspensionReason = bannedAt, reason
+	s.users[userUUID] = u
+	return nil
+}
+
+func (s *MemoryStore) LiftSuspension(userUUID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userUUID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.bannedAt, u.suspendedUntil, u.suspensionReason = time.Time{}, time.Time{}, ""
+	s.users[userUUID] = u
+	return nil
+}
+
+func (s *MemoryStore) GetSuspension(userUUID string) (*Suspension, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userUUID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return activeSuspension(u.bannedAt, u.suspendedUntil, u.suspensionReason, time.Now()), nil
+}
+
+func (s *MemoryStore) GetUser(userUUID string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userUUID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	user := u.User
+	user.setAvatarURL()
+	return &user, nil
+}
+
+func (s *MemoryStore) GetUsers(userUUIDs []string) (map[string]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := map[string]User{}
+	for _, id := range userUUIDs {
+		if u, ok := s.users[id]; ok {
+			user := u.User
+			user.setAvatarURL()
+			users[id] = user
+		}
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) SetAvatar(userUUID, avatarUUID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userUUID]
+	if !ok {
+		return "", ErrUserNotFound
+	}
+	previous := u.AvatarUUID
+	u.AvatarUUID = avatarUUID
+	s.users[userUUID] = u
+	return previous, nil
+}
+
+func (s *MemoryStore) GetUsersByNickname(nicknames []string) (map[string]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := map[string]User{}
+	for _, u := range s.users {
+		if normalized := NormalizeNickname(u.Nickname); slices.Contains(nicknames, normalized) {
+			user := u.User
+			user.setAvatarURL()
+			users[normalized] = user
+		}
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) CreateSession(session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.SessionUUID] = session
+	return nil
+}
+
+func (s *MemoryStore) GetSession(sessionUUID string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[sessionUUID]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+	u := s.users[session.UserUUID]
+	session.Role = u.Role
+	session.Suspension = activeSuspension(u.bannedAt, u.suspendedUntil, u.suspensionReason, time.Now())
+	return &session, nil
+}
+
+func (s *MemoryStore) DeleteSession(sessionUUID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sessionUUID)
+	return nil
+}
+
+func (s *MemoryStore) CreatePost(p Post, attachmentUUIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.linkAttachmentsLocked(p.AuthorUUID, "post", p.UUID, attachmentUUIDs); err != nil {
+		return err
+	}
+	p.Categories = append([]string{}, p.Categories...)
+	p.HotScore = hotScore(0, 0, p.CreatedAt)
+	s.posts = append(s.posts, p)
+	return nil
+}
+
+// authorLocked is what posts and comments show about userUUID
+func (s *MemoryStore) authorLocked(userUUID string) Author {
+	u, ok := s.users[userUUID]
+	if !ok {
+		return Author{Role: RoleUser, AvatarURL: avatarURL(userUUID, "")}
+	}
+	return Author{Nickname: u.Nickname, Role: u.Role, AvatarURL: avatarURL(userUUID, u.AvatarUUID)}
+}
+
+func (s *MemoryStore) GetPosts(f FeedFilter) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	posts := []Post{}
+	for _, p := range s.posts {
+		if p.Deleted || (f.Category != "" && !slices.Contains(p.Categories, f.Category)) {
+			continue
+		}
+		if f.Author != "" && NormalizeNickname(s.users[p.AuthorUUID].Nickname) != f.Author {
+			continue
+		}
+		if f.AuthorUUID != "" && p.AuthorUUID != f.AuthorUUID {
+			continue
+		}
+		if f.LikedBy != "" && !s.reactions[memoryReactionKey{f.LikedBy, ReactionOnPost, p.UUID}] {
+			continue
+		}
+		if f.FollowedBy != "" && !slices.ContainsFunc(p.Categories, func(c string) bool { return s.follows[f.FollowedBy][c] }) {
+			continue
+		}
+		if p.CreatedAt.Before(f.Since) || (f.After != nil && !f.After.precedes(p)) {
+			continue
+		}
+		p.Categories = append([]string{}, p.Categories...)
+		p.Author = s.authorLocked(p.AuthorUUID)
+		posts = append(posts, p)
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		return feedCursorAt(f, posts[i]).precedes(posts[j])
+	})
+	if len(posts) > f.Limit {
+		posts = posts[:f.Limit]
+	}
+	return posts, nil
+}
+
+func (s *MemoryStore) findPostLocked(postUUID string) *Post {
+	for i := range s.posts {
+		if s.posts[i].UUID == postUUID {
+			return &s.posts[i]
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetPost(postUUID string) (*Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.findPostLocked(postUUID)
+	if p == nil {
+		return nil, ErrPostNotFound
+	}
+	post := *p
+	post.Author = s.authorLocked(post.AuthorUUID)
+	if post.Deleted {
+		post.Title, post.Content, post.Categories = deletedPlaceholder, deletedPlaceholder, []string{}
+	} else {
+		post.Categories = append([]string{}, p.Categories...)
+	}
+	return &post, nil
+}
+
+func (s *MemoryStore) UpdatePost(post Post, editorUUID string, editedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.findPostLocked(post.UUID)
+	if p == nil || p.Deleted {
+		return ErrPostNotFound
+	}
+	s.revisions[p.UUID] = append(s.revisions[p.UUID], PostRevision{
+		PostUUID:   p.UUID,
+		EditorUUID: editorUUID,
+		Title:      p.Title,
+		Content:    p.Content,
+		Categories: p.Categories,
+		ReplacedAt: editedAt,
+	})
+	p.Title, p.Content = post.Title, post.Content
+	p.Categories = append([]string{}, post.Categories...)
+	p.EditedAt = &editedAt
+	return nil
+}
+
+func (s *MemoryStore) DeletePost(postUUID string, deletedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.findPostLocked(postUUID)
+	if p == nil || p.Deleted {
+		return ErrPostNotFound
+	}
+	p.Deleted = true
+	return nil
+}
+
+func (s *MemoryStore) GetPostRevisions(postUUID string) ([]PostRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]PostRevision{}, s.revisions[postUUID]...), nil
+}
+
+func (s *MemoryStore) GetComments(postUUID string) ([]Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	comments := []Comment{}
+	for _, c := range s.comments {
+		if c.PostUUID == postUUID {
+			c.Author = s.authorLocked(c.AuthorUUID)
+			comments = append(comments, redactComment(c))
+		}
+	}
+	return comments, nil
+}
+
+func redactComment(c Comment) Comment {
+	if c.Deleted {
+		c.Content = deletedPlaceholder
+	}
+	return c
+}
+
+func (s *MemoryStore) findCommentLocked(commentUUID string) *Comment {
+	for i := range s.comments {
+		if s.comments[i].UUID == commentUUID {
+			return &s.comments[i]
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateComment(c Comment, n *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.findPostLocked(c.PostUUID)
+	if p == nil || p.Deleted {
+		return ErrPostNotFound
+	}
+	p.CommentCount++
+	s.comments = append(s.comments, c)
+	if n != nil {
+		s.notifications = append(s.notifications, *n)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetComment(commentUUID string) (*Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.findCommentLocked(commentUUID)
+	if c == nil {
+		return nil, ErrCommentNotFound
+	}
+	comment := redactComment(*c)
+	comment.Author = s.authorLocked(comment.AuthorUUID)
+	return &comment, nil
+}
+
+func (s *MemoryStore) UpdateComment(commentUUID, content string, editedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.findCommentLocked(commentUUID)
+	if c == nil || c.Deleted {
+		return ErrCommentNotFound
+	}
+	c.Content = content
+	c.EditedAt = &editedAt
+	return nil
+}
+
+func (s *MemoryStore) DeleteComment(commentUUID string, deletedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.findCommentLocked(commentUUID)
+	if c == nil || c.Deleted {
+		return ErrCommentNotFound
+	}
+	c.Deleted = true
+	if p := s.findPostLocked(c.PostUUID); p != nil && p.CommentCount > 0 {
+		p.CommentCount--
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveMessage(messageUUID string, msg Message, createdAt time.Time, attachmentUUIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.linkAttachmentsLocked(msg.From, "message", messageUUID, attachmentUUIDs); err != nil {
+		return err
+	}
+	msg.UUID = messageUUID
+	msg.SentAt = createdAt.Format(time.RFC3339)
+	s.messages = append(s.messages, memoryMessage{Message: msg, createdAt: createdAt})
+	return nil
+}
+
+func (s *MemoryStore) LoadMessages(userA, userB string, limit, offset int) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Newest first, like the SQL query, then page and flip back to oldest first
+	var conversation []memoryMessage
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		m := s.messages[i]
+		if (m.From == userA && m.To == userB) || (m.From == userB && m.To == userA) {
+			conversation = append(conversation, m)
+		}
+	}
+	sort.SliceStable(conversation, func(i, j int) bool {
+		return conversation[i].createdAt.After(conversation[j].createdAt)
+	})
+
+	messages := []Message{}
+	for i := offset; i < len(conversation) && i < offset+limit; i++ {
+		messages = append(messages, redactMessage(conversation[i].Message))
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func redactMessage(m Message) Message {
+	if m.Deleted {
+		m.Content = deletedPlaceholder
+	}
+	return m
+}
+
+func (s *MemoryStore) findMessageLocked(messageUUID string) *memoryMessage {
+	for i := range s.messages {
+		if s.messages[i].UUID == messageUUID {
+			return &s.messages[i]
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetMessage(messageUUID string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.findMessageLocked(messageUUID)
+	if m == nil {
+		return nil, ErrMessageNotFound
+	}
+	msg := redactMessage(m.Message)
+	return &msg, nil
+}
+
+func (s *MemoryStore) DeleteMessage(messageUUID string, deletedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.findMessageLocked(messageUUID)
+	if m == nil || m.Deleted {
+		return ErrMessageNotFound
+	}
+	m.Deleted = true
+	return nil
+}
+
+func (s *MemoryStore) CreateReport(r Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.reports {
+		if existing.Status == ReportOpen && existing.ReporterUUID == r.ReporterUUID &&
+			existing.TargetType == r.TargetType && existing.TargetUUID == r.TargetUUID {
+			return ErrReportExists
+		}
+	}
+	r.Actions = nil
+	s.reports = append(s.reports, r)
+	return nil
+}
+
+func (s *MemoryStore) findReportLocked(reportUUID string) *Report {
+	for i := range s.reports {
+		if s.reports[i].UUID == reportUUID {
+			return &s.reports[i]
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetReport(reportUUID string) (*Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.findReportLocked(reportUUID)
+	if r == nil {
+		return nil, ErrReportNotFound
+	}
+	report := *r
+	report.Actions = append([]ReportAction{}, r.Actions...)
+	return &report, nil
+}
+
+func (s *MemoryStore) ListReports(f ReportFilter) ([]Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reports := []Report{}
+	skipped := 0
+	for _, r := range s.reports {
+		if (f.Status != "" && r.Status != f.Status) || (f.TargetType != "" && r.TargetType != f.TargetType) {
+			continue
+		}
+		if skipped < f.Offset {
+			skipped++
+			continue
+		}
+		if len(reports) == f.Limit {
+			break
+		}
+		r.Actions = nil
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+func (s *MemoryStore) ResolveReport(status ReportStatus, action ReportAction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.findReportLocked(action.ReportUUID)
+	if r == nil || r.Status != ReportOpen {
+		return ErrReportNotFound
+	}
+	r.Status = status
+	r.ResolvedAt = &action.CreatedAt
+	r.ResolvedBy = action.ModeratorUUID
+	r.Actions = append(r.Actions, action)
+	return nil
+}
+
+func (s *MemoryStore) RecordEvent(e AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.ID = int64(len(s.audit) + 1)
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+func (s *MemoryStore) ListEvents(f AuditFilter) ([]AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []AuditEvent{}
+	for _, e := range s.audit {
+		if len(events) == f.Limit {
+			break
+		}
+		if e.ID <= f.AfterID ||
+			(f.ActorUUID != "" && e.ActorUUID != f.ActorUUID) ||
+			(f.Action != "" && e.Action != f.Action) ||
+			(!f.Since.IsZero() && e.CreatedAt.Before(f.Since)) ||
+			(!f.Until.IsZero() && !e.CreatedAt.Before(f.Until)) {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// reactionCountersLocked returns the like and dislike counters of a live
+// post or comment
+func (s *MemoryStore) reactionCountersLocked(targetType ReactionTarget, targetUUID string) (likes, dislikes *int, err error) {
+	switch targetType {
+	case ReactionOnPost:
+		p := s.findPostLocked(targetUUID)
+		if p == nil || p.Deleted {
+			return nil, nil, ErrPostNotFound
+		}
+		return &p.Likes, &p.Dislikes, nil
+	case ReactionOnComment:
+		c := s.findCommentLocked(targetUUID)
+		if c == nil || c.Deleted {
+			return nil, nil, ErrCommentNotFound
+		}
+		return &c.Likes, &c.Dislikes, nil
+	}
+	return nil, nil, fmt.Errorf("unknown reaction target %q", targetType)
+}
+
+// rescorePostLocked keeps a post's hot score in step with its counters
+func (s *MemoryStore) rescorePostLocked(targetType ReactionTarget, targetUUID string) {
+	if targetType != ReactionOnPost {
+		return
+	}
+	p := s.findPostLocked(targetUUID)
+	p.HotScore = hotScore(p.Likes, p.Dislikes, p.CreatedAt)
+}
+
+func (s *MemoryStore) SetReaction(userUUID string, targetType ReactionTarget, targetUUID string, like bool) (ReactionCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	likes, dislikes, err := s.reactionCountersLocked(targetType, targetUUID)
+	if err != nil {
+		return ReactionCounts{}, err
+	}
+	key := memoryReactionKey{userUUID, targetType, targetUUID}
+	if prev, ok := s.reactions[key]; ok {
+		if prev {
+			*likes--
+		} else {
+			*dislikes--
+		}
+	}
+	if like {
+		*likes++
+	} else {
+		*dislikes++
+	}
+	s.reactions[key] = like
+	s.rescorePostLocked(targetType, targetUUID)
+	return ReactionCounts{Likes: *likes, Dislikes: *dislikes, Reaction: reactionName(like)}, nil
+}
+
+func (s *MemoryStore) RemoveReaction(userUUID string, targetType ReactionTarget, targetUUID string) (ReactionCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	likes, dislikes, err := s.reactionCountersLocked(targetType, targetUUID)
+	if err != nil {
+		return ReactionCounts{}, err
+	}
+	key := memoryReactionKey{userUUID, targetType, targetUUID}
+	if prev, ok := s.reactions[key]; ok {
+		if prev {
+			*likes--
+		} else {
+			*dislikes--
+		}
+		delete(s.reactions, key)
+		s.rescorePostLocked(targetType, targetUUID)
+	}
+	return ReactionCounts{Likes: *likes, Dislikes: *dislikes}, nil
+}
+
+func (s *MemoryStore) CreateNotification(n Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.notifications = append(s.notifications, n)
+	return nil
+}
+
+func (s *MemoryStore) CreateNotificationOnce(n Notification) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.notifications {
+		if existing.TargetUUID == n.TargetUUID && existing.TargetType == n.TargetType &&
+			existing.ActorUUID == n.ActorUUID && existing.UserUUID == n.UserUUID && existing.Type == n.Type {
+			return false, nil
+		}
+	}
+	s.notifications = append(s.notifications, n)
+	return true, nil
+}
+
+func (s *MemoryStore) ListNotifications(userUUID string, unreadOnly bool, limit, offset int) ([]Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notifications := []Notification{}
+	for i := len(s.notifications) - 1; i >= 0 && len(notifications) < limit; i-- {
+		n := s.notifications[i]
+		if n.UserUUID != userUUID || (unreadOnly && n.ReadAt != nil) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
+
+func (s *MemoryStore) CountUnread(userUUID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unread := 0
+	for _, n := range s.notifications {
+		if n.UserUUID == userUUID && n.ReadAt == nil {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+func (s *MemoryStore) MarkNotificationRead(userUUID, notificationUUID string, readAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.notifications {
+		n := &s.notifications[i]
+		if n.UUID != notificationUUID || n.UserUUID != userUUID {
+			continue
+		}
+		if n.ReadAt == nil {
+			n.ReadAt = &readAt
+		}
+		return nil
+	}
+	return ErrNotificationNotFound
+}
+
+func (s *MemoryStore) MarkAllNotificationsRead(userUUID string, readAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.notifications {
+		if n := &s.notifications[i]; n.UserUUID == userUUID && n.ReadAt == nil {
+			n.ReadAt = &readAt
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetNotificationPreferences(userUUID string) (NotificationPreferences, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefs := defaultNotificationPreferences()
+	for t, enabled := range s.notifyPrefs[userUUID] {
+		prefs[t] = enabled
+	}
+	return prefs, nil
+}
+
+func (s *MemoryStore) SetNotificationPreferences(userUUID string, changes NotificationPreferences) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.notifyPrefs[userUUID] == nil {
+		s.notifyPrefs[userUUID] = NotificationPreferences{}
+	}
+	for t, enabled := range changes {
+		s.notifyPrefs[userUUID][t] = enabled
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddMentions(targetType, targetUUID string, userUUIDs []string, at time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added := []string{}
+	for _, userUUID := range userUUIDs {
+		key := memoryMentionKey{targetType, targetUUID, userUUID}
+		if !s.mentions[key] {
+			s.mentions[key] = true
+			added = append(added, userUUID)
+		}
+	}
+	return added, nil
+}
+
+func (s *MemoryStore) CreateAttachment(a Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a.setURLs()
+	s.attachments = append(s.attachments, a)
+	return nil
+}
+
+func (s *MemoryStore) GetAttachment(attachmentUUID string) (*Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range s.attachments {
+		if a.UUID == attachmentUUID {
+			return &a, nil
+		}
+	}
+	return nil, ErrAttachmentNotFound
+}
+
+// linkAttachmentsLocked claims attachments for a new post or message,
+// checking everything first so a failure links nothing
+func (s *MemoryStore) linkAttachmentsLocked(uploaderUUID, ownerType, ownerUUID string, attachmentUUIDs []string) error {
+	indexes := make([]int, 0, len(attachmentUUIDs))
+	for _, attachmentUUID := range attachmentUUIDs {
+		i := slices.IndexFunc(s.attachments, func(a Attachment) bool { return a.UUID == attachmentUUID })
+		if i < 0 || s.attachments[i].UploaderUUID != uploaderUUID || s.attachments[i].OwnerType != "" ||
+			slices.Contains(indexes, i) {
+			return ErrAttachmentNotFound
+		}
+		indexes = append(indexes, i)
+	}
+	for _, i := range indexes {
+		s.attachments[i].OwnerType = ownerType
+		s.attachments[i].OwnerUUID = ownerUUID
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteUnclaimedAttachments(cutoff time.Time) ([]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted []Attachment
+	s.attachments = slices.DeleteFunc(s.attachments, func(a Attachment) bool {
+		if a.OwnerType != "" || !a.CreatedAt.Before(cutoff) {
+			return false
+		}
+		deleted = append(deleted, a)
+		return true
+	})
+	return deleted, nil
+}
+
+func (s *MemoryStore) ListAttachments(ownerType string, ownerUUIDs []string) (map[string][]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byOwner := map[string][]Attachment{}
+	for _, a := range s.attachments {
+		if a.OwnerType == ownerType && slices.Contains(ownerUUIDs, a.OwnerUUID) {
+			byOwner[a.OwnerUUID] = append(byOwner[a.OwnerUUID], a)
+		}
+	}
+	return byOwner, nil
+}
+
+func (s *MemoryStore) FollowCategory(userUUID, category string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.follows[userUUID] == nil {
+		s.follows[userUUID] = map[string]bool{}
+	}
+	s.follows[userUUID][category] = true
+	return nil
+}
+
+func (s *MemoryStore) UnfollowCategory(userUUID, category string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.follows[userUUID], category)
+	return nil
+}
+
+func (s *MemoryStore) FollowedCategories(userUUID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	categories := []string{}
+	for category := range s.follows[userUUID] {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// SQLiteStore implements every store interface on top of the functions in db.go
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStores returns Stores backed by db
+func NewSQLiteStores(db *sql.DB) Stores {
+	s := &SQLiteStore{db: db}
+	return Stores{
+		Users: s, Sessions: s, Posts: s, Comments: s, Messages: s, Reports: s, Audit: s,
+		Reactions: s, Notifications: s, Mentions: s, Attachments: s, Follows: s,
+	}
+}
+
+func (s *SQLiteStore) UserExists(email, nickname string) (bool, error) {
+	return UserExists(s.db, email, nickname)
+}
+
+func (s *SQLiteStore) CreateUser(u User, passwordHash string) error {
+	return InsertUserFull(s.db, u.UUID, u.Nickname, u.Email, passwordHash, u.Age, u.Gender, u.FirstName, u.LastName)
+}
+
+func (s *SQLiteStore) GetUserAuth(identifier string) (string, string, error) {
+	userUUID, hash, err := GetUserByEmailOrNickname(s.db, identifier)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrUserNotFound
+	}
+	return userUUID, hash, err
+}
+
+func (s *SQLiteStore) SetUserRole(userUUID string, role Role) error {
+	return SetUserRole(s.db, userUUID, role)
+}
+
+func (s *SQLiteStore) SuspendUser(userUUID string, until time.Time, reason string) error {
+	return SuspendUser(s.db, userUUID, until, reason)
+}
+
+func (s *SQLiteStore) GetUser(userUUID string) (*User, error) {
+	return GetUser(s.db, userUUID)
+}
+
+func (s *SQLiteStore) BanUser(userUUID string, bannedAt time.Time, reason string) error {
+	return BanUser(s.db, userUUID, bannedAt, reason)
+}
+
+func (s *SQLiteStore) LiftSuspension(userUUID string) error {
+	return LiftSuspension(s.db, userUUID)
+}
+
+func (s *SQLiteStore) GetSuspension(userUUID string) (*Suspension, error) {
+	return GetUserSuspension(s.db, userUUID)
+}
+
+func (s *SQLiteStore) CreateSession(session Session) error {
+	return CreateSession(s.db, session.SessionUUID, session.UserUUID, session.CSRFToken, session.ExpiresAt)
+}
+
+func (s *SQLiteStore) GetSession(sessionUUID string) (*Session, error) {
+	return GetSession(s.db, sessionUUID)
+}
+
+func (s *SQLiteStore) DeleteSession(sessionUUID string) error {
+	return DeleteSession(s.db, sessionUUID)
+}
+
+// CreatePost writes the post and its categories and claims its attachments atomically
+func (s *SQLiteStore) CreatePost(p Post, attachmentUUIDs []string) error {
+	return WithTx(s.db, func(tx *sql.Tx) error {
+		if err := InsertPost(tx, p.UUID, p.AuthorUUID, p.Title, p.Content, p.CreatedAt); err != nil {
+			return err
+		}
+		if err := InsertPostCategories(tx, p.UUID, p.Categories); err != nil {
+			return err
+		}
+		return LinkAttachments(tx, p.AuthorUUID, "post", p.UUID, attachmentUUIDs)
+	})
+}
+
+func (s *SQLiteStore) GetPosts(f FeedFilter) ([]Post, error) {
+	return GetPosts(s.db, f)
+}
+
+func (s *SQLiteStore) GetPost(postUUID string) (*Post, error) {
+	return GetPost(s.db, postUUID)
+}
+
+func (s *SQLiteStore) UpdatePost(p Post, editorUUID string, editedAt time.Time) error {
+	return UpdatePost(s.db, p, editorUUID, editedAt)
+}
+
+func (s *SQLiteStore) DeletePost(postUUID string, deletedAt time.Time) error {
+	return SoftDeletePost(s.db, postUUID, deletedAt)
+}
+
+func (s *SQLiteStore) GetPostRevisions(postUUID string) ([]PostRevision, error) {
+	return GetPostRevisions(s.db, postUUID)
+}
+
+func (s *SQLiteStore) GetComments(postUUID string) ([]Comment, error) {
+	return GetComments(s.db, postUUID)
+}
+
+// CreateComment writes the comment, its post's count and the notification atomically
+func (s *SQLiteStore) CreateComment(c Comment, n *Notification) error {
+	return WithTx(s.db, func(tx *sql.Tx) error {
+		if err := InsertComment(tx, c.UUID, c.PostUUID, c.AuthorUUID, c.Content, c.CreatedAt); err != nil {
+			return err
+		}
+		if n == nil {
+			return nil
+		}
+		return InsertNotification(tx, *n)
+	})
+}
+
+func (s *SQLiteStore) GetComment(commentUUID string) (*Comment, error) {
+	return GetComment(s.db, commentUUID)
+}
+
+func (s *SQLiteStore) UpdateComment(commentUUID, content string, editedAt time.Time) error {
+	return UpdateComment(s.db, commentUUID, content, editedAt)
+}
+
+func (s *SQLiteStore) DeleteComment(commentUUID string, deletedAt time.Time) error {
+	return SoftDeleteComment(s.db, commentUUID, deletedAt)
+}
+
+// SaveMessage writes the message and claims its attachments atomically
+func (s *SQLiteStore) SaveMessage(messageUUID string, msg Message, createdAt time.Time, attachmentUUIDs []string) error {
+	return WithTx(s.db, func(tx *sql.Tx) error {
+		if err := SaveMessage(tx, messageUUID, msg.From, msg.To, msg.Content, createdAt); err != nil {
+			return err
+		}
+		return LinkAttachments(tx, msg.From, "message", messageUUID, attachmentUUIDs)
+	})
+}
+
+func (s *SQLiteStore) LoadMessages(userA, userB string, limit, offset int) ([]Message, error) {
+	return LoadMessages(s.db, userA, userB, limit, offset)
+}
+
+func (s *SQLiteStore) GetMessage(messageUUID string) (*Message, error) {
+	return GetMessage(s.db, messageUUID)
+}
+
+func (s *SQLiteStore) DeleteMessage(messageUUID string, deletedAt time.Time) error {
+	return SoftDeleteMessage(s.db, messageUUID, deletedAt)
+}
+
+func (s *SQLiteStore) CreateReport(r Report) error {
+	return InsertReport(s.db, r)
+}
+
+func (s *SQLiteStore) GetReport(reportUUID string) (*Report, error) {
+	return GetReport(s.db, reportUUID)
+}
+
+func (s *SQLiteStore) ListReports(f ReportFilter) ([]Report, error) {
+	return ListReports(s.db, f)
+}
+
+func (s *SQLiteStore) ResolveReport(status ReportStatus, action ReportAction) error {
+	return ResolveReport(s.db, status, action)
+}
+
+func (s *SQLiteStore) RecordEvent(e AuditEvent) error {
+	return InsertAuditEvent(s.db, e)
+}
+
+func (s *SQLiteStore) ListEvents(f AuditFilter) ([]AuditEvent, error) {
+	return ListAuditEvents(s.db, f)
+}
+
+func (s *SQLiteStore) GetUsers(userUUIDs []string) (map[string]User, error) {
+	return GetUsers(s.db, userUUIDs)
+}
+
+func (s *SQLiteStore) SetAvatar(userUUID, avatarUUID string) (string, error) {
+	return SetUserAvatar(s.db, userUUID, avatarUUID)
+}
+
+func (s *SQLiteStore) GetUsersByNickname(nicknames []string) (map[string]User, error) {
+	return GetUsersByNickname(s.db, nicknames)
+}
+
+func (s *SQLiteStore) AddMentions(targetType, targetUUID string, userUUIDs []string, at time.Time) ([]string, error) {
+	return AddMentions(s.db, targetType, targetUUID, userUUIDs, at)
+}
+
+func (s *SQLiteStore) SetReaction(userUUID string, targetType ReactionTarget, targetUUID string, like bool) (ReactionCounts, error) {
+	return SetReaction(s.db, userUUID, targetType, targetUUID, like)
+}
+
+func (s *SQLiteStore) RemoveReaction(userUUID string, targetType ReactionTarget, targetUUID string) (ReactionCounts, error) {
+	return RemoveReaction(s.db, userUUID, targetType, targetUUID)
+}
+
+func (s *SQLiteStore) CreateNotification(n Notification) error {
+	return InsertNotification(s.db, n)
+}
+
+func (s *SQLiteStore) CreateNotificationOnce(n Notification) (bool, error) {
+	return InsertNotificationOnce(s.db, n)
+}
+
+func (s *SQLiteStore) ListNotifications(userUUID string, unreadOnly bool, limit, offset int) ([]Notification, error) {
+	return ListNotifications(s.db, userUUID, unreadOnly, limit, offset)
+}
+
+func (s *SQLiteStore) CountUnread(userUUID string) (int, error) {
+	return CountUnreadNotifications(s.db, userUUID)
+}
+
+func (s *SQLiteStore) MarkNotificationRead(userUUID, notificationUUID string, readAt time.Time) error {
+	return MarkNotificationRead(s.db, userUUID, notificationUUID, readAt)
+}
+
+func (s *SQLiteStore) MarkAllNotificationsRead(userUUID string, readAt time.Time) error {
+	return MarkAllNotificationsRead(s.db, userUUID, readAt)
+}
+
+func (s *SQLiteStore) GetNotificationPreferences(userUUID string) (NotificationPreferences, error) {
+	return GetNotificationPreferences(s.db, userUUID)
+}
+
+func (s *SQLiteStore) SetNotificationPreferences(userUUID string, changes NotificationPreferences) error {
+	return SetNotificationPreferences(s.db, userUUID, changes)
+}
+
+func (s *SQLiteStore) CreateAttachment(a Attachment) error {
+	return InsertAttachment(s.db, a)
+}
+
+func (s *SQLiteStore) GetAttachment(attachmentUUID string) (*Attachment, error) {
+	return GetAttachment(s.db, attachmentUUID)
+}
+
+func (s *SQLiteStore) DeleteUnclaimedAttachments(cutoff time.Time) ([]Attachment, error) {
+	return DeleteUnclaimedAttachments(s.db, cutoff)
+}
+
+func (s *SQLiteStore) ListAttachments(ownerType string, ownerUUIDs []string) (map[string][]Attachment, error) {
+	return ListAttachments(s.db, ownerType, ownerUUIDs)
+}
+
+func (s *SQLiteStore) FollowCategory(userUUID, category string, at time.Time) error {
+	return FollowCategory(s.db, userUUID, category, at)
+}
+
+func (s *SQLiteStore) UnfollowCategory(userUUID, category string) error {
+	return UnfollowCategory(s.db, userUUID, category)
+}
+
+func (s *SQLiteStore) FollowedCategories(userUUID string) ([]string, error) {
+	return GetFollowedCategories(s.db, userUUID)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Suspension keeps a user off the site, either until a given time or, for
+// bans, until staff lift it
+type Suspension struct {
+	Until     *time.Time `json:"until,omitempty"`
+	Permanent bool       `json:"permanent"`
+	Reason    string     `json:"reason"`
+}
+
+// activeSuspension returns the restriction in force at now, or nil. Zero
+// times mean the user was never banned or suspended.
+func activeSuspension(bannedAt, suspendedUntil time.Time, reason string, now time.Time) *Suspension {
+	if !bannedAt.IsZero() {
+		return &Suspension{Permanent: true, Reason: reason}
+	}
+	if suspendedUntil.After(now) {
+		return &Suspension{Until: &suspendedUntil, Reason: reason}
+	}
+	return nil
+}
+
+// Message explains the suspension to the affected user
+func (s *Suspension) Message() string {
+	msg := "Your account is banned"
+	if !s.Permanent {
+		msg = "Your account is suspended until " + s.Until.UTC().Format(time.RFC3339)
+	}
+	if s.Reason != "" {
+		msg += ": " + s.Reason
+	}
+	return msg
+}
+
+// writeSuspended responds 403 with the suspension details so clients can
+// show the reason and end date
+func writeSuspended(w http.ResponseWriter, susp *Suspension) {
+	code := codeSuspended
+	if susp.Permanent {
+		code = codeBanned
+	}
+	writeJSON(w, http.StatusForbidden, errorEnvelope{Error: APIError{
+		Code:       code,
+		Message:    susp.Message(),
+		Suspension: susp,
+	}})
+}
+
+// restrictableUser loads the user named in the URL and checks that the
+// current user outranks them, writing the error response when not
+func (s *Server) restrictableUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	target, err := s.users.GetUser(mux.Vars(r)["uuid"])
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return nil, false
+	}
+	if err != nil {
+		writeServerError(w, "Failed to fetch user", err)
+		return nil, false
+	}
+
+	role, _ := RoleFromContext(r.Context())
+	if !role.Outranks(target.Role) {
+		writeError(w, http.StatusForbidden, codeForbidden, "You can only restrict users below your role")
+		return nil, false
+	}
+	return target, true
+}
+
+// disconnectRestricted closes the user's live sockets so a suspension takes
+// effect immediately rather than when they next make a request
+func (s *Server) disconnectRestricted(userUUID string) {
+	susp, err := s.users.GetSuspension(userUUID)
+	if err != nil || susp == nil {
+		return
+	}
+	s.hub.DisconnectUser(userUUID, susp.Message())
+}
+
+type SuspendUserRequest struct {
+	Duration Duration `json:"duration"`
+	Reason   string   `json:"reason"`
+}
+
+func (s *Server) SuspendUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SuspendUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+
+		errs := ValidationErrors{}
+		if req.Duration <= 0 {
+			errs.add("duration", "duration must be positive, e.g. \"72h\"")
+		}
+		if req.Reason == "" {
+			errs.add("reason", "reason is required")
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		target, ok := s.restrictableUser(w, r)
+		if !ok {
+			return
+		}
+
+		until := time.Now().Add(req.Duration.Duration())
+		if err := s.users.SuspendUser(target.UUID, until, req.Reason); err != nil {
+			writeServerError(w, "Failed to suspend user", err)
+			return
+		}
+		s.disconnectRestricted(target.UUID)
+		actorUUID, _ := UserUUIDFromContext(r.Context())
+		s.audit(r, actorUUID, AuditUserSuspend, "user", target.UUID, req.Reason)
+
+		writeData(w, http.StatusOK, Suspension{Until: &until, Reason: req.Reason})
+	}
+}
+
+type BanUserRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (s *Server) BanUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BanUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		if req.Reason == "" {
+			writeValidationErrors(w, ValidationErrors{"reason": "reason is required"})
+			return
+		}
+
+		target, ok := s.restrictableUser(w, r)
+		if !ok {
+			return
+		}
+
+		if err := s.users.BanUser(target.UUID, time.Now(), req.Reason); err != nil {
+			writeServerError(w, "Failed to ban user", err)
+			return
+		}
+		s.disconnectRestricted(target.UUID)
+		actorUUID, _ := UserUUIDFromContext(r.Context())
+		s.audit(r, actorUUID, AuditUserBan, "user", target.UUID, req.Reason)
+
+		writeData(w, http.StatusOK, Suspension{Permanent: true, Reason: req.Reason})
+	}
+}
+
+// LiftSuspensionHandler ends a suspension early. Only admins may lift bans.
+func (s *Server) LiftSuspensionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target, ok := s.restrictableUser(w, r)
+		if !ok {
+			return
+		}
+
+		susp, err := s.users.GetSuspension(target.UUID)
+		if err != nil {
+			writeServerError(w, "Failed to fetch suspension", err)
+			return
+		}
+		if susp != nil && susp.Permanent {
+			if role, _ := RoleFromContext(r.Context()); !role.AtLeast(RoleAdmin) {
+				writeError(w, http.StatusForbidden, codeForbidden, "Only admins can lift a ban")
+				return
+			}
+		}
+
+		if err := s.users.LiftSuspension(target.UUID); err != nil {
+			writeServerError(w, "Failed to lift suspension", err)
+			return
+		}
+		actorUUID, _ := UserUUIDFromContext(r.Context())
+		s.audit(r, actorUUID, AuditSuspensionLift, "user", target.UUID, "")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,81 @@
+--Users table
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT UNIQUE NOT NULL,
+    nickname TEXT UNIQUE NOT NULL,
+    email TEXT UNIQUE NOT NULL,
+    age INTEGER NOT NULL,
+    gender TEXT,
+    first_name TEXT,
+    last_name TEXT,
+    password_hash TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+--Sessions table
+CREATE TABLE IF NOT EXISTS sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    session_uuid TEXT UNIQUE NOT NULL,
+    user_uuid TEXT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid)
+);
+
+-- Categories table
+CREATE TABLE IF NOT EXISTS categories (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE NOT NULL
+);
+
+-- Posts table
+CREATE TABLE IF NOT EXISTS posts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT UNIQUE NOT NULL,
+    user_uuid TEXT NOT NULL,
+    title TEXT NOT NULL,
+    content TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid)
+);
+
+-- PostCategories (Many-to-Many relation)
+CREATE TABLE IF NOT EXISTS post_categories (
+    post_uuid TEXT NOT NULL,
+    category TEXT NOT NULL,
+    FOREIGN KEY(post_uuid) REFERENCES posts(uuid)
+);
+
+-- Comments table
+CREATE TABLE IF NOT EXISTS comments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT UNIQUE NOT NULL,
+    post_uuid TEXT NOT NULL,
+    user_uuid TEXT NOT NULL,
+    content TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY(post_uuid) REFERENCES posts(uuid),
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid)
+);
+
+-- LikesDislikes table (for posts and comments)
+CREATE TABLE IF NOT EXISTS likes_dislikes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_uuid TEXT NOT NULL,
+    target_type TEXT NOT NULL CHECK(target_type IN ('post','comment')),
+    target_id INTEGER NOT NULL,
+    is_like BOOLEAN NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_uuid, target_type, target_id),
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid)
+);
+
+-- PrivateMessages table
+CREATE TABLE IF NOT EXISTS private_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    sender_uuid TEXT NOT NULL,
+    receiver_uuid TEXT NOT NULL,
+    content TEXT NOT NULL,
+    sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(sender_uuid) REFERENCES users(uuid),
+    FOREIGN KEY(receiver_uuid) REFERENCES users(uuid)
+);
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ValidationErrors maps a request field to the reason it was rejected
+type ValidationErrors map[string]string
+
+func (v ValidationErrors) add(field, message string) {
+	if _, exists := v[field]; !exists {
+		v[field] = message
+	}
+}
+
+var nicknamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+const (
+	minNicknameLength = 3
+	maxNicknameLength = 20
+	minPasswordLength = 8
+	maxPasswordBytes  = 72 // bcrypt ignores anything longer
+	maxEmailLength    = 254
+	maxNameLength     = 50
+	minAge            = 13
+	maxAge            = 120
+	// Content limits also bound the cost of rendering Markdown, which grows
+	// with the number of unclosed links in the text
+	maxPostLength    = 10000
+	maxCommentLength = 2000
+)
+
+// NormalizeEmail lower-cases and trims an email so lookups are case-insensitive
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NormalizeNickname returns the form of a nickname used for uniqueness checks
+func NormalizeNickname(nickname string) string {
+	return strings.ToLower(strings.TrimSpace(nickname))
+}
+
+// Normalize trims every field except the password and lower-cases the email
+func (req *RegisterRequest) Normalize() {
+	req.Nickname = strings.TrimSpace(req.Nickname)
+	req.Email = NormalizeEmail(req.Email)
+	req.Gender = strings.TrimSpace(req.Gender)
+	req.FirstName = strings.TrimSpace(req.FirstName)
+	req.LastName = strings.TrimSpace(req.LastName)
+}
+
+// Validate checks a normalized registration request field by field
+func (req *RegisterRequest) Validate() ValidationErrors {
+	errs := ValidationErrors{}
+
+	switch n := utf8.RuneCountInString(req.Nickname); {
+	case n == 0:
+		errs.add("nickname", "nickname is required")
+	case n < minNicknameLength || n > maxNicknameLength:
+		errs.add("nickname", "nickname must be between 3 and 20 characters")
+	case !nicknamePattern.MatchString(req.Nickname):
+		errs.add("nickname", "nickname may only contain letters, digits, '_', '.' and '-'")
+	}
+
+	if req.Email == "" {
+		errs.add("email", "email is required")
+	} else if !validEmail(req.Email) {
+		errs.add("email", "email is not a valid address")
+	}
+
+	if msg := passwordProblem(req.Password); msg != "" {
+		errs.add("password", msg)
+	}
+
+	if req.Age < minAge || req.Age > maxAge {
+		errs.add("age", "age must be between 13 and 120")
+	}
+
+	if utf8.RuneCountInString(req.Gender) > maxNameLength {
+		errs.add("gender", "gender is too long")
+	}
+	if utf8.RuneCountInString(req.FirstName) > maxNameLength {
+		errs.add("first_name", "first name is too long")
+	}
+	if utf8.RuneCountInString(req.LastName) > maxNameLength {
+		errs.add("last_name", "last name is too long")
+	}
+
+	return errs
+}
+
+// tooLong reports whether s has more than max characters
+func tooLong(s string, max int) bool {
+	return utf8.RuneCountInString(s) > max
+}
+
+func validEmail(email string) bool {
+	if len(email) > maxEmailLength {
+		return false
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return false
+	}
+	at := strings.LastIndex(email, "@")
+	return strings.Contains(email[at+1:], ".")
+}
+
+// passwordProblem returns why a password is too weak, or "" if it is acceptable
+func passwordProblem(password string) string {
+	if password == "" {
+		return "password is required"
+	}
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return "password must be at least 8 characters"
+	}
+	if len(password) > maxPasswordBytes {
+		return "password must be at most 72 bytes"
+	}
+	if strings.TrimSpace(password) != password {
+		return "password must not start or end with whitespace"
+	}
+
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return "password must contain at least one letter and one digit"
+	}
+	return ""
+}